@@ -1,10 +1,9 @@
 package main
 
 import (
-	"sync"
-
 	"github.com/JuFnd/go-proxy/configs"
 	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/app"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/lifecycle"
 	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/logger"
 	"github.com/JuFnd/go-proxy/internal/app/proxy/server"
 	"github.com/JuFnd/go-proxy/internal/app/server/delivery"
@@ -18,32 +17,72 @@ func main() {
 	logger := loggerSingleton.GetLogger()
 	app := app.Init()
 
+	switch app.Command {
+	case "":
+	case "migrate":
+		if err := migrate(app, logger); err != nil {
+			logger.Fatalln("migrate failed:", err.Error())
+		}
+		return
+	default:
+		logger.Fatalf("unknown command %q, run without one to start the proxy or use migrate", app.Command)
+	}
+
 	srvCfg := configs.GetHTTPSrvConfig(app.ConfigPath)
 	tlsCfg := configs.GetTlsConfig(app.ConfigPath)
+	storageCfg := configs.GetStorageConfig(app.ConfigPath)
+	captureCfg := configs.GetCaptureConfig(app.ConfigPath)
+	upstreamCfg := configs.GetUpstreamConfig(app.ConfigPath)
+	upstreamTLSCfg := configs.GetUpstreamTLSConfig(app.ConfigPath)
+	transportCfg := configs.GetTransportConfig(app.ConfigPath)
+	socks5Cfg := configs.GetSocks5Config(app.ConfigPath)
+	transparentCfg := configs.GetTransparentConfig(app.ConfigPath)
+	interceptCfg := configs.GetInterceptConfig(app.ConfigPath)
+	rewriteCfg := configs.GetRewriteConfig(app.ConfigPath)
+	scopeCfg := configs.GetScopeConfig(app.ConfigPath)
+	passthroughCfg := configs.GetPassthroughConfig(app.ConfigPath)
+	requestIDCfg := configs.GetRequestIDConfig(app.ConfigPath)
 	apiCfg := configs.GetWebSrvConfig(app.ConfigPsx)
 
-	requestRepo, _ := repository.GetUserRepo(&apiCfg, logger)
+	requestRepo, err := repository.New(storageCfg, captureCfg, &apiCfg, logger)
+	if err != nil {
+		logger.Fatalln("storage init failed:", err.Error())
+	}
+
 	requestUseCase := usecase.NewProxyUseCase(requestRepo)
 
-	proxy := server.New(&srvCfg, &tlsCfg, &apiCfg, requestUseCase, logger)
+	proxy := server.New(&srvCfg, &tlsCfg, &captureCfg, &upstreamCfg, &upstreamTLSCfg, &transportCfg, &socks5Cfg, &transparentCfg, &interceptCfg, &rewriteCfg, &scopeCfg, &passthroughCfg, &requestIDCfg, requestUseCase, logger)
+	if proxy == nil {
+		logger.Fatalln("proxy init failed, see the errors above")
+	}
+
 	api := delivery.GetApi(requestUseCase, proxy, &srvCfg, logger)
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	manager := lifecycle.New(srvCfg.ShutdownTimeout, logger)
+	manager.Serve("proxy", proxy.ListenAndServe, proxy.Shutdown)
+	manager.Serve("api", api.ListenAndServe, api.Shutdown)
 
-	go func() {
-		defer wg.Done()
-		if err := proxy.ListenAndServe(); err != nil {
-			logger.Fatalln(err.Error())
-		}
-	}()
+	// the proxy shutdown also stops and drains the socks5 and transparent listeners
+	if socks5Cfg.Enabled {
+		manager.Serve("socks5", proxy.ListenAndServeSOCKS5, nil)
+	}
 
-	go func() {
-		defer wg.Done()
-		if err := api.ListenAndServe(); err != nil {
-			logger.Fatalln(err.Error())
+	if transparentCfg.Enabled {
+		manager.Serve("transparent", proxy.ListenAndServeTransparent, nil)
+	}
+
+	// storage goes last, the drained listeners may still be writing to it
+	manager.OnClose("storage", requestUseCase.Close)
+	manager.OnReload(func() error {
+		reloadableCfg, err := configs.GetReloadableConfig(app.ConfigPath)
+		if err != nil {
+			return err
 		}
-	}()
 
-	wg.Wait()
+		return proxy.Reload(reloadableCfg)
+	})
+
+	if err := manager.Run(); err != nil {
+		logger.Fatalln(err.Error())
+	}
 }
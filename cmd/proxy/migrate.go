@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/app"
+	"github.com/JuFnd/go-proxy/internal/app/server/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+const migrateUsage = "usage: migrate [up | down [steps] | status]"
+
+// migrate runs the migrate subcommand against the postgres database of the
+// psx config: up applies what is pending, down reverts the newest steps
+// migrations (one by default) and status lists them.
+func migrate(app app.App, logger *logrus.Logger) error {
+	storageCfg := configs.GetStorageConfig(app.ConfigPath)
+	if storageCfg.Backend != "" && storageCfg.Backend != repository.BackendPostgres {
+		return fmt.Errorf("storage backend %s keeps no schema to migrate", storageCfg.Backend)
+	}
+
+	action := "up"
+	if len(app.Args) > 0 {
+		action = app.Args[0]
+	}
+
+	steps := 1
+	switch {
+	case action == "down" && len(app.Args) == 2:
+		n, err := strconv.Atoi(app.Args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad number of steps %q, %s", app.Args[1], migrateUsage)
+		}
+		steps = n
+	case len(app.Args) > 1:
+		return errors.New(migrateUsage)
+	}
+
+	psxCfg := configs.GetWebSrvConfig(app.ConfigPsx)
+	repo, err := repository.GetUserRepo(&psxCfg, logger)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	switch action {
+	case "up":
+		applied, err := repo.MigrateUp()
+		for _, m := range applied {
+			logger.WithField("version", m.Version).Infoln("applied migration", m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			logger.Infoln("schema is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := repo.MigrateDown(steps)
+		for _, m := range reverted {
+			logger.WithField("version", m.Version).Infoln("reverted migration", m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			logger.Infoln("no migration is applied")
+		}
+		return err
+	case "status":
+		statuses, err := repo.Migrations()
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-32s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -5,15 +5,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type HTTPSrvConfig struct {
-	ProxyPort string
-	ProxyHost string
-	WebPort   string
-	WebHost   string
+	ProxyPort       string
+	ProxyHost       string
+	WebPort         string
+	WebHost         string
+	ShutdownTimeout time.Duration
 }
 
 type WebConfig struct {
@@ -26,10 +28,149 @@ type WebConfig struct {
 }
 
 type TlsConfig struct {
-	Script   string
-	CertsDir string
-	KeyFile  string
-	CertFile string
+	CertsDir      string
+	CaCertFile    string
+	CaKeyFile     string
+	CertCacheSize int
+	CertTTL       time.Duration
+}
+
+// CaptureConfig bounds what is kept of a body: MaxBodySize the stored wire
+// bytes, MaxDecodedSize the decoded copy of an encoded body.
+type CaptureConfig struct {
+	MaxBodySize    int64
+	MaxDecodedSize int64
+}
+
+type UpstreamProxyConfig struct {
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+}
+
+type UpstreamRuleConfig struct {
+	Host string `mapstructure:"host"`
+	Via  string `mapstructure:"via"`
+}
+
+type UpstreamConfig struct {
+	Default string                `mapstructure:"default"`
+	Proxies []UpstreamProxyConfig `mapstructure:"proxies"`
+	Rules   []UpstreamRuleConfig  `mapstructure:"rules"`
+}
+
+type UpstreamTLSHostConfig struct {
+	Host               string   `mapstructure:"host"`
+	InsecureSkipVerify bool     `mapstructure:"insecure_skip_verify"`
+	RootCAs            []string `mapstructure:"root_cas"`
+	MinVersion         string   `mapstructure:"min_version"`
+	ClientCert         string   `mapstructure:"client_cert"`
+	ClientKey          string   `mapstructure:"client_key"`
+}
+
+type UpstreamTLSConfig struct {
+	InsecureSkipVerify bool                    `mapstructure:"insecure_skip_verify"`
+	RootCAs            []string                `mapstructure:"root_cas"`
+	MinVersion         string                  `mapstructure:"min_version"`
+	Hosts              []UpstreamTLSHostConfig `mapstructure:"hosts"`
+}
+
+type StorageConfig struct {
+	Backend        string `mapstructure:"backend"`
+	Path           string `mapstructure:"path"`
+	MigrateOnStart bool   `mapstructure:"migrate_on_start"`
+}
+
+type TransportConfig struct {
+	DialTimeout           time.Duration `mapstructure:"dial_timeout"`
+	KeepAlive             time.Duration `mapstructure:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `mapstructure:"idle_conn_timeout"`
+	MaxIdleConns          int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int           `mapstructure:"max_conns_per_host"`
+}
+
+type Socks5Config struct {
+	Enabled  bool
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+type TransparentConfig struct {
+	Enabled bool
+	Host    string
+	Port    string
+}
+
+type InterceptRuleConfig struct {
+	Host   string `mapstructure:"host"`
+	Method string `mapstructure:"method"`
+	Path   string `mapstructure:"path"`
+}
+
+type InterceptConfig struct {
+	Requests      bool                  `mapstructure:"requests"`
+	Responses     bool                  `mapstructure:"responses"`
+	Timeout       time.Duration         `mapstructure:"timeout"`
+	TimeoutAction string                `mapstructure:"timeout_action"`
+	Rules         []InterceptRuleConfig `mapstructure:"rules"`
+}
+
+type RewriteRuleConfig struct {
+	Name     string `mapstructure:"name"`
+	Disabled bool   `mapstructure:"disabled"`
+	Target   string `mapstructure:"target"`
+	Part     string `mapstructure:"part"`
+	Match    string `mapstructure:"match"`
+	Replace  string `mapstructure:"replace"`
+	Regex    bool   `mapstructure:"regex"`
+}
+
+type RewriteConfig struct {
+	Rules []RewriteRuleConfig `mapstructure:"rules"`
+}
+
+type ScopeRuleConfig struct {
+	Host   string `mapstructure:"host"`
+	Regex  bool   `mapstructure:"regex"`
+	Port   int    `mapstructure:"port"`
+	Scheme string `mapstructure:"scheme"`
+	Path   string `mapstructure:"path"`
+}
+
+type ScopeConfig struct {
+	Include []ScopeRuleConfig `mapstructure:"include"`
+	Exclude []ScopeRuleConfig `mapstructure:"exclude"`
+}
+
+type PassthroughConfig struct {
+	Hosts            []string      `mapstructure:"hosts"`
+	AutoDetect       bool          `mapstructure:"auto_detect"`
+	FailureThreshold int           `mapstructure:"failure_threshold"`
+	FailureWindow    time.Duration `mapstructure:"failure_window"`
+}
+
+// RequestIDConfig names the headers the id of a request travels in. Header
+// carries it back to the client, and in from the trusted clients whose own
+// id is kept. An upstream answering with its own id in Header keeps it, the
+// proxy's id then goes in X-Proxy-Request-Id. An empty UpstreamHeader leaves
+// the upstream request alone.
+type RequestIDConfig struct {
+	Header         string   `mapstructure:"header"`
+	UpstreamHeader string   `mapstructure:"upstream_header"`
+	TrustedClients []string `mapstructure:"trusted_clients"`
+}
+
+// ReloadableConfig holds the sections a running proxy picks up again on
+// SIGHUP, everything else takes a restart.
+type ReloadableConfig struct {
+	Intercept   InterceptConfig   `mapstructure:"intercept"`
+	Rewrite     RewriteConfig     `mapstructure:"rewrite"`
+	Scope       ScopeConfig       `mapstructure:"scope"`
+	Passthrough PassthroughConfig `mapstructure:"passthrough"`
 }
 
 type DbRedisCfg struct {
@@ -49,10 +190,11 @@ func GetHTTPSrvConfig(cfgPath string) HTTPSrvConfig {
 	}
 
 	return HTTPSrvConfig{
-		ProxyPort: v.GetString("proxy.port"),
-		ProxyHost: v.GetString("proxy.host"),
-		WebPort:   v.GetString("webapi.port"),
-		WebHost:   v.GetString("proxy.host"),
+		ProxyPort:       v.GetString("proxy.port"),
+		ProxyHost:       v.GetString("proxy.host"),
+		WebPort:         v.GetString("webapi.port"),
+		WebHost:         v.GetString("proxy.host"),
+		ShutdownTimeout: v.GetDuration("proxy.shutdown_timeout"),
 	}
 }
 
@@ -92,9 +234,231 @@ func GetTlsConfig(cfgPath string) TlsConfig {
 	certsDirRelPath := v.GetString("proxy.certs_dir")
 
 	return TlsConfig{
-		Script:   filepath.Join(currDir, v.GetString("proxy.certs_gen_script")),
-		CertsDir: filepath.Join(currDir, certsDirRelPath),
-		KeyFile:  filepath.Join(currDir, certsDirRelPath, v.GetString("proxy.key_file")),
-		CertFile: filepath.Join(currDir, certsDirRelPath, v.GetString("proxy.cert_file")),
+		CertsDir:      filepath.Join(currDir, certsDirRelPath),
+		CaCertFile:    filepath.Join(currDir, certsDirRelPath, v.GetString("proxy.ca_cert_file")),
+		CaKeyFile:     filepath.Join(currDir, certsDirRelPath, v.GetString("proxy.ca_key_file")),
+		CertCacheSize: v.GetInt("proxy.cert_cache_size"),
+		CertTTL:       v.GetDuration("proxy.cert_ttl"),
 	}
 }
+
+func GetCaptureConfig(cfgPath string) CaptureConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	return CaptureConfig{
+		MaxBodySize:    v.GetInt64("capture.max_body_size"),
+		MaxDecodedSize: v.GetInt64("capture.max_decoded_size"),
+	}
+}
+
+func GetUpstreamConfig(cfgPath string) UpstreamConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var upstreamCfg UpstreamConfig
+	if err := v.UnmarshalKey("upstream", &upstreamCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return upstreamCfg
+}
+
+func GetSocks5Config(cfgPath string) Socks5Config {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	return Socks5Config{
+		Enabled:  v.GetBool("socks5.enabled"),
+		Host:     v.GetString("socks5.host"),
+		Port:     v.GetString("socks5.port"),
+		Username: v.GetString("socks5.username"),
+		Password: v.GetString("socks5.password"),
+	}
+}
+
+func GetTransparentConfig(cfgPath string) TransparentConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	return TransparentConfig{
+		Enabled: v.GetBool("transparent.enabled"),
+		Host:    v.GetString("transparent.host"),
+		Port:    v.GetString("transparent.port"),
+	}
+}
+
+func GetInterceptConfig(cfgPath string) InterceptConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var interceptCfg InterceptConfig
+	if err := v.UnmarshalKey("intercept", &interceptCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return interceptCfg
+}
+
+func GetRewriteConfig(cfgPath string) RewriteConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var rewriteCfg RewriteConfig
+	if err := v.UnmarshalKey("rewrite", &rewriteCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return rewriteCfg
+}
+
+func GetScopeConfig(cfgPath string) ScopeConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var scopeCfg ScopeConfig
+	if err := v.UnmarshalKey("scope", &scopeCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return scopeCfg
+}
+
+func GetPassthroughConfig(cfgPath string) PassthroughConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var passthroughCfg PassthroughConfig
+	if err := v.UnmarshalKey("passthrough", &passthroughCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return passthroughCfg
+}
+
+func GetUpstreamTLSConfig(cfgPath string) UpstreamTLSConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var upstreamTLSCfg UpstreamTLSConfig
+	if err := v.UnmarshalKey("upstream_tls", &upstreamTLSCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return upstreamTLSCfg
+}
+
+func GetTransportConfig(cfgPath string) TransportConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var transportCfg TransportConfig
+	if err := v.UnmarshalKey("transport", &transportCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return transportCfg
+}
+
+// GetReloadableConfig reads the file again without exiting on errors, a
+// running process keeps its configuration when the new one is broken.
+func GetReloadableConfig(cfgPath string) (ReloadableConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := v.ReadInConfig(); err != nil {
+		return ReloadableConfig{}, err
+	}
+
+	var reloadableCfg ReloadableConfig
+	if err := v.Unmarshal(&reloadableCfg); err != nil {
+		return ReloadableConfig{}, err
+	}
+
+	return reloadableCfg, nil
+}
+
+func GetStorageConfig(cfgPath string) StorageConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var storageCfg StorageConfig
+	if err := v.UnmarshalKey("storage", &storageCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return storageCfg
+}
+
+func GetRequestIDConfig(cfgPath string) RequestIDConfig {
+	v := viper.GetViper()
+	v.SetConfigFile(cfgPath)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgPath), "."))
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	var requestIDCfg RequestIDConfig
+	if err := v.UnmarshalKey("request_id", &requestIDCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	return requestIDCfg
+}
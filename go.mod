@@ -3,6 +3,7 @@ module github.com/JuFnd/go-proxy
 go 1.21.2
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/gorilla/mux v1.8.1
 	github.com/jackc/pgx v3.6.2+incompatible
 	github.com/sirupsen/logrus v1.9.3
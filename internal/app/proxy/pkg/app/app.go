@@ -6,6 +6,9 @@ type App struct {
 	ConfigPath      string
 	ConfigRedisPath string
 	ConfigPsx       string
+	// Command is the subcommand named after the flags, empty to run the proxy.
+	Command string
+	Args    []string
 }
 
 func Init() App {
@@ -16,5 +19,10 @@ func Init() App {
 	flag.StringVar(&app.ConfigPsx, "a", "configs/psx_config.yaml", "path to config psx file")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		app.Command = flag.Arg(0)
+		app.Args = flag.Args()[1:]
+	}
+
 	return app
 }
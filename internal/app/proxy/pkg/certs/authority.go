@@ -0,0 +1,199 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheSize = 1024
+	DefaultTTL       = 24 * time.Hour
+
+	// leaves are backdated to tolerate clients with a slightly skewed clock
+	notBeforeSkew = time.Hour
+)
+
+type Authority struct {
+	caCert  *x509.Certificate
+	caKey   crypto.Signer
+	leafKey crypto.Signer
+	ttl     time.Duration
+	cache   *lruCache
+
+	mu       sync.Mutex
+	inflight map[string]*mintCall
+}
+
+type mintCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func NewAuthority(caCertFile, caKeyFile string, cacheSize int, ttl time.Duration) (*Authority, error) {
+	caCertPEM, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert err: %w", err)
+	}
+
+	caKeyPEM, err := os.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca key err: %w", err)
+	}
+
+	caPair, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load ca key pair err: %w", err)
+	}
+
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse ca cert err: %w", err)
+	}
+
+	if !caCert.IsCA {
+		return nil, errors.New("ca cert is not a certificate authority")
+	}
+
+	caKey, ok := caPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("ca key does not support signing")
+	}
+
+	// a single key is shared by every leaf, generating one per host would
+	// make each cache miss noticeably slower without adding anything
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate leaf key err: %w", err)
+	}
+
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Authority{
+		caCert:   caCert,
+		caKey:    caKey,
+		leafKey:  leafKey,
+		ttl:      ttl,
+		cache:    newLRUCache(cacheSize),
+		inflight: make(map[string]*mintCall),
+	}, nil
+}
+
+func (a *Authority) Certificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	if host == "" {
+		return nil, errors.New("empty host")
+	}
+
+	if cert, ok := a.cache.get(host, time.Now()); ok {
+		return cert, nil
+	}
+
+	a.mu.Lock()
+	if call, ok := a.inflight[host]; ok {
+		a.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+
+	call := &mintCall{done: make(chan struct{})}
+	a.inflight[host] = call
+	a.mu.Unlock()
+
+	call.cert, call.err = a.mint(host)
+
+	a.mu.Lock()
+	delete(a.inflight, host)
+	a.mu.Unlock()
+	close(call.done)
+
+	return call.cert, call.err
+}
+
+func (a *Authority) mint(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial err: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(a.ttl)
+	if notAfter.After(a.caCert.NotAfter) {
+		notAfter = a.caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName(host)},
+		NotBefore:             now.Add(-notBeforeSkew),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.caCert, a.leafKey.Public(), a.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate err: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate err: %w", err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.caCert.Raw},
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}
+
+	// drop the entry well before the leaf itself expires so a cached
+	// certificate never reaches a client on its last valid second
+	a.cache.put(host, cert, now.Add(notAfter.Sub(now)/2))
+
+	return cert, nil
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
+
+func commonName(host string) string {
+	// CN is limited to 64 bytes, the SAN is what clients actually check
+	if len(host) > 64 {
+		return host[:64]
+	}
+
+	return host
+}
@@ -0,0 +1,190 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCA writes a CA valid for caValidity to a temporary directory and
+// returns the paths of its certificate and key.
+func newTestCA(t *testing.T, caValidity time.Duration) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	caCert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	return certFile, keyFile, roots
+}
+
+func TestAuthorityCertificate(t *testing.T) {
+	certFile, keyFile, roots := newTestCA(t, 365*24*time.Hour)
+
+	tests := []struct {
+		name   string
+		host   string
+		verify string
+	}{
+		{name: "dns name", host: "example.com", verify: "example.com"},
+		{name: "host and port", host: "Example.COM:443", verify: "example.com"},
+		{name: "trailing dot", host: "example.org.", verify: "example.org"},
+		{name: "ipv4", host: "192.0.2.1:8443", verify: "192.0.2.1"},
+		{name: "ipv6", host: "[2001:db8::1]:443", verify: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority, err := NewAuthority(certFile, keyFile, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, err := authority.Certificate(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: tt.verify, Roots: roots}); err != nil {
+				t.Errorf("leaf for %q does not verify as %q: %v", tt.host, tt.verify, err)
+			}
+
+			if validity := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); validity > DefaultTTL+notBeforeSkew {
+				t.Errorf("leaf is valid for %v, want at most the default ttl", validity)
+			}
+
+			again, err := authority.Certificate(tt.verify)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != cert {
+				t.Errorf("%q and %q minted two certificates, want the cached one", tt.host, tt.verify)
+			}
+		})
+	}
+
+	authority, err := NewAuthority(certFile, keyFile, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authority.Certificate("[]:443"); err == nil {
+		t.Error("minted a certificate for an empty host")
+	}
+}
+
+func TestAuthorityCache(t *testing.T) {
+	certFile, keyFile, _ := newTestCA(t, 365*24*time.Hour)
+
+	t.Run("evicts beyond its size", func(t *testing.T) {
+		authority, err := NewAuthority(certFile, keyFile, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first, _ := authority.Certificate("a.example")
+		authority.Certificate("b.example")
+		if again, _ := authority.Certificate("a.example"); again == first {
+			t.Error("a.example was served from a cache of one after b.example")
+		}
+	})
+
+	t.Run("leaf capped by the ca", func(t *testing.T) {
+		shortFile, shortKey, _ := newTestCA(t, time.Hour)
+		authority, err := NewAuthority(shortFile, shortKey, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := authority.Certificate("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.NotAfter.After(time.Now().Add(time.Hour)) {
+			t.Errorf("leaf outlives its ca: not after %v", cert.Leaf.NotAfter)
+		}
+	})
+
+	t.Run("cached for half the ttl", func(t *testing.T) {
+		authority, err := NewAuthority(certFile, keyFile, 0, 2*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, _ := authority.Certificate("example.com")
+		if _, hit := authority.cache.get("example.com", time.Now().Add(59*time.Minute)); !hit {
+			t.Error("entry expired before half the ttl")
+		}
+		if _, hit := authority.cache.get("example.com", time.Now().Add(61*time.Minute)); hit {
+			t.Error("entry outlived half the ttl")
+		}
+		if again, _ := authority.Certificate("example.com"); again == cert {
+			t.Error("expired entry was served again")
+		}
+	})
+
+	t.Run("concurrent misses mint once", func(t *testing.T) {
+		authority, err := NewAuthority(certFile, keyFile, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const callers = 16
+		certs := make(chan interface{}, callers)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cert, _ := authority.Certificate("example.com")
+				certs <- cert
+			}()
+		}
+		wg.Wait()
+		close(certs)
+
+		first := <-certs
+		for cert := range certs {
+			if cert != first {
+				t.Fatal("concurrent callers got different certificates")
+			}
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package certs
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	host      string
+	cert      *tls.Certificate
+	expiresAt time.Time
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLRUCache(size int) *lruCache {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lruCache) get(host string, now time.Time) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, host)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.cert, true
+}
+
+func (c *lruCache) put(host string, cert *tls.Certificate, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[host]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.cert = cert
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[host] = c.order.PushFront(&cacheEntry{host: host, cert: cert, expiresAt: expiresAt})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).host)
+	}
+}
@@ -0,0 +1,124 @@
+package certs
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+
+	type op struct {
+		put     bool
+		host    string
+		expires time.Time
+		at      time.Time
+		// hit is what a get expects, ignored for puts
+		hit bool
+	}
+
+	tests := []struct {
+		name string
+		size int
+		ops  []op
+	}{
+		{
+			name: "miss on empty",
+			size: 2,
+			ops:  []op{{host: "a", at: now}},
+		},
+		{
+			name: "hit before expiry",
+			size: 2,
+			ops: []op{
+				{put: true, host: "a", expires: later},
+				{host: "a", at: later.Add(-time.Nanosecond), hit: true},
+			},
+		},
+		{
+			name: "expired at the deadline",
+			size: 2,
+			ops: []op{
+				{put: true, host: "a", expires: later},
+				{host: "a", at: later},
+				// the expired entry is gone, not just hidden
+				{host: "a", at: now},
+			},
+		},
+		{
+			name: "oldest evicted",
+			size: 2,
+			ops: []op{
+				{put: true, host: "a", expires: later},
+				{put: true, host: "b", expires: later},
+				{put: true, host: "c", expires: later},
+				{host: "a", at: now},
+				{host: "b", at: now, hit: true},
+				{host: "c", at: now, hit: true},
+			},
+		},
+		{
+			name: "get refreshes recency",
+			size: 2,
+			ops: []op{
+				{put: true, host: "a", expires: later},
+				{put: true, host: "b", expires: later},
+				{host: "a", at: now, hit: true},
+				{put: true, host: "c", expires: later},
+				{host: "a", at: now, hit: true},
+				{host: "b", at: now},
+			},
+		},
+		{
+			name: "put replaces and refreshes",
+			size: 2,
+			ops: []op{
+				{put: true, host: "a", expires: now},
+				{put: true, host: "b", expires: later},
+				{put: true, host: "a", expires: later},
+				{put: true, host: "c", expires: later},
+				{host: "a", at: now, hit: true},
+				{host: "b", at: now},
+			},
+		},
+		{
+			name: "size below one keeps one",
+			size: 0,
+			ops: []op{
+				{put: true, host: "a", expires: later},
+				{put: true, host: "b", expires: later},
+				{host: "a", at: now},
+				{host: "b", at: now, hit: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newLRUCache(tt.size)
+			certs := make(map[string]*tls.Certificate)
+
+			for i, op := range tt.ops {
+				if op.put {
+					certs[op.host] = &tls.Certificate{}
+					cache.put(op.host, certs[op.host], op.expires)
+					continue
+				}
+
+				cert, hit := cache.get(op.host, op.at)
+				if hit != op.hit {
+					t.Fatalf("op %d: get(%q) hit = %v, want %v", i, op.host, hit, op.hit)
+				}
+				if hit && cert != certs[op.host] {
+					t.Fatalf("op %d: get(%q) returned a stale certificate", i, op.host)
+				}
+			}
+
+			if cache.order.Len() != len(cache.entries) {
+				t.Errorf("list holds %d entries, map %d", cache.order.Len(), len(cache.entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package intercept
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+const (
+	KindRequest  = "request"
+	KindResponse = "response"
+
+	ActionForward = "forward"
+	ActionDrop    = "drop"
+	ActionRespond = "respond"
+
+	defaultTimeout = time.Minute
+)
+
+var (
+	ErrNotFound      = errors.New("intercepted item not found")
+	ErrInvalidAction = errors.New("invalid intercept action")
+)
+
+type Rule struct {
+	Host   string `json:"host"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// Settings can be changed at runtime, an empty rule list holds everything
+// once requests or responses are switched on.
+type Settings struct {
+	Requests  bool   `json:"requests"`
+	Responses bool   `json:"responses"`
+	Rules     []Rule `json:"rules"`
+}
+
+// Item is a request or response waiting for a decision. For a response
+// Method and URL describe the request it answers.
+type Item struct {
+	Id           int64               `json:"id"`
+	Kind         string              `json:"kind"`
+	ConnectionId string              `json:"connection_id"`
+	Method       string              `json:"method"`
+	URL          string              `json:"url"`
+	Code         int                 `json:"code,omitempty"`
+	Headers      map[string][]string `json:"headers"`
+	Body         []byte              `json:"body"`
+	HeldAt       time.Time           `json:"held_at"`
+	Deadline     time.Time           `json:"deadline"`
+
+	decision chan Decision
+}
+
+// Decision releases a held item. Empty fields keep the held values, a nil
+// Body keeps the held body while an empty one clears it. Code, Headers and
+// Body of a respond decision on a request make up the canned response.
+type Decision struct {
+	Action  string              `json:"action"`
+	Method  string              `json:"method,omitempty"`
+	URL     string              `json:"url,omitempty"`
+	Code    int                 `json:"code,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+type Queue struct {
+	mu            sync.Mutex
+	settings      Settings
+	timeout       time.Duration
+	timeoutAction string
+	nextId        int64
+	items         map[int64]*Item
+}
+
+func NewQueue(cfg configs.InterceptConfig) (*Queue, error) {
+	q := &Queue{items: make(map[int64]*Item)}
+	if err := q.Reload(cfg); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Reload applies cfg as SetSettings would and takes over its timeout, items
+// already held keep their deadline.
+func (q *Queue) Reload(cfg configs.InterceptConfig) error {
+	timeoutAction := cfg.TimeoutAction
+	if timeoutAction == "" {
+		timeoutAction = ActionForward
+	}
+
+	if timeoutAction != ActionForward && timeoutAction != ActionDrop {
+		return fmt.Errorf("intercept timeout action must be %s or %s, got %q", ActionForward, ActionDrop, cfg.TimeoutAction)
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	settings := Settings{Requests: cfg.Requests, Responses: cfg.Responses}
+	for _, ruleCfg := range cfg.Rules {
+		settings.Rules = append(settings.Rules, Rule{Host: ruleCfg.Host, Method: ruleCfg.Method, Path: ruleCfg.Path})
+	}
+
+	if err := q.SetSettings(settings); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.timeout = timeout
+	q.timeoutAction = timeoutAction
+	return nil
+}
+
+func validateRules(rules []Rule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(strings.ToLower(rule.Host), ""); err != nil {
+			return fmt.Errorf("intercept rule host %q: %w", rule.Host, err)
+		}
+	}
+
+	return nil
+}
+
+func (q *Queue) Settings() Settings {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.settings
+}
+
+// SetSettings replaces the settings, items of a kind that is no longer held
+// are forwarded unchanged.
+func (q *Queue) SetSettings(settings Settings) error {
+	if err := validateRules(settings.Rules); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.settings = settings
+	for id, item := range q.items {
+		if (item.Kind == KindRequest && !settings.Requests) || (item.Kind == KindResponse && !settings.Responses) {
+			delete(q.items, id)
+			item.decision <- Decision{Action: ActionForward}
+		}
+	}
+
+	return nil
+}
+
+// Matches reports whether an item of the given kind for this request should
+// be held.
+func (q *Queue) Matches(kind, method, host, urlPath string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if (kind == KindRequest && !q.settings.Requests) || (kind == KindResponse && !q.settings.Responses) {
+		return false
+	}
+
+	if len(q.settings.Rules) == 0 {
+		return true
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, rule := range q.settings.Rules {
+		if rule.Host != "" {
+			if ok, _ := path.Match(strings.ToLower(rule.Host), host); !ok {
+				continue
+			}
+		}
+
+		if rule.Method != "" && !strings.EqualFold(rule.Method, method) {
+			continue
+		}
+
+		if rule.Path != "" && !strings.HasPrefix(urlPath, rule.Path) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Hold queues the item and blocks until it is released through Resolve or
+// its deadline passes, in which case the timeout action is returned. An item
+// whose client goes away while it is held is dropped.
+func (q *Queue) Hold(ctx context.Context, item *Item) Decision {
+	q.mu.Lock()
+	q.nextId++
+	item.Id = q.nextId
+	item.HeldAt = time.Now()
+	item.Deadline = item.HeldAt.Add(q.timeout)
+	item.decision = make(chan Decision, 1)
+	q.items[item.Id] = item
+	timeout, timeoutAction := q.timeout, q.timeoutAction
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	expired := Decision{Action: timeoutAction}
+	select {
+	case decision := <-item.decision:
+		return decision
+	case <-timer.C:
+	case <-ctx.Done():
+		expired = Decision{Action: ActionDrop}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// a decision may have raced with the timer
+	select {
+	case decision := <-item.decision:
+		return decision
+	default:
+	}
+
+	delete(q.items, item.Id)
+	return expired
+}
+
+func (q *Queue) List() []*Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]*Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+
+	// ids grow with time, listing them in order shows the oldest first
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+
+	return items
+}
+
+func (q *Queue) Resolve(id int64, decision Decision) error {
+	switch decision.Action {
+	case ActionForward, ActionDrop, ActionRespond:
+	default:
+		return fmt.Errorf("%w %q", ErrInvalidAction, decision.Action)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(q.items, id)
+	item.decision <- decision
+	return nil
+}
@@ -0,0 +1,231 @@
+package intercept
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+func TestQueueMatches(t *testing.T) {
+	rules := []configs.InterceptRuleConfig{
+		{Host: "*.Example.com", Method: "post"},
+		{Host: "api.test", Path: "/v1/"},
+	}
+
+	tests := []struct {
+		name   string
+		cfg    configs.InterceptConfig
+		kind   string
+		method string
+		host   string
+		path   string
+		want   bool
+	}{
+		{name: "nothing held", cfg: configs.InterceptConfig{}, kind: KindRequest, method: "GET", host: "example.com", path: "/"},
+		{name: "requests only", cfg: configs.InterceptConfig{Requests: true}, kind: KindResponse, method: "GET", host: "example.com", path: "/"},
+		{name: "no rules hold everything", cfg: configs.InterceptConfig{Requests: true}, kind: KindRequest, method: "GET", host: "example.com", path: "/", want: true},
+		{name: "host and method", cfg: configs.InterceptConfig{Requests: true, Rules: rules}, kind: KindRequest, method: "POST", host: "www.example.com", path: "/", want: true},
+		{name: "host with port", cfg: configs.InterceptConfig{Requests: true, Rules: rules}, kind: KindRequest, method: "POST", host: "WWW.example.com:8443", path: "/", want: true},
+		{name: "method differs", cfg: configs.InterceptConfig{Requests: true, Rules: rules}, kind: KindRequest, method: "GET", host: "www.example.com", path: "/"},
+		{name: "bare domain misses the wildcard", cfg: configs.InterceptConfig{Requests: true, Rules: rules}, kind: KindRequest, method: "POST", host: "example.com", path: "/"},
+		{name: "path prefix", cfg: configs.InterceptConfig{Responses: true, Rules: rules}, kind: KindResponse, method: "GET", host: "api.test", path: "/v1/users", want: true},
+		{name: "path outside the prefix", cfg: configs.InterceptConfig{Responses: true, Rules: rules}, kind: KindResponse, method: "GET", host: "api.test", path: "/v2/users"},
+		{name: "ipv6 host", cfg: configs.InterceptConfig{Requests: true, Rules: []configs.InterceptRuleConfig{{Host: "2001:db8::1"}}}, kind: KindRequest, method: "GET", host: "[2001:db8::1]:443", path: "/", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQueue(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := q.Matches(tt.kind, tt.method, tt.host, tt.path); got != tt.want {
+				t.Errorf("Matches(%s %s %s%s) = %v, want %v", tt.kind, tt.method, tt.host, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewQueueRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  configs.InterceptConfig
+	}{
+		{name: "timeout action", cfg: configs.InterceptConfig{TimeoutAction: ActionRespond}},
+		{name: "bad host pattern", cfg: configs.InterceptConfig{Rules: []configs.InterceptRuleConfig{{Host: "[a-"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewQueue(tt.cfg); err == nil {
+				t.Error("NewQueue() accepted the configuration")
+			}
+		})
+	}
+}
+
+// held waits until the queue holds n items and returns them.
+func held(t *testing.T, q *Queue, n int) []*Item {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if items := q.List(); len(items) == n {
+			return items
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("queue never held %d items, holds %d", n, len(q.List()))
+	return nil
+}
+
+func TestQueueHold(t *testing.T) {
+	body := []byte("edited")
+
+	tests := []struct {
+		name    string
+		cfg     configs.InterceptConfig
+		decide  func(q *Queue, item *Item) error
+		cancel  bool
+		want    Decision
+		wantErr error
+	}{
+		{
+			name: "forward",
+			cfg:  configs.InterceptConfig{Requests: true},
+			decide: func(q *Queue, item *Item) error {
+				return q.Resolve(item.Id, Decision{Action: ActionForward, Body: body})
+			},
+			want: Decision{Action: ActionForward, Body: body},
+		},
+		{
+			name: "respond",
+			cfg:  configs.InterceptConfig{Requests: true},
+			decide: func(q *Queue, item *Item) error {
+				return q.Resolve(item.Id, Decision{Action: ActionRespond, Code: 418})
+			},
+			want: Decision{Action: ActionRespond, Code: 418},
+		},
+		{
+			name: "invalid action keeps the item",
+			cfg:  configs.InterceptConfig{Requests: true, Timeout: 50 * time.Millisecond},
+			decide: func(q *Queue, item *Item) error {
+				return q.Resolve(item.Id, Decision{Action: "hold"})
+			},
+			want:    Decision{Action: ActionForward},
+			wantErr: ErrInvalidAction,
+		},
+		{
+			name: "unknown item",
+			cfg:  configs.InterceptConfig{Requests: true, Timeout: 50 * time.Millisecond},
+			decide: func(q *Queue, item *Item) error {
+				return q.Resolve(item.Id+1, Decision{Action: ActionDrop})
+			},
+			want:    Decision{Action: ActionForward},
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "timeout forwards",
+			cfg:  configs.InterceptConfig{Requests: true, Timeout: 20 * time.Millisecond},
+			want: Decision{Action: ActionForward},
+		},
+		{
+			name: "timeout drops",
+			cfg:  configs.InterceptConfig{Requests: true, Timeout: 20 * time.Millisecond, TimeoutAction: ActionDrop},
+			want: Decision{Action: ActionDrop},
+		},
+		{
+			name:   "client gone",
+			cfg:    configs.InterceptConfig{Requests: true},
+			cancel: true,
+			want:   Decision{Action: ActionDrop},
+		},
+		{
+			name: "switched off",
+			cfg:  configs.InterceptConfig{Requests: true},
+			decide: func(q *Queue, item *Item) error {
+				return q.SetSettings(Settings{Responses: true})
+			},
+			want: Decision{Action: ActionForward},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQueue(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			decisions := make(chan Decision, 1)
+			go func() {
+				decisions <- q.Hold(ctx, &Item{Kind: KindRequest, Method: "GET", URL: "http://example.com/"})
+			}()
+
+			item := held(t, q, 1)[0]
+			if item.Deadline.Sub(item.HeldAt) <= 0 {
+				t.Errorf("item held at %v has deadline %v", item.HeldAt, item.Deadline)
+			}
+
+			if tt.decide != nil {
+				if err = tt.decide(q, item); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("decision error = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if tt.cancel {
+				cancel()
+			}
+
+			select {
+			case got := <-decisions:
+				if got.Action != tt.want.Action || got.Code != tt.want.Code || string(got.Body) != string(tt.want.Body) {
+					t.Errorf("Hold() = %+v, want %+v", got, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Hold() never returned")
+			}
+
+			if items := q.List(); len(items) != 0 {
+				t.Errorf("queue still holds %d items after the decision", len(items))
+			}
+		})
+	}
+}
+
+func TestQueueListsOldestFirst(t *testing.T) {
+	q, err := NewQueue(configs.InterceptConfig{Requests: true, Responses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []string{KindRequest, KindResponse, KindRequest} {
+		go q.Hold(context.Background(), &Item{Kind: kind})
+		// one at a time, so the ids follow the order above
+		held(t, q, len(q.List())+1)
+	}
+
+	items := q.List()
+	for i, item := range items {
+		if item.Id != int64(i+1) {
+			t.Errorf("item %d has id %d, want %d", i, item.Id, i+1)
+		}
+	}
+
+	// switching responses off releases only the held response
+	q.SetSettings(Settings{Requests: true})
+	if items = held(t, q, 2); items[0].Kind != KindRequest || items[1].Kind != KindRequest {
+		t.Errorf("left %s and %s held, want the two requests", items[0].Kind, items[1].Kind)
+	}
+
+	for _, item := range items {
+		q.Resolve(item.Id, Decision{Action: ActionDrop})
+	}
+}
@@ -0,0 +1,177 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+type service struct {
+	name     string
+	serve    func() error
+	shutdown func(context.Context) error
+}
+
+type closer struct {
+	name  string
+	close func() error
+}
+
+// Manager runs the listeners of the process and takes them down together.
+// SIGINT and SIGTERM stop every service and give in-flight work the drain
+// timeout to finish, a second signal cuts the drain short. Closers run once
+// every service has stopped, SIGHUP runs the reload hooks.
+type Manager struct {
+	logger       *logrus.Logger
+	drainTimeout time.Duration
+	services     []service
+	closers      []closer
+	reloads      []func() error
+}
+
+func New(drainTimeout time.Duration, logger *logrus.Logger) *Manager {
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	return &Manager{logger: logger, drainTimeout: drainTimeout}
+}
+
+// Serve registers a service, serve blocks until the service stops and
+// returns nil when that was caused by shutdown. A nil shutdown is for
+// services stopped by the shutdown of another one.
+func (m *Manager) Serve(name string, serve func() error, shutdown func(context.Context) error) {
+	m.services = append(m.services, service{name: name, serve: serve, shutdown: shutdown})
+}
+
+// OnClose registers a resource released after all services have drained,
+// closers run in the order they were registered.
+func (m *Manager) OnClose(name string, close func() error) {
+	m.closers = append(m.closers, closer{name: name, close: close})
+}
+
+func (m *Manager) OnReload(reload func() error) {
+	m.reloads = append(m.reloads, reload)
+}
+
+// Run starts every service and blocks until a signal or a failing service
+// ends the process, it returns the error of the service that failed first.
+func (m *Manager) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	stopped := make(chan error, len(m.services))
+	for _, s := range m.services {
+		go func(s service) {
+			err := s.serve()
+			if err != nil {
+				err = fmt.Errorf("%s: %w", s.name, err)
+			}
+			stopped <- err
+		}(s)
+	}
+
+	var runErr error
+	running := len(m.services)
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				m.reload()
+				continue
+			}
+
+			m.logger.Infof("received %s, shutting down", sig)
+			break wait
+		case err := <-stopped:
+			running--
+			if err != nil {
+				m.logger.Errorln("service failed:", err.Error())
+				runErr = err
+				break wait
+			}
+			if running == 0 {
+				break wait
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout)
+	defer cancel()
+
+	// a second signal while draining means the operator is done waiting
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					continue
+				}
+
+				m.logger.Warnf("received %s while draining, closing what is left", sig)
+				cancel()
+			case <-ctx.Done():
+			}
+			return
+		}
+	}()
+
+	m.shutdown(ctx)
+
+	for _, c := range m.closers {
+		if err := c.close(); err != nil {
+			m.logger.WithField("resource", c.name).Errorln("close failed:", err.Error())
+		}
+	}
+
+	return runErr
+}
+
+func (m *Manager) shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range m.services {
+		if s.shutdown == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s service) {
+			defer wg.Done()
+
+			err := s.shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				m.logger.WithField("service", s.name).Warnln("drain did not finish in time, open connections were closed")
+				return
+			}
+			if err != nil {
+				m.logger.WithField("service", s.name).Errorln("shutdown failed:", err.Error())
+			}
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+func (m *Manager) reload() {
+	m.logger.Infoln("received SIGHUP, reloading configuration")
+
+	for _, reload := range m.reloads {
+		if err := reload(); err != nil {
+			m.logger.Errorln("configuration reload failed, keeping the current one:", err.Error())
+			return
+		}
+	}
+
+	m.logger.Infoln("configuration reloaded")
+}
@@ -0,0 +1,99 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestManagerRun(t *testing.T) {
+	errFailed := errors.New("listener failed")
+
+	tests := []struct {
+		name string
+		// drain is how long the surviving service takes to shut down
+		drain   time.Duration
+		timeout time.Duration
+		want    error
+		// wantCtx is what the shutdown context ended with, nil when the
+		// service drained in time
+		wantCtx error
+	}{
+		{name: "drained", drain: time.Millisecond, timeout: time.Second, want: errFailed},
+		{name: "deadline", drain: time.Minute, timeout: 50 * time.Millisecond, want: errFailed, wantCtx: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			m := New(tt.timeout, logger)
+
+			var order []string
+			stop := make(chan struct{})
+			var ctxErr error
+			m.Serve("proxy", func() error {
+				<-stop
+				return nil
+			}, func(ctx context.Context) error {
+				defer close(stop)
+				select {
+				case <-time.After(tt.drain):
+					return nil
+				case <-ctx.Done():
+					ctxErr = ctx.Err()
+					return ctxErr
+				}
+			})
+			m.Serve("api", func() error {
+				return errFailed
+			}, nil)
+			m.OnClose("db", func() error {
+				order = append(order, "db")
+				return nil
+			})
+			m.OnClose("certs", func() error {
+				order = append(order, "certs")
+				return errors.New("already closed")
+			})
+
+			err := m.Run()
+			if !errors.Is(err, tt.want) || !strings.HasPrefix(err.Error(), "api: ") {
+				t.Fatalf("Run() = %v, want %v from api", err, tt.want)
+			}
+			if !errors.Is(ctxErr, tt.wantCtx) {
+				t.Errorf("shutdown context ended with %v, want %v", ctxErr, tt.wantCtx)
+			}
+			if strings.Join(order, ",") != "db,certs" {
+				t.Errorf("closers ran as %v, want db,certs", order)
+			}
+		})
+	}
+}
+
+func TestManagerRunStopsWhenServicesEnd(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	m := New(0, logger)
+	if m.drainTimeout != defaultDrainTimeout {
+		t.Errorf("drain timeout = %s, want the default %s", m.drainTimeout, defaultDrainTimeout)
+	}
+
+	shutdowns := 0
+	m.Serve("proxy", func() error { return nil }, func(context.Context) error {
+		shutdowns++
+		return nil
+	})
+
+	if err := m.Run(); err != nil {
+		t.Fatalf("Run() = %v after a clean stop", err)
+	}
+	if shutdowns != 1 {
+		t.Errorf("shutdown ran %d times, want once", shutdowns)
+	}
+}
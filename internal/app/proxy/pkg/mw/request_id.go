@@ -2,10 +2,27 @@ package mw
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/JuFnd/go-proxy/configs"
 )
 
-const requestIDLen = 8
+const (
+	requestIDLen = 8
+	// maxInboundIDLen bounds the ids trusted clients may bring, longer ones
+	// are replaced like the ids of anyone else.
+	maxInboundIDLen = 64
+
+	// proxyRequestIDHeader is the header the id goes in by default, and the
+	// one it falls back to when the upstream answers with its own id in the
+	// configured header.
+	proxyRequestIDHeader = "X-Proxy-Request-Id"
+)
 
 var requestIDKey = struct{}{}
 
@@ -22,9 +39,144 @@ func SetRequestID(ctx context.Context, reqID string) context.Context {
 	return context.WithValue(ctx, requestIDKey, reqID)
 }
 
-func RequestID(next http.Handler) http.Handler {
+func NewRequestID() string {
+	return randomString(requestIDLen)
+}
+
+// RequestIDs hands out the ids requests are logged, stored and answered
+// under. A request from a trusted client keeps the id it came with, every
+// other one gets a new id.
+type RequestIDs struct {
+	header         string
+	upstreamHeader string
+	trusted        []netip.Prefix
+}
+
+func NewRequestIDs(cfg configs.RequestIDConfig) (*RequestIDs, error) {
+	header := cfg.Header
+	if header == "" {
+		header = proxyRequestIDHeader
+	}
+
+	for _, name := range []string{header, cfg.UpstreamHeader} {
+		if strings.ContainsAny(name, " :\t\r\n") {
+			return nil, fmt.Errorf("request id header %q is not a valid header name", name)
+		}
+	}
+
+	trusted := make([]netip.Prefix, 0, len(cfg.TrustedClients))
+	for _, client := range cfg.TrustedClients {
+		prefix, err := netip.ParsePrefix(client)
+		if err != nil {
+			addr, errAddr := netip.ParseAddr(client)
+			if errAddr != nil {
+				return nil, fmt.Errorf("trusted client %q is neither an address nor a cidr", client)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		trusted = append(trusted, prefix.Masked())
+	}
+
+	return &RequestIDs{
+		header:         http.CanonicalHeaderKey(header),
+		upstreamHeader: http.CanonicalHeaderKey(cfg.UpstreamHeader),
+		trusted:        trusted,
+	}, nil
+}
+
+// Header is the header the id is returned to the client in.
+func (ids *RequestIDs) Header() string {
+	return ids.header
+}
+
+// UpstreamHeader is the header the id is sent upstream in, empty when it is
+// not sent.
+func (ids *RequestIDs) UpstreamHeader() string {
+	return ids.upstreamHeader
+}
+
+// Assign picks the id of r and sets it on the response, handlers that copy
+// the headers of another response over call Respond afterwards. An inbound id
+// that is not kept is removed from r, so it is neither forwarded nor recorded
+// as if the proxy had vouched for it.
+func (ids *RequestIDs) Assign(w http.ResponseWriter, r *http.Request) string {
+	reqID := r.Header.Get(ids.header)
+	if !validInboundID(reqID) || !ids.trusts(r.RemoteAddr) {
+		r.Header.Del(ids.header)
+		reqID = NewRequestID()
+	}
+
+	w.Header().Set(ids.header, reqID)
+	return reqID
+}
+
+// Respond sets the id on dst, the headers answered with after those of the
+// upstream response have been copied over. The upstream's own id in the
+// configured header is kept, the proxy's id then goes in X-Proxy-Request-Id
+// unless the upstream already uses that one too.
+func (ids *RequestIDs) Respond(dst, upstream http.Header, reqID string) {
+	sent := upstream.Values(ids.header)
+	if len(sent) == 0 {
+		dst.Set(ids.header, reqID)
+		return
+	}
+
+	// drop the id Assign set before the upstream answered
+	dst[ids.header] = append([]string(nil), sent...)
+	if slices.Contains(sent, reqID) || ids.header == proxyRequestIDHeader || len(upstream.Values(proxyRequestIDHeader)) > 0 {
+		return
+	}
+
+	dst.Set(proxyRequestIDHeader, reqID)
+}
+
+func (ids *RequestIDs) trusts(remoteAddr string) bool {
+	if len(ids.trusted) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range ids.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validInboundID keeps the ids that are safe to log and to put in headers.
+func validInboundID(reqID string) bool {
+	if reqID == "" || len(reqID) > maxInboundIDLen {
+		return false
+	}
+
+	for _, c := range reqID {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func RequestID(ids *RequestIDs, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqID := randomString(requestIDLen)
+		reqID := ids.Assign(w, r)
 		r = r.WithContext(SetRequestID(r.Context(), reqID))
 
 		next.ServeHTTP(w, r)
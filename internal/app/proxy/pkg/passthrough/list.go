@@ -0,0 +1,202 @@
+package passthrough
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultFailureWindow    = 5 * time.Minute
+)
+
+type Entry struct {
+	Host    string    `json:"host"`
+	Auto    bool      `json:"auto"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type failures struct {
+	count int
+	first time.Time
+}
+
+// List holds the hosts whose TLS is tunneled byte for byte instead of being
+// intercepted. Configured entries are host globs, hosts whose clients keep
+// rejecting the minted certificate are added on their own when auto
+// detection is on.
+type List struct {
+	mu        sync.Mutex
+	patterns  []string
+	auto      map[string]time.Time
+	failures  map[string]*failures
+	detect    bool
+	threshold int
+	window    time.Duration
+}
+
+func NewList(cfg configs.PassthroughConfig) (*List, error) {
+	patterns, err := compilePatterns(cfg.Hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := cfg.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	window := cfg.FailureWindow
+	if window <= 0 {
+		window = defaultFailureWindow
+	}
+
+	return &List{
+		patterns:  patterns,
+		auto:      make(map[string]time.Time),
+		failures:  make(map[string]*failures),
+		detect:    cfg.AutoDetect,
+		threshold: threshold,
+		window:    window,
+	}, nil
+}
+
+func compilePatterns(hosts []string) ([]string, error) {
+	patterns := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		pattern := strings.ToLower(host)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("passthrough host %q: %w", host, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// Reload replaces the configured hosts and the detection settings, hosts
+// added automatically stay on the list.
+func (l *List) Reload(cfg configs.PassthroughConfig) error {
+	patterns, err := compilePatterns(cfg.Hosts)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.patterns = patterns
+	l.detect = cfg.AutoDetect
+	if cfg.FailureThreshold > 0 {
+		l.threshold = cfg.FailureThreshold
+	}
+	if cfg.FailureWindow > 0 {
+		l.window = cfg.FailureWindow
+	}
+
+	return nil
+}
+
+func (l *List) Contains(host string) bool {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.auto[host]; ok {
+		return true
+	}
+
+	for _, pattern := range l.patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HandshakeFailed counts a client rejecting the minted certificate for host
+// and reports whether that put the host on the list.
+func (l *List) HandshakeFailed(host string) bool {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.detect {
+		return false
+	}
+
+	if _, ok := l.auto[host]; ok {
+		return false
+	}
+
+	now := time.Now()
+	failed, ok := l.failures[host]
+	if !ok || now.Sub(failed.first) > l.window {
+		failed = &failures{first: now}
+		l.failures[host] = failed
+	}
+
+	failed.count++
+	if failed.count < l.threshold {
+		return false
+	}
+
+	delete(l.failures, host)
+	l.auto[host] = now
+	return true
+}
+
+// HandshakeSucceeded forgets earlier failures, a client that accepts the
+// certificate is not pinning it.
+func (l *List) HandshakeSucceeded(host string) {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, host)
+}
+
+func (l *List) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, 0, len(l.patterns)+len(l.auto))
+	for _, pattern := range l.patterns {
+		entries = append(entries, Entry{Host: pattern})
+	}
+
+	auto := make([]Entry, 0, len(l.auto))
+	for host, addedAt := range l.auto {
+		auto = append(auto, Entry{Host: host, Auto: true, AddedAt: addedAt})
+	}
+	sort.Slice(auto, func(i, j int) bool { return auto[i].AddedAt.Before(auto[j].AddedAt) })
+
+	return append(entries, auto...)
+}
+
+// Remove takes an automatically added host off the list, configured hosts
+// stay until the configuration changes.
+func (l *List) Remove(host string) bool {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.auto[host]; !ok {
+		return false
+	}
+
+	delete(l.auto, host)
+	return true
+}
@@ -0,0 +1,149 @@
+package passthrough
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+// backdate moves the first failure counted for host back by d, as if the
+// failures had been seen that long ago.
+func backdate(l *List, host string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if failed, ok := l.failures[host]; ok {
+		failed.first = failed.first.Add(-d)
+	}
+}
+
+func TestListContains(t *testing.T) {
+	l, err := NewList(configs.PassthroughConfig{Hosts: []string{"*.Bank.example", "pinned.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "www.bank.example", want: true},
+		{host: "WWW.BANK.EXAMPLE", want: true},
+		{host: "bank.example"},
+		{host: "pinned.test", want: true},
+		{host: "other.test"},
+	}
+
+	for _, tt := range tests {
+		if got := l.Contains(tt.host); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if _, err = NewList(configs.PassthroughConfig{Hosts: []string{"[a-"}}); err == nil {
+		t.Error("NewList() accepted a malformed host pattern")
+	}
+}
+
+func TestListHandshakeFailed(t *testing.T) {
+	const host = "app.test"
+
+	tests := []struct {
+		name string
+		cfg  configs.PassthroughConfig
+		// steps are the failures and successes seen in order, f for a
+		// failure, s for a success, w for waiting out the window
+		steps string
+		want  bool
+	}{
+		{name: "detection off", cfg: configs.PassthroughConfig{FailureThreshold: 1}, steps: "fff"},
+		{name: "default threshold", cfg: configs.PassthroughConfig{AutoDetect: true}, steps: "fff", want: true},
+		{name: "below the default threshold", cfg: configs.PassthroughConfig{AutoDetect: true}, steps: "ff"},
+		{name: "threshold of one", cfg: configs.PassthroughConfig{AutoDetect: true, FailureThreshold: 1}, steps: "f", want: true},
+		{name: "success resets the count", cfg: configs.PassthroughConfig{AutoDetect: true}, steps: "ffsff"},
+		{name: "count after a success", cfg: configs.PassthroughConfig{AutoDetect: true}, steps: "ffsfff", want: true},
+		{name: "window passed", cfg: configs.PassthroughConfig{AutoDetect: true, FailureWindow: time.Minute}, steps: "ffwf"},
+		{name: "new window fills", cfg: configs.PassthroughConfig{AutoDetect: true, FailureWindow: time.Minute}, steps: "ffwfff", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewList(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			added := 0
+			for _, step := range tt.steps {
+				switch step {
+				case 'f':
+					if l.HandshakeFailed(host) {
+						added++
+					}
+				case 's':
+					l.HandshakeSucceeded(host)
+				case 'w':
+					backdate(l, host, l.window+time.Second)
+				}
+			}
+
+			if got := l.Contains(host); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+			if tt.want && added != 1 {
+				t.Errorf("HandshakeFailed() reported the host added %d times, want once", added)
+			}
+		})
+	}
+}
+
+func TestListAutoEntries(t *testing.T) {
+	l, err := NewList(configs.PassthroughConfig{Hosts: []string{"pinned.test"}, AutoDetect: true, FailureThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.HandshakeFailed("First.test")
+	// detected hosts are listed oldest first
+	time.Sleep(time.Millisecond)
+	l.HandshakeFailed("second.test")
+	if l.HandshakeFailed("first.test") {
+		t.Error("HandshakeFailed() added a host already on the list")
+	}
+
+	entries := l.Entries()
+	want := []Entry{{Host: "pinned.test"}, {Host: "first.test", Auto: true}, {Host: "second.test", Auto: true}}
+	if len(entries) != len(want) {
+		t.Fatalf("Entries() = %+v, want %+v", entries, want)
+	}
+	for i, entry := range entries {
+		if entry.Host != want[i].Host || entry.Auto != want[i].Auto || entry.Auto == entry.AddedAt.IsZero() {
+			t.Errorf("Entries()[%d] = %+v, want %+v", i, entry, want[i])
+		}
+	}
+
+	// a reload swaps the configured hosts and keeps the detected ones
+	if err = l.Reload(configs.PassthroughConfig{Hosts: []string{"other.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Contains("pinned.test") || !l.Contains("other.test") || !l.Contains("first.test") {
+		t.Errorf("Entries() after reload = %+v", l.Entries())
+	}
+	if l.HandshakeFailed("third.test") {
+		t.Error("HandshakeFailed() added a host with detection reloaded off")
+	}
+	if err = l.Reload(configs.PassthroughConfig{Hosts: []string{"[a-"}}); err == nil || !l.Contains("other.test") {
+		t.Errorf("Reload() of a malformed pattern = %v, want an error and the old hosts kept", err)
+	}
+
+	if l.Remove("other.test") {
+		t.Error("Remove() took a configured host off the list")
+	}
+	if !l.Remove("FIRST.test") || l.Contains("first.test") {
+		t.Error("Remove() left a detected host on the list")
+	}
+	if l.Remove("first.test") {
+		t.Error("Remove() reported a host that was already removed")
+	}
+}
@@ -0,0 +1,468 @@
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/decoder"
+)
+
+const (
+	TargetRequest  = "request"
+	TargetResponse = "response"
+
+	PartHeader    = "header"
+	PartBody      = "body"
+	PartFirstLine = "first_line"
+
+	// defaultBodyLimit bounds the bodies read for body rules when no decode
+	// limit is configured
+	defaultBodyLimit = 16 << 20
+)
+
+// Rule rewrites one part of a request or response. Header rules see every
+// header as a "Name: value" line, a line replaced with nothing is removed
+// and a rule with an empty Match adds Replace as a new header.
+type Rule struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+	Target   string `json:"target"`
+	Part     string `json:"part"`
+	Match    string `json:"match"`
+	Replace  string `json:"replace"`
+	Regex    bool   `json:"regex"`
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+// Engine applies an ordered rule list to live traffic, the rules can be
+// swapped while traffic flows.
+type Engine struct {
+	mu    sync.RWMutex
+	rules []compiledRule
+	// decodeLimit caps the decoded bodies body rules work on, a body that
+	// decodes to more is matched as it is on the wire. Bodies longer than
+	// that on the wire are not read at all and stream through unchanged.
+	decodeLimit int64
+}
+
+func NewEngine(cfg configs.RewriteConfig, decodeLimit int64) (*Engine, error) {
+	engine := &Engine{decodeLimit: decodeLimit}
+	if err := engine.Reload(cfg); err != nil {
+		return nil, err
+	}
+
+	return engine, nil
+}
+
+// Reload installs the rules of cfg, replacing any set through the api.
+func (e *Engine) Reload(cfg configs.RewriteConfig) error {
+	rules := make([]Rule, 0, len(cfg.Rules))
+	for _, ruleCfg := range cfg.Rules {
+		rules = append(rules, Rule{
+			Name:     ruleCfg.Name,
+			Disabled: ruleCfg.Disabled,
+			Target:   ruleCfg.Target,
+			Part:     ruleCfg.Part,
+			Match:    ruleCfg.Match,
+			Replace:  ruleCfg.Replace,
+			Regex:    ruleCfg.Regex,
+		})
+	}
+
+	return e.SetRules(rules)
+}
+
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	rules := make([]Rule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, rule.Rule)
+	}
+
+	return rules
+}
+
+// SetRules validates and installs a new rule list, unnamed rules are named
+// after their position.
+func (e *Engine) SetRules(rules []Rule) error {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = "rule-" + strconv.Itoa(i+1)
+		}
+
+		if rule.Target != TargetRequest && rule.Target != TargetResponse {
+			return fmt.Errorf("rewrite rule %s: target must be %s or %s", rule.Name, TargetRequest, TargetResponse)
+		}
+
+		switch rule.Part {
+		case PartHeader:
+		case PartBody, PartFirstLine:
+			if rule.Match == "" {
+				return fmt.Errorf("rewrite rule %s: %s rules need a match", rule.Name, rule.Part)
+			}
+		default:
+			return fmt.Errorf("rewrite rule %s: part must be %s, %s or %s", rule.Name, PartHeader, PartBody, PartFirstLine)
+		}
+
+		compiledRule := compiledRule{Rule: rule}
+		if rule.Regex && rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return fmt.Errorf("rewrite rule %s: %w", rule.Name, err)
+			}
+			compiledRule.re = re
+		}
+
+		compiled = append(compiled, compiledRule)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = compiled
+	return nil
+}
+
+func (e *Engine) active(target string) (rules []compiledRule, hasBody bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.rules {
+		if rule.Disabled || rule.Target != target {
+			continue
+		}
+
+		rules = append(rules, rule)
+		hasBody = hasBody || rule.Part == PartBody
+	}
+
+	return rules, hasBody
+}
+
+// Request rewrites r in place and returns the names of the rules that fired.
+// The body is only read into memory when a body rule is active and the body
+// is rewritable.
+func (e *Engine) Request(r *http.Request) ([]string, error) {
+	rules, hasBody := e.active(TargetRequest)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var body *bodyRewrite
+	if hasBody && e.rewritable(r.ContentLength, r.Header) {
+		raw, rest, err := e.readBody(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if rest != nil {
+			r.Body = rest
+		} else {
+			body = newBodyRewrite(raw, r.Header, e.decodeLimit)
+		}
+	}
+
+	var fired []string
+	for _, rule := range rules {
+		var ok bool
+		switch rule.Part {
+		case PartHeader:
+			r.Header, ok = rule.header(r.Header)
+		case PartFirstLine:
+			ok = rule.requestLine(r)
+		case PartBody:
+			ok = body != nil && body.apply(rule)
+		}
+
+		if ok {
+			fired = append(fired, rule.Name)
+		}
+	}
+
+	if body != nil {
+		content := body.result(r.Header)
+		r.Body = http.NoBody
+		if len(content) > 0 {
+			r.Body = io.NopCloser(bytes.NewReader(content))
+		}
+		r.ContentLength = int64(len(content))
+		r.TransferEncoding = nil
+	}
+
+	return fired, nil
+}
+
+// Response rewrites res in place and returns the names of the rules that
+// fired. The body is only read into memory when a body rule is active and
+// the body is rewritable.
+func (e *Engine) Response(res *http.Response) ([]string, error) {
+	rules, hasBody := e.active(TargetResponse)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var body *bodyRewrite
+	if hasBody && e.rewritable(res.ContentLength, res.Header) {
+		raw, rest, err := e.readBody(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		if rest != nil {
+			res.Body = rest
+		} else {
+			body = newBodyRewrite(raw, res.Header, e.decodeLimit)
+		}
+	}
+
+	var fired []string
+	for _, rule := range rules {
+		var ok bool
+		switch rule.Part {
+		case PartHeader:
+			res.Header, ok = rule.header(res.Header)
+		case PartFirstLine:
+			ok = rule.statusLine(res)
+		case PartBody:
+			ok = body != nil && body.apply(rule)
+		}
+
+		if ok {
+			fired = append(fired, rule.Name)
+		}
+	}
+
+	if body != nil {
+		content := body.result(res.Header)
+		res.Body = io.NopCloser(bytes.NewReader(content))
+		res.ContentLength = int64(len(content))
+		if body.changed {
+			res.Header.Set("Content-Length", strconv.Itoa(len(content)))
+		}
+	}
+
+	return fired, nil
+}
+
+func (rule compiledRule) replace(s string) (string, bool) {
+	if rule.re != nil {
+		if !rule.re.MatchString(s) {
+			return s, false
+		}
+		return rule.re.ReplaceAllString(s, rule.Replace), true
+	}
+
+	if !strings.Contains(s, rule.Match) {
+		return s, false
+	}
+	return strings.ReplaceAll(s, rule.Match, rule.Replace), true
+}
+
+func (rule compiledRule) header(header http.Header) (http.Header, bool) {
+	if rule.Match == "" {
+		name, value, ok := parseHeaderLine(rule.Replace)
+		if !ok {
+			return header, false
+		}
+
+		header.Add(name, value)
+		return header, true
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fired := false
+	rewritten := make(http.Header, len(header))
+	for _, key := range keys {
+		for _, value := range header[key] {
+			line, ok := rule.replace(key + ": " + value)
+			if !ok {
+				rewritten.Add(key, value)
+				continue
+			}
+
+			fired = true
+			if name, value, ok := parseHeaderLine(line); ok {
+				rewritten.Add(name, value)
+			}
+		}
+	}
+
+	return rewritten, fired
+}
+
+func parseHeaderLine(line string) (string, string, bool) {
+	name, value, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", false
+	}
+
+	return name, strings.TrimSpace(value), true
+}
+
+// requestLine rewrites "METHOD request-uri PROTO", the protocol itself is
+// chosen by the transport and cannot be changed.
+func (rule compiledRule) requestLine(r *http.Request) bool {
+	line, ok := rule.replace(r.Method + " " + r.URL.RequestURI() + " " + r.Proto)
+	if !ok {
+		return false
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return true
+	}
+
+	target, err := url.ParseRequestURI(fields[1])
+	if err != nil {
+		return true
+	}
+
+	r.Method = fields[0]
+	if target.Host != "" {
+		r.URL = target
+		r.Host = target.Host
+		return true
+	}
+
+	r.URL.Path = target.Path
+	r.URL.RawPath = target.RawPath
+	r.URL.RawQuery = target.RawQuery
+	return true
+}
+
+func (rule compiledRule) statusLine(res *http.Response) bool {
+	line, ok := rule.replace(res.Proto + " " + res.Status)
+	if !ok {
+		return false
+	}
+
+	_, status, _ := strings.Cut(line, " ")
+	codeText, _, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeText)
+	if err != nil || code < 100 || code > 999 {
+		return true
+	}
+
+	res.StatusCode = code
+	res.Status = status
+	return true
+}
+
+// bodyRewrite works on the decoded body so rules can match compressed
+// traffic, the coding is only dropped when a rule actually changed it.
+type bodyRewrite struct {
+	raw     []byte
+	content []byte
+	decoded bool
+	changed bool
+}
+
+func newBodyRewrite(raw []byte, header http.Header, decodeLimit int64) *bodyRewrite {
+	body := &bodyRewrite{raw: raw, content: raw}
+	if encodings := decoder.Encodings(header); len(encodings) > 0 {
+		decoded, err := decoder.Decode(raw, encodings, decodeLimit)
+		if err == nil {
+			body.content = decoded
+			body.decoded = true
+		}
+	}
+
+	return body
+}
+
+func (b *bodyRewrite) apply(rule compiledRule) bool {
+	if rule.re != nil {
+		if !rule.re.Match(b.content) {
+			return false
+		}
+		b.content = rule.re.ReplaceAll(b.content, []byte(rule.Replace))
+	} else {
+		match := []byte(rule.Match)
+		if !bytes.Contains(b.content, match) {
+			return false
+		}
+		b.content = bytes.ReplaceAll(b.content, match, []byte(rule.Replace))
+	}
+
+	b.changed = true
+	return true
+}
+
+func (b *bodyRewrite) result(header http.Header) []byte {
+	if !b.changed {
+		return b.raw
+	}
+
+	if b.decoded {
+		header.Del("Content-Encoding")
+	}
+
+	return b.content
+}
+
+func (e *Engine) bodyLimit() int64 {
+	if e.decodeLimit > 0 {
+		return e.decodeLimit
+	}
+
+	return defaultBodyLimit
+}
+
+// rewritable reports whether body rules may read a body. Streams never end
+// on their own, so event streams, bodies of unknown length and bodies over
+// the limit are left alone.
+func (e *Engine) rewritable(length int64, header http.Header) bool {
+	if length < 0 || length > e.bodyLimit() {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType != "text/event-stream"
+}
+
+// readBody reads a body of at most the limit. A body longer than it
+// announced is handed back as rest, the bytes already read put in front, to
+// be streamed through unchanged.
+func (e *Engine) readBody(body io.ReadCloser) (raw []byte, rest io.ReadCloser, err error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil, nil
+	}
+
+	limit := e.bodyLimit()
+	raw, err = io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+
+	if int64(len(raw)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), body), body}, nil
+	}
+
+	body.Close()
+	return raw, nil, nil
+}
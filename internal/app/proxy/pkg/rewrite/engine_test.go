@@ -0,0 +1,430 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/andybalholm/brotli"
+)
+
+func compress(t *testing.T, encoding, plain string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("no writer for %s", encoding)
+	}
+
+	io.WriteString(w, plain)
+	w.Close()
+	return buf.Bytes()
+}
+
+func newEngine(t *testing.T, decodeLimit int64, rules ...configs.RewriteRuleConfig) *Engine {
+	t.Helper()
+
+	engine, err := NewEngine(configs.RewriteConfig{Rules: rules}, decodeLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return engine
+}
+
+func TestEngineRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []configs.RewriteRuleConfig
+		method     string
+		target     string
+		header     http.Header
+		body       string
+		wantFired  []string
+		wantMethod string
+		wantURL    string
+		wantHost   string
+		wantHeader http.Header
+		wantBody   string
+	}{
+		{
+			name:       "header replaced",
+			rules:      []configs.RewriteRuleConfig{{Name: "ua", Target: TargetRequest, Part: PartHeader, Match: "curl", Replace: "browser"}},
+			header:     http.Header{"User-Agent": {"curl/8.0"}},
+			wantFired:  []string{"ua"},
+			wantHeader: http.Header{"User-Agent": {"browser/8.0"}},
+		},
+		{
+			name:       "header removed",
+			rules:      []configs.RewriteRuleConfig{{Name: "no-cookie", Target: TargetRequest, Part: PartHeader, Match: `^Cookie: .*$`, Regex: true}},
+			header:     http.Header{"Cookie": {"a=1"}, "Accept": {"*/*"}},
+			wantFired:  []string{"no-cookie"},
+			wantHeader: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:       "header added",
+			rules:      []configs.RewriteRuleConfig{{Name: "debug", Target: TargetRequest, Part: PartHeader, Replace: "X-Debug: 1"}},
+			header:     http.Header{"Accept": {"*/*"}},
+			wantFired:  []string{"debug"},
+			wantHeader: http.Header{"Accept": {"*/*"}, "X-Debug": {"1"}},
+		},
+		{
+			name:       "header renamed",
+			rules:      []configs.RewriteRuleConfig{{Name: "rename", Target: TargetRequest, Part: PartHeader, Match: "X-Old:", Replace: "X-New:"}},
+			header:     http.Header{"X-Old": {"v"}},
+			wantFired:  []string{"rename"},
+			wantHeader: http.Header{"X-New": {"v"}},
+		},
+		{
+			name:       "path and method",
+			rules:      []configs.RewriteRuleConfig{{Name: "v2", Target: TargetRequest, Part: PartFirstLine, Match: `^GET /v1/(\S*)`, Replace: "POST /v2/$1", Regex: true}},
+			target:     "http://example.com/v1/users?page=2",
+			wantFired:  []string{"v2"},
+			wantMethod: http.MethodPost,
+			wantURL:    "http://example.com/v2/users?page=2",
+		},
+		{
+			name:      "retargeted",
+			rules:     []configs.RewriteRuleConfig{{Name: "staging", Target: TargetRequest, Part: PartFirstLine, Match: "GET /", Replace: "GET http://staging.example/"}},
+			target:    "http://example.com/x",
+			wantFired: []string{"staging"},
+			wantURL:   "http://staging.example/x",
+			wantHost:  "staging.example",
+		},
+		{
+			name:      "first line unmatched",
+			rules:     []configs.RewriteRuleConfig{{Name: "v2", Target: TargetRequest, Part: PartFirstLine, Match: "/v1/", Replace: "/v2/"}},
+			target:    "http://example.com/v3/users",
+			wantURL:   "http://example.com/v3/users",
+			wantFired: nil,
+		},
+		{
+			name:      "body",
+			rules:     []configs.RewriteRuleConfig{{Name: "role", Target: TargetRequest, Part: PartBody, Match: `"user"`, Replace: `"admin"`}},
+			body:      `{"role":"user"}`,
+			wantFired: []string{"role"},
+			wantBody:  `{"role":"admin"}`,
+		},
+		{
+			name: "rules fire in order, disabled and response rules skipped",
+			rules: []configs.RewriteRuleConfig{
+				{Name: "first", Target: TargetRequest, Part: PartBody, Match: "a", Replace: "b"},
+				{Name: "off", Disabled: true, Target: TargetRequest, Part: PartBody, Match: "b", Replace: "x"},
+				{Name: "response", Target: TargetResponse, Part: PartBody, Match: "b", Replace: "x"},
+				{Name: "second", Target: TargetRequest, Part: PartBody, Match: "b", Replace: "c"},
+			},
+			body:      "a",
+			wantFired: []string{"first", "second"},
+			wantBody:  "c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, target := tt.method, tt.target
+			if method == "" {
+				method = http.MethodGet
+			}
+			if target == "" {
+				target = "http://example.com/"
+			}
+
+			r, err := http.NewRequest(method, target, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != nil {
+				r.Header = tt.header
+			}
+
+			fired, err := newEngine(t, 0, tt.rules...).Request(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(fired, ",") != strings.Join(tt.wantFired, ",") {
+				t.Errorf("fired %q, want %q", fired, tt.wantFired)
+			}
+			if tt.wantMethod != "" && r.Method != tt.wantMethod {
+				t.Errorf("method = %s, want %s", r.Method, tt.wantMethod)
+			}
+			if tt.wantURL != "" && r.URL.String() != tt.wantURL {
+				t.Errorf("url = %s, want %s", r.URL, tt.wantURL)
+			}
+			if tt.wantHost != "" && r.Host != tt.wantHost {
+				t.Errorf("host = %s, want %s", r.Host, tt.wantHost)
+			}
+			if tt.wantHeader != nil && !equalHeaders(r.Header, tt.wantHeader) {
+				t.Errorf("header = %v, want %v", r.Header, tt.wantHeader)
+			}
+			if tt.wantBody != "" {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != tt.wantBody || r.ContentLength != int64(len(tt.wantBody)) {
+					t.Errorf("body = %q with length %d, want %q", body, r.ContentLength, tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestEngineResponse(t *testing.T) {
+	// long and repetitive enough that no coding stores it verbatim
+	padding := strings.Repeat("proxy ", 100)
+	plain := `{"admin":false,"name":"` + padding + `"}`
+	rewritten := `{"admin":true,"name":"` + padding + `"}`
+	admin := configs.RewriteRuleConfig{Name: "admin", Target: TargetResponse, Part: PartBody, Match: `"admin":false`, Replace: `"admin":true`}
+
+	tests := []struct {
+		name         string
+		rules        []configs.RewriteRuleConfig
+		decodeLimit  int64
+		encoding     string
+		status       int
+		wantFired    []string
+		wantStatus   int
+		wantEncoding string
+		// wantBody is the plain body expected, compared after decoding with
+		// wantEncoding when that is set
+		wantBody string
+	}{
+		{name: "plain body", rules: []configs.RewriteRuleConfig{admin}, wantFired: []string{"admin"}, wantBody: rewritten},
+		{name: "gzip body decoded", rules: []configs.RewriteRuleConfig{admin}, encoding: "gzip", wantFired: []string{"admin"}, wantBody: rewritten},
+		{name: "br body decoded", rules: []configs.RewriteRuleConfig{admin}, encoding: "br", wantFired: []string{"admin"}, wantBody: rewritten},
+		{
+			name:         "unmatched compressed body kept as sent",
+			rules:        []configs.RewriteRuleConfig{{Name: "miss", Target: TargetResponse, Part: PartBody, Match: "absent", Replace: "x"}},
+			encoding:     "gzip",
+			wantEncoding: "gzip",
+			wantBody:     plain,
+		},
+		{
+			name:         "body over the decode limit matched on the wire",
+			rules:        []configs.RewriteRuleConfig{admin},
+			decodeLimit:  8,
+			encoding:     "gzip",
+			wantEncoding: "gzip",
+			wantBody:     plain,
+		},
+		{
+			name:       "status line",
+			rules:      []configs.RewriteRuleConfig{{Name: "ok", Target: TargetResponse, Part: PartFirstLine, Match: "403 Forbidden", Replace: "200 OK"}},
+			status:     http.StatusForbidden,
+			wantFired:  []string{"ok"},
+			wantStatus: http.StatusOK,
+			wantBody:   plain,
+		},
+		{
+			name:       "unparsable status kept",
+			rules:      []configs.RewriteRuleConfig{{Name: "bad", Target: TargetResponse, Part: PartFirstLine, Match: "200", Replace: "two hundred"}},
+			wantFired:  []string{"bad"},
+			wantStatus: http.StatusOK,
+			wantBody:   plain,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			body := []byte(plain)
+			header := http.Header{"Content-Type": {"application/json"}}
+			if tt.encoding != "" {
+				body = compress(t, tt.encoding, plain)
+				header.Set("Content-Encoding", tt.encoding)
+			}
+			header.Set("Content-Length", strconv.Itoa(len(body)))
+
+			res := &http.Response{
+				StatusCode:    status,
+				Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+				Proto:         "HTTP/1.1",
+				Header:        header,
+				Body:          io.NopCloser(bytes.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}},
+			}
+
+			fired, err := newEngine(t, tt.decodeLimit, tt.rules...).Response(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(fired, ",") != strings.Join(tt.wantFired, ",") {
+				t.Errorf("fired %q, want %q", fired, tt.wantFired)
+			}
+			if tt.wantStatus != 0 && res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if got := res.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			got, _ := io.ReadAll(res.Body)
+			if res.Header.Get("Content-Length") != strconv.Itoa(len(got)) || res.ContentLength != int64(len(got)) {
+				t.Errorf("Content-Length %s and length %d for a %d byte body", res.Header.Get("Content-Length"), res.ContentLength, len(got))
+			}
+			if tt.wantEncoding == "gzip" {
+				reader, err := gzip.NewReader(bytes.NewReader(got))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ = io.ReadAll(reader)
+			}
+			if string(got) != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+// endlessBody never ends, like a server-sent event stream, and counts the
+// reads made from it.
+type endlessBody struct {
+	reads int
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	b.reads++
+	return copy(p, "data: secret\n\n"), nil
+}
+
+func (b *endlessBody) Close() error {
+	return nil
+}
+
+func TestEngineResponseBodyLimit(t *testing.T) {
+	const limit = 64
+	rule := configs.RewriteRuleConfig{Name: "mask", Target: TargetResponse, Part: PartBody, Match: "secret", Replace: "xxxxxx"}
+	short := "the secret is out"
+	long := "the secret is out" + strings.Repeat(".", limit)
+
+	tests := []struct {
+		name        string
+		body        string
+		length      int64
+		contentType string
+		wantFired   bool
+		wantBody    string
+	}{
+		{name: "under the limit", body: short, length: int64(len(short)), wantFired: true, wantBody: "the xxxxxx is out"},
+		{name: "over the limit", body: long, length: int64(len(long)), wantBody: long},
+		{name: "unknown length", body: short, length: -1, wantBody: short},
+		{name: "longer than announced", body: long, length: int64(len(short)), wantBody: long},
+		{name: "event stream", body: short, length: int64(len(short)), contentType: "text/event-stream; charset=utf-8", wantBody: short},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "text/plain"
+			}
+
+			res := &http.Response{
+				StatusCode:    http.StatusOK,
+				Status:        "200 OK",
+				Proto:         "HTTP/1.1",
+				Header:        http.Header{"Content-Type": {contentType}},
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: tt.length,
+			}
+
+			fired, err := newEngine(t, limit, rule).Response(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (len(fired) == 1) != tt.wantFired {
+				t.Errorf("fired %q, want the body rule fired %v", fired, tt.wantFired)
+			}
+
+			got, _ := io.ReadAll(res.Body)
+			if string(got) != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if !tt.wantFired && res.ContentLength != tt.length {
+				t.Errorf("length = %d, want the announced %d", res.ContentLength, tt.length)
+			}
+		})
+	}
+}
+
+func TestEngineLeavesStreamsUnread(t *testing.T) {
+	rule := configs.RewriteRuleConfig{Target: TargetResponse, Part: PartBody, Match: "secret", Replace: "xxxxxx"}
+
+	for _, res := range []*http.Response{
+		{Header: http.Header{"Content-Type": {"text/event-stream"}}, ContentLength: -1},
+		{Header: http.Header{"Content-Type": {"application/octet-stream"}}, ContentLength: -1},
+	} {
+		body := &endlessBody{}
+		res.Body = body
+
+		if _, err := newEngine(t, 0, rule).Response(res); err != nil {
+			t.Fatal(err)
+		}
+		if body.reads != 0 || res.Body != body {
+			t.Errorf("%s body of unknown length was read %d times, want it streamed untouched", res.Header.Get("Content-Type"), body.reads)
+		}
+	}
+}
+
+func TestEngineSetRulesRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "target", rule: Rule{Target: "both", Part: PartHeader}},
+		{name: "part", rule: Rule{Target: TargetRequest, Part: "trailer"}},
+		{name: "body without match", rule: Rule{Target: TargetRequest, Part: PartBody, Replace: "x"}},
+		{name: "first line without match", rule: Rule{Target: TargetResponse, Part: PartFirstLine, Replace: "x"}},
+		{name: "bad regex", rule: Rule{Target: TargetRequest, Part: PartBody, Match: "(", Regex: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newEngine(t, 0, configs.RewriteRuleConfig{Name: "kept", Target: TargetRequest, Part: PartHeader, Replace: "X-A: 1"})
+			if err := engine.SetRules([]Rule{tt.rule}); err == nil {
+				t.Fatal("SetRules() accepted the rule")
+			}
+
+			if rules := engine.Rules(); len(rules) != 1 || rules[0].Name != "kept" {
+				t.Errorf("rules after a rejected set = %+v, want the old ones", rules)
+			}
+		})
+	}
+
+	engine := newEngine(t, 0)
+	engine.SetRules([]Rule{{Target: TargetRequest, Part: PartHeader, Replace: "X-A: 1"}})
+	if rules := engine.Rules(); rules[0].Name != "rule-1" {
+		t.Errorf("unnamed rule is called %q, want rule-1", rules[0].Name)
+	}
+}
+
+func equalHeaders(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, values := range a {
+		if strings.Join(values, "\x00") != strings.Join(b[key], "\x00") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,153 @@
+package scope
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+type rule struct {
+	host   string
+	hostRe *regexp.Regexp
+	port   int
+	scheme string
+	path   string
+}
+
+// Scope decides which targets are recorded. With no include rules every
+// target is in scope, exclude rules always win over include rules.
+type Scope struct {
+	mu      sync.RWMutex
+	include []rule
+	exclude []rule
+}
+
+func New(cfg configs.ScopeConfig) (*Scope, error) {
+	s := &Scope{}
+	if err := s.Reload(cfg); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload swaps in the rules of cfg, the current rules stay when cfg is
+// invalid.
+func (s *Scope) Reload(cfg configs.ScopeConfig) error {
+	include, err := compileRules(cfg.Include)
+	if err != nil {
+		return fmt.Errorf("scope include: %w", err)
+	}
+
+	exclude, err := compileRules(cfg.Exclude)
+	if err != nil {
+		return fmt.Errorf("scope exclude: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.include = include
+	s.exclude = exclude
+	return nil
+}
+
+func compileRules(rulesCfg []configs.ScopeRuleConfig) ([]rule, error) {
+	rules := make([]rule, 0, len(rulesCfg))
+	for _, ruleCfg := range rulesCfg {
+		r := rule{
+			port:   ruleCfg.Port,
+			scheme: strings.ToLower(ruleCfg.Scheme),
+			path:   ruleCfg.Path,
+		}
+
+		if ruleCfg.Regex {
+			// a host pattern names the whole host, example\.com must not
+			// take in example.com.attacker.net
+			re, err := regexp.Compile(`^(?:` + ruleCfg.Host + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("host %q: %w", ruleCfg.Host, err)
+			}
+			r.hostRe = re
+		} else {
+			r.host = strings.ToLower(ruleCfg.Host)
+			if _, err := path.Match(r.host, ""); err != nil {
+				return nil, fmt.Errorf("host %q: %w", ruleCfg.Host, err)
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// InScope reports whether a request to host, given as "host" or
+// "host:port", should be recorded.
+func (s *Scope) InScope(scheme, host, urlPath string) bool {
+	scheme = strings.ToLower(scheme)
+	hostname, port := splitHostPort(scheme, host)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.include) > 0 && !matchAny(s.include, scheme, hostname, port, urlPath) {
+		return false
+	}
+
+	return !matchAny(s.exclude, scheme, hostname, port, urlPath)
+}
+
+func matchAny(rules []rule, scheme, hostname string, port int, urlPath string) bool {
+	for _, r := range rules {
+		if r.matches(scheme, hostname, port, urlPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r rule) matches(scheme, hostname string, port int, urlPath string) bool {
+	if r.hostRe != nil && !r.hostRe.MatchString(hostname) {
+		return false
+	}
+
+	if r.host != "" {
+		if ok, _ := path.Match(r.host, hostname); !ok {
+			return false
+		}
+	}
+
+	if r.port != 0 && r.port != port {
+		return false
+	}
+
+	if r.scheme != "" && r.scheme != scheme {
+		return false
+	}
+
+	return r.path == "" || strings.HasPrefix(urlPath, r.path)
+}
+
+func splitHostPort(scheme, host string) (string, int) {
+	hostname, portText, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = strings.Trim(host, "[]")
+		switch scheme {
+		case "https", "wss":
+			return strings.ToLower(hostname), 443
+		default:
+			return strings.ToLower(hostname), 80
+		}
+	}
+
+	port, _ := strconv.Atoi(portText)
+	return strings.ToLower(hostname), port
+}
@@ -0,0 +1,118 @@
+package scope
+
+import (
+	"testing"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+func TestInScope(t *testing.T) {
+	cfg := configs.ScopeConfig{
+		Include: []configs.ScopeRuleConfig{
+			{Host: "*.Example.com"},
+			{Host: `^api[0-9]+\.test$`, Regex: true, Scheme: "https"},
+			{Host: "localhost", Port: 8080, Path: "/app/"},
+			{Host: `example\.org`, Regex: true},
+			{Host: `a\.test|b\.test`, Regex: true},
+		},
+		Exclude: []configs.ScopeRuleConfig{
+			{Host: "cdn.example.com"},
+			{Host: "*.example.com", Path: "/static/"},
+			{Host: `media\.example\.com`, Regex: true},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		scheme string
+		host   string
+		path   string
+		want   bool
+	}{
+		{name: "wildcard include", scheme: "http", host: "www.example.com", path: "/", want: true},
+		{name: "case and port ignored", scheme: "HTTPS", host: "WWW.Example.com:8443", path: "/", want: true},
+		{name: "bare domain outside the wildcard", scheme: "http", host: "example.com", path: "/"},
+		{name: "excluded host", scheme: "https", host: "cdn.example.com", path: "/"},
+		{name: "regex exclude", scheme: "https", host: "media.example.com", path: "/"},
+		{name: "regex exclude does not over-match", scheme: "https", host: "social.media.example.com", path: "/", want: true},
+		{name: "excluded path", scheme: "https", host: "www.example.com", path: "/static/app.js"},
+		{name: "regex include", scheme: "https", host: "api12.test", path: "/", want: true},
+		{name: "regex include over https only", scheme: "http", host: "api12.test", path: "/"},
+		{name: "regex anchored", scheme: "https", host: "api12.test.evil", path: "/"},
+		{name: "unanchored regex matches the whole host", scheme: "https", host: "example.org", path: "/", want: true},
+		{name: "unanchored regex suffix", scheme: "https", host: "example.org.attacker.net", path: "/"},
+		{name: "unanchored regex prefix", scheme: "https", host: "evil-example.org", path: "/"},
+		{name: "unanchored alternation", scheme: "https", host: "b.test.attacker.net", path: "/"},
+		{name: "unanchored alternation hit", scheme: "https", host: "b.test", path: "/", want: true},
+		{name: "port and path", scheme: "http", host: "localhost:8080", path: "/app/home", want: true},
+		{name: "default port differs", scheme: "http", host: "localhost", path: "/app/home"},
+		{name: "path outside the prefix", scheme: "http", host: "localhost:8080", path: "/admin"},
+		{name: "not included", scheme: "http", host: "other.test", path: "/"},
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.InScope(tt.scheme, tt.host, tt.path); got != tt.want {
+				t.Errorf("InScope(%s, %s, %s) = %v, want %v", tt.scheme, tt.host, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInScopeDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    configs.ScopeConfig
+		scheme string
+		host   string
+		want   bool
+	}{
+		{name: "no rules record everything", scheme: "http", host: "example.com", want: true},
+		{name: "exclude only", cfg: configs.ScopeConfig{Exclude: []configs.ScopeRuleConfig{{Host: "tracker.test"}}}, scheme: "http", host: "example.com", want: true},
+		{name: "exclude only hit", cfg: configs.ScopeConfig{Exclude: []configs.ScopeRuleConfig{{Host: "tracker.test"}}}, scheme: "http", host: "tracker.test"},
+		{name: "https default port", cfg: configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Port: 443}}}, scheme: "https", host: "example.com", want: true},
+		{name: "wss default port", cfg: configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Port: 443}}}, scheme: "wss", host: "example.com", want: true},
+		{name: "http default port", cfg: configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Port: 443}}}, scheme: "http", host: "example.com"},
+		{name: "ipv6 with port", cfg: configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Host: "2001:db8::1", Port: 8443}}}, scheme: "https", host: "[2001:db8::1]:8443", want: true},
+		{name: "ipv6 without port", cfg: configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Host: "2001:db8::1", Port: 443}}}, scheme: "https", host: "[2001:db8::1]", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.InScope(tt.scheme, tt.host, "/"); got != tt.want {
+				t.Errorf("InScope(%s, %s) = %v, want %v", tt.scheme, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsRulesOnError(t *testing.T) {
+	s, err := New(configs.ScopeConfig{Include: []configs.ScopeRuleConfig{{Host: "example.com"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []configs.ScopeConfig{
+		{Include: []configs.ScopeRuleConfig{{Host: "(", Regex: true}}},
+		{Exclude: []configs.ScopeRuleConfig{{Host: "[a-"}}},
+	}
+	for _, cfg := range invalid {
+		if err = s.Reload(cfg); err == nil {
+			t.Errorf("Reload(%+v) accepted the rules", cfg)
+		}
+	}
+
+	if !s.InScope("http", "example.com", "/") || s.InScope("http", "other.test", "/") {
+		t.Error("a rejected reload changed the scope")
+	}
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+var ErrRejected = errors.New("socks5: connect rejected")
+
+// Connect runs the client side of the negotiation on a connection to a
+// SOCKS5 server and asks it to CONNECT to addr, a "host:port".
+func Connect(conn net.Conn, addr string, creds *Credentials) error {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid port %q", portText)
+	}
+
+	method := byte(methodNoAuth)
+	if creds != nil {
+		method = methodUserPass
+	}
+
+	if _, err = conn.Write([]byte{version, 1, method}); err != nil {
+		return err
+	}
+
+	chosen := make([]byte, 2)
+	if _, err = io.ReadFull(conn, chosen); err != nil {
+		return err
+	}
+
+	if chosen[0] != version {
+		return ErrVersion
+	}
+
+	if chosen[1] != method {
+		return ErrNoAcceptable
+	}
+
+	if creds != nil {
+		if err = sendCredentials(conn, creds); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{version, cmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(append(request, atypIPv4), ip4...)
+		} else {
+			request = append(append(request, atypIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name %q is too long", host)
+		}
+		request = append(append(request, atypDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != version {
+		return ErrVersion
+	}
+
+	if header[1] != replySucceeded {
+		return fmt.Errorf("%w: reply code %d", ErrRejected, header[1])
+	}
+
+	// the bound address is of no use to us but has to be drained
+	if _, err = readAddress(conn, header[3]); err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	return err
+}
+
+func sendCredentials(conn net.Conn, creds *Credentials) error {
+	if len(creds.Username) > 255 || len(creds.Password) > 255 {
+		return errors.New("socks5: username or password is too long")
+	}
+
+	request := []byte{userPassVersion, byte(len(creds.Username))}
+	request = append(request, creds.Username...)
+	request = append(request, byte(len(creds.Password)))
+	request = append(request, creds.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+
+	if status[1] != userPassSuccess {
+		return ErrAuthFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	version = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySucceeded           = 0x00
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+var (
+	ErrVersion        = errors.New("socks5: unsupported protocol version")
+	ErrNoAcceptable   = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed     = errors.New("socks5: authentication failed")
+	ErrCommand        = errors.New("socks5: unsupported command")
+	ErrAddressType    = errors.New("socks5: unsupported address type")
+	ErrUnexpectedAuth = errors.New("socks5: unsupported authentication version")
+)
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Accept runs the server side of the RFC 1928 negotiation on conn, with
+// RFC 1929 username/password authentication when creds is set. Only CONNECT
+// is supported, the returned target is the requested "host:port". Success is
+// reported to the client right away, the target itself is dialed lazily.
+func Accept(conn net.Conn, creds *Credentials) (string, error) {
+	if err := negotiateMethod(conn, creds); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+
+	if header[0] != version {
+		return "", ErrVersion
+	}
+
+	host, err := readAddress(conn, header[3])
+	if err != nil {
+		// a client that hung up mid-address gets no answer
+		if errors.Is(err, ErrAddressType) {
+			reply(conn, replyAddressNotSupported)
+		}
+		return "", err
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err = io.ReadFull(conn, portBytes); err != nil {
+		return "", err
+	}
+
+	if header[1] != cmdConnect {
+		reply(conn, replyCommandNotSupported)
+		return "", ErrCommand
+	}
+
+	if err = reply(conn, replySucceeded); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))), nil
+}
+
+func negotiateMethod(conn net.Conn, creds *Credentials) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != version {
+		return ErrVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	wanted := byte(methodNoAuth)
+	if creds != nil {
+		wanted = methodUserPass
+	}
+
+	for _, method := range methods {
+		if method != wanted {
+			continue
+		}
+
+		if _, err := conn.Write([]byte{version, wanted}); err != nil {
+			return err
+		}
+
+		if creds != nil {
+			return authenticate(conn, creds)
+		}
+
+		return nil
+	}
+
+	conn.Write([]byte{version, methodNoAcceptable})
+	return ErrNoAcceptable
+}
+
+func authenticate(conn net.Conn, creds *Credentials) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != userPassVersion {
+		return ErrUnexpectedAuth
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passwordLen); err != nil {
+		return err
+	}
+
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	usernameOk := subtle.ConstantTimeCompare(username, []byte(creds.Username)) == 1
+	passwordOk := subtle.ConstantTimeCompare(password, []byte(creds.Password)) == 1
+	if !usernameOk || !passwordOk {
+		conn.Write([]byte{userPassVersion, userPassFailure})
+		return ErrAuthFailed
+	}
+
+	_, err := conn.Write([]byte{userPassVersion, userPassSuccess})
+	return err
+}
+
+func readAddress(conn net.Conn, addressType byte) (string, error) {
+	switch addressType {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if addressType == atypIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+
+		return ip.String(), nil
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+
+		return string(domain), nil
+	default:
+		return "", fmt.Errorf("%w: %d", ErrAddressType, addressType)
+	}
+}
+
+func reply(conn net.Conn, code byte) error {
+	// the bound address is meaningless here, clients ignore it for CONNECT
+	_, err := conn.Write([]byte{version, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
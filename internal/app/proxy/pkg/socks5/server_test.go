@@ -0,0 +1,141 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// scriptConn feeds a scripted client to Accept and keeps what it answers.
+type scriptConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *scriptConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAccept(t *testing.T) {
+	var (
+		greetNoAuth   = []byte{version, 1, methodNoAuth}
+		greetUserPass = []byte{version, 2, methodNoAuth, methodUserPass}
+		goodLogin     = join([]byte{userPassVersion, 4}, []byte("user"), []byte{6}, []byte("secret"))
+		badLogin      = join([]byte{userPassVersion, 4}, []byte("user"), []byte{5}, []byte("wrong"))
+
+		connectDomain = join([]byte{version, cmdConnect, 0, atypDomain, 11}, []byte("example.com"), []byte{0x01, 0xbb})
+		connectIPv4   = []byte{version, cmdConnect, 0, atypIPv4, 192, 0, 2, 1, 0x1f, 0x90}
+		connectIPv6   = join([]byte{version, cmdConnect, 0, atypIPv6}, net.ParseIP("2001:db8::1"), []byte{0, 80})
+
+		chose      = func(method byte) []byte { return []byte{version, method} }
+		succeeded  = []byte{version, replySucceeded, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+		loggedIn   = []byte{userPassVersion, userPassSuccess}
+		loginFails = []byte{userPassVersion, userPassFailure}
+	)
+
+	creds := &Credentials{Username: "user", Password: "secret"}
+
+	tests := []struct {
+		name      string
+		creds     *Credentials
+		in        []byte
+		want      string
+		wantErr   error
+		wantReply []byte
+	}{
+		{name: "domain", in: join(greetNoAuth, connectDomain), want: "example.com:443", wantReply: join(chose(methodNoAuth), succeeded)},
+		{name: "ipv4", in: join(greetNoAuth, connectIPv4), want: "192.0.2.1:8080", wantReply: join(chose(methodNoAuth), succeeded)},
+		{name: "ipv6", in: join(greetNoAuth, connectIPv6), want: "[2001:db8::1]:80", wantReply: join(chose(methodNoAuth), succeeded)},
+		{name: "login", creds: creds, in: join(greetUserPass, goodLogin, connectDomain), want: "example.com:443", wantReply: join(chose(methodUserPass), loggedIn, succeeded)},
+		{name: "wrong password", creds: creds, in: join(greetUserPass, badLogin), wantErr: ErrAuthFailed, wantReply: join(chose(methodUserPass), loginFails)},
+		{name: "login required", creds: creds, in: greetNoAuth, wantErr: ErrNoAcceptable, wantReply: chose(methodNoAcceptable)},
+		{name: "no methods", in: []byte{version, 0}, wantErr: ErrNoAcceptable, wantReply: chose(methodNoAcceptable)},
+		{name: "socks4 greeting", in: []byte{0x04, 1, 0}, wantErr: ErrVersion},
+		{name: "bad auth version", creds: creds, in: join(greetUserPass, []byte{0x05, 0}), wantErr: ErrUnexpectedAuth, wantReply: chose(methodUserPass)},
+		{name: "bind", in: join(greetNoAuth, []byte{version, 0x02, 0, atypIPv4, 192, 0, 2, 1, 0, 80}), wantErr: ErrCommand,
+			wantReply: join(chose(methodNoAuth), []byte{version, replyCommandNotSupported, 0, atypIPv4, 0, 0, 0, 0, 0, 0})},
+		{name: "unknown address type", in: join(greetNoAuth, []byte{version, cmdConnect, 0, 0x02}), wantErr: ErrAddressType,
+			wantReply: join(chose(methodNoAuth), []byte{version, replyAddressNotSupported, 0, atypIPv4, 0, 0, 0, 0, 0, 0})},
+		{name: "request version", in: join(greetNoAuth, []byte{0x04, cmdConnect, 0, atypIPv4}), wantErr: ErrVersion, wantReply: chose(methodNoAuth)},
+		{name: "cut short in the address", in: join(greetNoAuth, connectDomain[:8]), wantErr: io.ErrUnexpectedEOF, wantReply: chose(methodNoAuth)},
+		{name: "cut short in the port", in: join(greetNoAuth, connectIPv4[:9]), wantErr: io.ErrUnexpectedEOF, wantReply: chose(methodNoAuth)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &scriptConn{in: bytes.NewReader(tt.in)}
+
+			target, err := Accept(conn, tt.creds)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Accept() error = %v, want %v", err, tt.wantErr)
+			}
+			if target != tt.want {
+				t.Errorf("Accept() = %q, want %q", target, tt.want)
+			}
+			if !bytes.Equal(conn.out.Bytes(), tt.wantReply) {
+				t.Errorf("Accept() answered % x, want % x", conn.out.Bytes(), tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestConnectAccept(t *testing.T) {
+	creds := &Credentials{Username: "user", Password: "secret"}
+
+	tests := []struct {
+		name        string
+		addr        string
+		client      *Credentials
+		server      *Credentials
+		want        string
+		wantErr     error
+		wantServErr error
+	}{
+		{name: "domain", addr: "example.com:443", want: "example.com:443"},
+		{name: "ipv4", addr: "192.0.2.1:8080", want: "192.0.2.1:8080"},
+		{name: "ipv6", addr: "[2001:db8::1]:80", want: "[2001:db8::1]:80"},
+		{name: "login", addr: "example.com:443", client: creds, server: creds, want: "example.com:443"},
+		{name: "wrong password", addr: "example.com:443", client: &Credentials{Username: "user", Password: "guess"}, server: creds,
+			wantErr: ErrAuthFailed, wantServErr: ErrAuthFailed},
+		{name: "login required", addr: "example.com:443", server: creds, wantErr: ErrNoAcceptable, wantServErr: ErrNoAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			type accepted struct {
+				target string
+				err    error
+			}
+			done := make(chan accepted, 1)
+			go func() {
+				target, err := Accept(server, tt.server)
+				server.Close()
+				done <- accepted{target, err}
+			}()
+
+			if err := Connect(client, tt.addr, tt.client); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			client.Close()
+
+			got := <-done
+			if !errors.Is(got.err, tt.wantServErr) || got.target != tt.want {
+				t.Errorf("Accept() = %q, %v, want %q, %v", got.target, got.err, tt.want, tt.wantServErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+// Package transparent recovers where a connection redirected to the proxy by
+// the firewall was originally headed.
+package transparent
+
+import "errors"
+
+var ErrUnsupported = errors.New("original destination lookup is not supported on this platform")
@@ -0,0 +1,77 @@
+//go:build linux
+
+package transparent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and
+// linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// OriginalDst returns the "host:port" a connection accepted after an iptables
+// REDIRECT or DNAT rule was addressed to before the rewrite.
+func OriginalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination needs a tcp connection")
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	ipv4 := true
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		ipv4 = false
+	}
+
+	var addr string
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv4 {
+			addr, sockErr = originalDst4(int(fd))
+		} else {
+			addr, sockErr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return addr, sockErr
+}
+
+// the option fills in a sockaddr, the getsockopt wrappers below are only
+// used because their result structs are large enough to hold one
+func originalDst4(fd int) (string, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+
+	// struct sockaddr_in: family, port in network order, address
+	raw := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(raw[2:4])
+	return net.JoinHostPort(net.IP(raw[4:8]).String(), strconv.Itoa(int(port))), nil
+}
+
+func originalDst6(fd int) (string, error) {
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+
+	// the port keeps the network byte order it had in memory
+	var rawPort [2]byte
+	binary.NativeEndian.PutUint16(rawPort[:], info.Addr.Port)
+	port := binary.BigEndian.Uint16(rawPort[:])
+
+	return net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package transparent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDstNeedsTCP(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	if addr, err := OriginalDst(conn); err == nil {
+		t.Errorf("OriginalDst() of a pipe = %s, want an error", addr)
+	}
+}
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// without conntrack there is nothing to look up, with it a connection
+	// no rule rewrote was headed where it arrived
+	addr, err := OriginalDst(conn)
+	if err == nil && addr != conn.LocalAddr().String() {
+		t.Errorf("OriginalDst() = %s, want an error or the listener's own %s", addr, conn.LocalAddr())
+	}
+}
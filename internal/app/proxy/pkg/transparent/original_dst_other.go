@@ -0,0 +1,9 @@
+//go:build !linux
+
+package transparent
+
+import "net"
+
+func OriginalDst(conn net.Conn) (string, error) {
+	return "", ErrUnsupported
+}
@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/socks5"
+)
+
+// DialContext opens a raw TCP stream to addr, tunneled through the upstream
+// proxy the rules pick for it. It serves traffic that cannot go through an
+// http.Transport, such as TLS passed through untouched.
+func (r *Router) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL, err := r.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), defaultPort(proxyURL.Scheme))
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5":
+		var creds *socks5.Credentials
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			creds = &socks5.Credentials{Username: proxyURL.User.Username(), Password: password}
+		}
+
+		err = socks5.Connect(conn, addr, creds)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		conn = tlsConn
+		err = tlsConn.HandshakeContext(ctx)
+		if err == nil {
+			conn, err = connectThrough(conn, proxyURL, addr)
+		}
+	default:
+		conn, err = connectThrough(conn, proxyURL, addr)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %w", proxyURL.Redacted(), err)
+	}
+
+	return conn, nil
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5":
+		return "1080"
+	default:
+		return "80"
+	}
+}
+
+// connectThrough asks an HTTP proxy for a CONNECT tunnel to addr.
+func connectThrough(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// a successful CONNECT answer has no body, whatever follows is the tunnel
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("connect to %s: %s", addr, response.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn keeps bytes the proxy sent right after its CONNECT answer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+const Direct = "direct"
+
+type rule struct {
+	pattern string
+	proxy   *url.URL
+}
+
+// Router picks the upstream proxy for a target host, the first matching rule
+// wins and a nil proxy means the target is dialed directly.
+type Router struct {
+	rules        []rule
+	defaultProxy *url.URL
+	fromEnv      bool
+}
+
+func NewRouter(cfg configs.UpstreamConfig) (*Router, error) {
+	proxies := make(map[string]*url.URL, len(cfg.Proxies))
+	for _, proxyCfg := range cfg.Proxies {
+		if proxyCfg.Name == "" || proxyCfg.Name == Direct {
+			return nil, fmt.Errorf("invalid upstream proxy name %q", proxyCfg.Name)
+		}
+
+		proxyURL, err := parseProxyURL(proxyCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s: %w", proxyCfg.Name, err)
+		}
+
+		proxies[proxyCfg.Name] = proxyURL
+	}
+
+	lookup := func(name string) (*url.URL, error) {
+		if name == Direct {
+			return nil, nil
+		}
+
+		proxyURL, ok := proxies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream proxy %q", name)
+		}
+
+		return proxyURL, nil
+	}
+
+	router := &Router{}
+	for _, ruleCfg := range cfg.Rules {
+		pattern := strings.ToLower(ruleCfg.Host)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("upstream rule host %q: %w", ruleCfg.Host, err)
+		}
+
+		proxyURL, err := lookup(ruleCfg.Via)
+		if err != nil {
+			return nil, err
+		}
+
+		router.rules = append(router.rules, rule{pattern: pattern, proxy: proxyURL})
+	}
+
+	// without any upstream configuration keep honouring HTTP_PROXY and friends
+	if cfg.Default == "" {
+		router.fromEnv = len(cfg.Proxies) == 0 && len(cfg.Rules) == 0
+		return router, nil
+	}
+
+	defaultProxy, err := lookup(cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	router.defaultProxy = defaultProxy
+	return router, nil
+}
+
+func (r *Router) ProxyFor(host string) *url.URL {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, rule := range r.rules {
+		if matched, _ := path.Match(rule.pattern, host); matched {
+			return rule.proxy
+		}
+	}
+
+	return r.defaultProxy
+}
+
+// Proxy has the signature of http.Transport.Proxy.
+func (r *Router) Proxy(req *http.Request) (*url.URL, error) {
+	if r.fromEnv {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	return r.ProxyFor(req.URL.Host), nil
+}
+
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy url %q has no host", rawURL)
+	}
+
+	return proxyURL, nil
+}
@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+func TestRouterProxyFor(t *testing.T) {
+	cfg := configs.UpstreamConfig{
+		Default: "corp",
+		Proxies: []configs.UpstreamProxyConfig{
+			{Name: "corp", URL: "http://corp.example:3128"},
+			{Name: "tor", URL: "socks5://127.0.0.1:9050"},
+		},
+		Rules: []configs.UpstreamRuleConfig{
+			{Host: "*.onion", Via: "tor"},
+			{Host: "intranet.example", Via: "direct"},
+			{Host: "*.Internal.Example", Via: "direct"},
+			// never reached for intranet.example, the first match wins
+			{Host: "intranet.*", Via: "tor"},
+			{Host: "10.*", Via: "direct"},
+		},
+	}
+
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "hidden.onion", want: "socks5://127.0.0.1:9050"},
+		{host: "hidden.onion:80", want: "socks5://127.0.0.1:9050"},
+		{host: "intranet.example", want: ""},
+		{host: "INTRANET.example:443", want: ""},
+		{host: "intranet.test", want: "socks5://127.0.0.1:9050"},
+		{host: "wiki.internal.example", want: ""},
+		// a star spans any number of labels
+		{host: "a.wiki.internal.example", want: ""},
+		{host: "internal.example", want: "http://corp.example:3128"},
+		{host: "10.1.2.3:8080", want: ""},
+		{host: "example.com", want: "http://corp.example:3128"},
+		{host: "[2001:db8::1]:443", want: "http://corp.example:3128"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got := ""
+			if proxyURL := router.ProxyFor(tt.host); proxyURL != nil {
+				got = proxyURL.String()
+			}
+
+			if got != tt.want {
+				t.Errorf("ProxyFor(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterDefaults(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://env.example:8080")
+	request := &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}}
+
+	tests := []struct {
+		name string
+		cfg  configs.UpstreamConfig
+		want string
+	}{
+		{name: "no configuration uses the environment", want: "http://env.example:8080"},
+		{
+			name: "rules without a default go direct",
+			cfg: configs.UpstreamConfig{
+				Proxies: []configs.UpstreamProxyConfig{{Name: "corp", URL: "http://corp.example:3128"}},
+				Rules:   []configs.UpstreamRuleConfig{{Host: "*.corp", Via: "corp"}},
+			},
+		},
+		{name: "direct default", cfg: configs.UpstreamConfig{Default: "direct"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := NewRouter(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			proxyURL, err := router.Proxy(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+			if got != tt.want {
+				t.Errorf("Proxy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRouterRejects(t *testing.T) {
+	proxies := []configs.UpstreamProxyConfig{{Name: "corp", URL: "http://corp.example:3128"}}
+
+	tests := []struct {
+		name string
+		cfg  configs.UpstreamConfig
+	}{
+		{name: "unnamed proxy", cfg: configs.UpstreamConfig{Proxies: []configs.UpstreamProxyConfig{{URL: "http://corp.example:3128"}}}},
+		{name: "proxy named direct", cfg: configs.UpstreamConfig{Proxies: []configs.UpstreamProxyConfig{{Name: "direct", URL: "http://corp.example:3128"}}}},
+		{name: "unsupported scheme", cfg: configs.UpstreamConfig{Proxies: []configs.UpstreamProxyConfig{{Name: "corp", URL: "ftp://corp.example"}}}},
+		{name: "proxy without host", cfg: configs.UpstreamConfig{Proxies: []configs.UpstreamProxyConfig{{Name: "corp", URL: "http://"}}}},
+		{name: "bad pattern", cfg: configs.UpstreamConfig{Proxies: proxies, Rules: []configs.UpstreamRuleConfig{{Host: "[a-", Via: "corp"}}}},
+		{name: "rule via unknown proxy", cfg: configs.UpstreamConfig{Proxies: proxies, Rules: []configs.UpstreamRuleConfig{{Host: "*", Via: "other"}}}},
+		{name: "unknown default", cfg: configs.UpstreamConfig{Proxies: proxies, Default: "other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter(tt.cfg); err == nil {
+				t.Error("NewRouter() accepted the configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type tlsRule struct {
+	pattern   string
+	transport *http.Transport
+}
+
+// Transport sends every request through a clone of the base transport that
+// carries the TLS policy of the target host, so verification, trusted roots,
+// client certificates and minimum versions can differ per upstream.
+type Transport struct {
+	base  *http.Transport
+	rules []tlsRule
+}
+
+// NewTransport applies the default policy to base and derives a transport
+// for every host rule, the first matching rule wins.
+func NewTransport(base *http.Transport, cfg configs.UpstreamTLSConfig) (*Transport, error) {
+	defaultConfig, err := tlsConfig(&tls.Config{}, cfg.InsecureSkipVerify, cfg.RootCAs, cfg.MinVersion, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	base.TLSClientConfig = defaultConfig
+	t := &Transport{base: base}
+
+	for _, hostCfg := range cfg.Hosts {
+		pattern := strings.ToLower(hostCfg.Host)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("upstream tls host %q: %w", hostCfg.Host, err)
+		}
+
+		minVersion := hostCfg.MinVersion
+		if minVersion == "" {
+			minVersion = cfg.MinVersion
+		}
+
+		hostConfig, err := tlsConfig(defaultConfig.Clone(), cfg.InsecureSkipVerify || hostCfg.InsecureSkipVerify,
+			hostCfg.RootCAs, minVersion, hostCfg.ClientCert, hostCfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls host %s: %w", hostCfg.Host, err)
+		}
+
+		transport := base.Clone()
+		transport.TLSClientConfig = hostConfig
+		t.rules = append(t.rules, tlsRule{pattern: pattern, transport: transport})
+	}
+
+	return t, nil
+}
+
+func tlsConfig(config *tls.Config, skipVerify bool, rootCAs []string, minVersion, clientCert, clientKey string) (*tls.Config, error) {
+	config.InsecureSkipVerify = skipVerify
+
+	if len(rootCAs) > 0 {
+		pool := config.RootCAs
+		if pool == nil {
+			systemPool, err := x509.SystemCertPool()
+			if err != nil {
+				systemPool = x509.NewCertPool()
+			}
+			pool = systemPool
+		} else {
+			pool = pool.Clone()
+		}
+
+		for _, file := range rootCAs {
+			bundle, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("read root ca bundle: %w", err)
+			}
+
+			if !pool.AppendCertsFromPEM(bundle) {
+				return nil, fmt.Errorf("root ca bundle %s holds no certificates", file)
+			}
+		}
+
+		config.RootCAs = pool
+	}
+
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", minVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	if clientCert != "" || clientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func (t *Transport) transportFor(host string) *http.Transport {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, rule := range t.rules {
+		if matched, _ := path.Match(rule.pattern, host); matched {
+			return rule.transport
+		}
+	}
+
+	return t.base
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transportFor(req.URL.Host).RoundTrip(req)
+}
+
+func (t *Transport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+	for _, rule := range t.rules {
+		rule.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,235 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+// testPKI is a throwaway CA that issues the certificates of a test server
+// and its clients.
+type testPKI struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "upstream test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pki := &testPKI{dir: t.TempDir(), cert: cert, key: key, serial: 1}
+	pki.caFile = pki.write(t, "ca.crt", "CERTIFICATE", der)
+	return pki
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	file := filepath.Join(p.dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// issue signs a leaf for 127.0.0.1 and returns it with the files it was
+// written to.
+func (p *testPKI) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (tls.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, key.Public(), p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := p.write(t, name+".crt", "CERTIFICATE", der)
+	keyFile := p.write(t, name+".key", "PRIVATE KEY", keyDER)
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, certFile, keyFile
+}
+
+func TestTransportTLSPolicy(t *testing.T) {
+	pki := newTestPKI(t)
+	serverCert, _, _ := pki.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	_, clientCert, clientKey := pki.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	roots := []string{pki.caFile}
+
+	tests := []struct {
+		name string
+		cfg  configs.UpstreamTLSConfig
+		// the server asks for a client certificate signed by the CA
+		requireClientCert bool
+		serverMaxVersion  uint16
+		wantErr           bool
+		wantVersion       uint16
+	}{
+		{name: "unknown authority", wantErr: true},
+		{
+			name:        "skip verify for the host",
+			cfg:         configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "127.0.0.1", InsecureSkipVerify: true}}},
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name:    "skip verify for another host",
+			cfg:     configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "other.test", InsecureSkipVerify: true}}},
+			wantErr: true,
+		},
+		{name: "root ca bundle", cfg: configs.UpstreamTLSConfig{RootCAs: roots}, wantVersion: tls.VersionTLS13},
+		{
+			name:        "root ca bundle for the host",
+			cfg:         configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "127.0.0.*", RootCAs: roots}}},
+			wantVersion: tls.VersionTLS13,
+		},
+		{name: "client certificate missing", cfg: configs.UpstreamTLSConfig{RootCAs: roots}, requireClientCert: true, wantErr: true},
+		{
+			name: "client certificate for the host",
+			cfg: configs.UpstreamTLSConfig{RootCAs: roots, Hosts: []configs.UpstreamTLSHostConfig{
+				{Host: "127.0.0.1", ClientCert: clientCert, ClientKey: clientKey},
+			}},
+			requireClientCert: true,
+			wantVersion:       tls.VersionTLS13,
+		},
+		{name: "minimum version above the server's", cfg: configs.UpstreamTLSConfig{RootCAs: roots, MinVersion: "1.3"}, serverMaxVersion: tls.VersionTLS12, wantErr: true},
+		{
+			name: "minimum version lowered for the host",
+			cfg: configs.UpstreamTLSConfig{RootCAs: roots, MinVersion: "1.3", Hosts: []configs.UpstreamTLSHostConfig{
+				{Host: "127.0.0.1", MinVersion: "1.2"},
+			}},
+			serverMaxVersion: tls.VersionTLS12,
+			wantVersion:      tls.VersionTLS12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			server.Config.ErrorLog = log.New(io.Discard, "", 0)
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, MaxVersion: tt.serverMaxVersion}
+			if tt.requireClientCert {
+				server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TLS.ClientCAs = x509.NewCertPool()
+				server.TLS.ClientCAs.AddCert(pki.cert)
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			transport, err := NewTransport(&http.Transport{}, tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.CloseIdleConnections()
+
+			request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			response, err := transport.RoundTrip(request)
+			if tt.wantErr {
+				if err == nil {
+					response.Body.Close()
+					t.Fatal("RoundTrip() succeeded, want the tls policy to fail it")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.TLS == nil || response.TLS.Version != tt.wantVersion {
+				t.Errorf("negotiated %+v, want %s", response.TLS, tls.VersionName(tt.wantVersion))
+			}
+		})
+	}
+}
+
+func TestNewTransportRejects(t *testing.T) {
+	pki := newTestPKI(t)
+	_, clientCert, clientKey := pki.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("no certificates here"), 0o600)
+
+	tests := []struct {
+		name string
+		cfg  configs.UpstreamTLSConfig
+	}{
+		{name: "unknown version", cfg: configs.UpstreamTLSConfig{MinVersion: "1.4"}},
+		{name: "missing bundle", cfg: configs.UpstreamTLSConfig{RootCAs: []string{filepath.Join(t.TempDir(), "missing.pem")}}},
+		{name: "empty bundle", cfg: configs.UpstreamTLSConfig{RootCAs: []string{empty}}},
+		{name: "host pattern", cfg: configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "[a-"}}}},
+		{name: "host version", cfg: configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "a.test", MinVersion: "ssl3"}}}},
+		{name: "key without certificate", cfg: configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "a.test", ClientKey: clientKey}}}},
+		{name: "mismatched key", cfg: configs.UpstreamTLSConfig{Hosts: []configs.UpstreamTLSHostConfig{{Host: "a.test", ClientCert: clientCert, ClientKey: pki.caFile}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTransport(&http.Transport{}, tt.cfg); err == nil {
+				t.Error("NewTransport() accepted the configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+// NewBaseTransport builds the transport every intercepted exchange goes out
+// through, plain and MITM'd alike, so upstream connections are pooled per
+// host across clients and tunnels. Zero limits and timeouts mean none, as
+// they do for http.Transport.
+func NewBaseTransport(cfg configs.TransportConfig, router *Router) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 router.Proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		// the client picked its encodings, the proxy must not add gzip on
+		// its behalf and hand back a body it never asked for
+		DisableCompression: true,
+	}
+}
@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+)
+
+func TestNewBaseTransport(t *testing.T) {
+	router, err := NewRouter(configs.UpstreamConfig{
+		Default: "corp",
+		Proxies: []configs.UpstreamProxyConfig{{Name: "corp", URL: "http://corp.example:3128"}},
+		Rules:   []configs.UpstreamRuleConfig{{Host: "intranet.example", Via: Direct}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := configs.TransportConfig{
+		DialTimeout:           time.Second,
+		KeepAlive:             2 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ResponseHeaderTimeout: 4 * time.Second,
+		IdleConnTimeout:       5 * time.Second,
+		MaxIdleConns:          6,
+		MaxIdleConnsPerHost:   7,
+		MaxConnsPerHost:       8,
+	}
+	transport := NewBaseTransport(cfg, router)
+
+	if transport.TLSHandshakeTimeout != cfg.TLSHandshakeTimeout || transport.ResponseHeaderTimeout != cfg.ResponseHeaderTimeout ||
+		transport.IdleConnTimeout != cfg.IdleConnTimeout || transport.MaxIdleConns != cfg.MaxIdleConns ||
+		transport.MaxIdleConnsPerHost != cfg.MaxIdleConnsPerHost || transport.MaxConnsPerHost != cfg.MaxConnsPerHost {
+		t.Errorf("transport limits %+v, want those of %+v", transport, cfg)
+	}
+	if !transport.DisableCompression || !transport.ForceAttemptHTTP2 {
+		t.Error("the transport adds encodings the client did not ask for or never tries h2")
+	}
+
+	for host, want := range map[string]string{"intranet.example": "", "example.com": "http://corp.example:3128"} {
+		proxyURL, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "http", Host: host}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if proxyURL != nil {
+			got = proxyURL.String()
+		}
+		if got != want {
+			t.Errorf("proxy for %s = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestBaseTransportReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	var remotes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes = append(remotes, r.RemoteAddr)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	router, err := NewRouter(configs.UpstreamConfig{Default: Direct})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewBaseTransport(configs.TransportConfig{MaxIdleConnsPerHost: 1}, router)
+	defer transport.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remotes) != 2 || remotes[0] != remotes[1] {
+		t.Errorf("requests came from %v, want both on one pooled connection", remotes)
+	}
+}
+
+func TestBaseTransportResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	router, err := NewRouter(configs.UpstreamConfig{Default: Direct})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewBaseTransport(configs.TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond}, router)
+	defer transport.CloseIdleConnections()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	if response, err := transport.RoundTrip(request); err == nil {
+		response.Body.Close()
+		t.Fatal("RoundTrip() waited for a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RoundTrip() gave up after %s, want about the 50ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+
+	// frames are always relayed in full, only the stored copy is capped
+	maxCapturedPayload = 1 << 20
+)
+
+type Message struct {
+	Opcode  int
+	Payload []byte
+	Time    time.Time
+}
+
+func IsUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// Relay copies frames from src to dst unchanged and reports every complete
+// message, control frames included, once its final fragment has been relayed.
+func Relay(dst io.Writer, src *bufio.Reader, onMessage func(Message)) error {
+	var (
+		message []byte
+		opcode  int
+	)
+
+	for {
+		header := make([]byte, 2, 14)
+		if _, err := io.ReadFull(src, header); err != nil {
+			return err
+		}
+
+		fin := header[0]&0x80 != 0
+		frameOpcode := int(header[0] & 0x0f)
+		masked := header[1]&0x80 != 0
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			header = header[:4]
+			if _, err := io.ReadFull(src, header[2:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[2:]))
+		case 127:
+			header = header[:10]
+			if _, err := io.ReadFull(src, header[2:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(header[2:])
+		}
+
+		var maskKey []byte
+		if masked {
+			start := len(header)
+			header = header[:start+4]
+			if _, err := io.ReadFull(src, header[start:]); err != nil {
+				return err
+			}
+			maskKey = header[start:]
+		}
+
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+
+		capture := &payloadCapture{maskKey: maskKey}
+		if frameOpcode == OpContinuation {
+			capture.buf = message
+		}
+
+		if _, err := io.CopyN(io.MultiWriter(dst, capture), src, int64(length)); err != nil {
+			return err
+		}
+
+		if frameOpcode >= OpClose {
+			onMessage(Message{Opcode: frameOpcode, Payload: capture.buf, Time: time.Now()})
+			continue
+		}
+
+		if frameOpcode != OpContinuation {
+			opcode = frameOpcode
+		}
+
+		message = capture.buf
+		if fin {
+			onMessage(Message{Opcode: opcode, Payload: message, Time: time.Now()})
+			message = nil
+		}
+	}
+}
+
+type payloadCapture struct {
+	buf     []byte
+	maskKey []byte
+	offset  int
+}
+
+func (c *payloadCapture) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.maskKey != nil {
+			b ^= c.maskKey[c.offset%4]
+		}
+		c.offset++
+
+		if len(c.buf) < maxCapturedPayload {
+			c.buf = append(c.buf, b)
+		}
+	}
+
+	return len(p), nil
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
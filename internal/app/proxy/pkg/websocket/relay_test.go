@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frame encodes a single frame, a non-nil mask key masks the payload the way
+// a client has to.
+func frame(fin bool, opcode int, payload, maskKey []byte) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+
+	var maskBit byte
+	if maskKey != nil {
+		maskBit = 0x80
+	}
+
+	out := []byte{first}
+	switch {
+	case len(payload) < 126:
+		out = append(out, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		out = append(out, maskBit|126)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)))
+	default:
+		out = append(out, maskBit|127)
+		out = binary.BigEndian.AppendUint64(out, uint64(len(payload)))
+	}
+
+	if maskKey == nil {
+		return append(out, payload...)
+	}
+
+	out = append(out, maskKey...)
+	for i, b := range payload {
+		out = append(out, b^maskKey[i%4])
+	}
+
+	return out
+}
+
+func TestRelay(t *testing.T) {
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+	otherKey := []byte{0x01, 0x02, 0x03, 0x04}
+	medium := bytes.Repeat([]byte("m"), 300)
+	large := bytes.Repeat([]byte("0123456789"), 7000)
+	oversized := bytes.Repeat([]byte("x"), maxCapturedPayload+10)
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []Message
+	}{
+		{
+			name:   "masked client text",
+			frames: [][]byte{frame(true, OpText, []byte("hello"), key)},
+			want:   []Message{{Opcode: OpText, Payload: []byte("hello")}},
+		},
+		{
+			name:   "unmasked server binary",
+			frames: [][]byte{frame(true, OpBinary, []byte{0, 1, 2, 0xff}, nil)},
+			want:   []Message{{Opcode: OpBinary, Payload: []byte{0, 1, 2, 0xff}}},
+		},
+		{
+			name: "fragments around control frames",
+			frames: [][]byte{
+				frame(false, OpText, []byte("hel"), key),
+				frame(true, OpPing, []byte("are you there"), otherKey),
+				frame(false, OpContinuation, []byte("lo "), otherKey),
+				frame(true, OpPong, nil, key),
+				frame(true, OpClose, []byte{0x03, 0xe8}, key),
+				frame(true, OpContinuation, []byte("world"), key),
+			},
+			want: []Message{
+				{Opcode: OpPing, Payload: []byte("are you there")},
+				{Opcode: OpPong},
+				{Opcode: OpClose, Payload: []byte{0x03, 0xe8}},
+				{Opcode: OpText, Payload: []byte("hello world")},
+			},
+		},
+		{
+			name:   "16-bit length",
+			frames: [][]byte{frame(true, OpBinary, medium, key)},
+			want:   []Message{{Opcode: OpBinary, Payload: medium}},
+		},
+		{
+			name:   "64-bit length",
+			frames: [][]byte{frame(true, OpBinary, large, nil)},
+			want:   []Message{{Opcode: OpBinary, Payload: large}},
+		},
+		{
+			name:   "stored copy capped",
+			frames: [][]byte{frame(true, OpText, oversized, key)},
+			want:   []Message{{Opcode: OpText, Payload: oversized[:maxCapturedPayload]}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := bytes.Join(tt.frames, nil)
+
+			var relayed bytes.Buffer
+			var got []Message
+			err := Relay(&relayed, bufio.NewReader(bytes.NewReader(input)), func(message Message) {
+				got = append(got, message)
+			})
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("Relay() = %v, want io.EOF at the end of the stream", err)
+			}
+
+			if !bytes.Equal(relayed.Bytes(), input) {
+				t.Errorf("relayed %d bytes, want the %d input bytes unchanged", relayed.Len(), len(input))
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("reported %d messages, want %d", len(got), len(tt.want))
+			}
+			for i, message := range got {
+				if message.Opcode != tt.want[i].Opcode || !bytes.Equal(message.Payload, tt.want[i].Payload) || message.Time.IsZero() {
+					t.Errorf("message %d = opcode %d with %d bytes, want opcode %d with %d bytes", i, message.Opcode, len(message.Payload), tt.want[i].Opcode, len(tt.want[i].Payload))
+				}
+			}
+		})
+	}
+}
+
+func TestRelayTruncatedFrame(t *testing.T) {
+	input := frame(true, OpText, []byte("hello"), nil)
+
+	reported := false
+	err := Relay(io.Discard, bufio.NewReader(bytes.NewReader(input[:len(input)-2])), func(Message) {
+		reported = true
+	})
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Relay() = %v, want the stream to end mid-frame", err)
+	}
+	if reported {
+		t.Error("Relay() reported a message whose frame was cut off")
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// captureBuffer keeps at most limit bytes of everything written to it while
+// still counting the full length, a limit of zero or less keeps everything.
+type captureBuffer struct {
+	limit  int64
+	length int64
+	buf    bytes.Buffer
+}
+
+func newCaptureBuffer(limit int64) *captureBuffer {
+	return &captureBuffer{limit: limit}
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	c.length += int64(len(p))
+
+	keep := p
+	if c.limit > 0 {
+		if room := c.limit - int64(c.buf.Len()); room < int64(len(keep)) {
+			keep = keep[:max(room, 0)]
+		}
+	}
+	c.buf.Write(keep)
+
+	return len(p), nil
+}
+
+func (c *captureBuffer) truncated() bool {
+	return c.length > int64(c.buf.Len())
+}
+
+// request fills in the body of a stored request, cut like response bodies are.
+func (c *captureBuffer) request(stored *models.Request) {
+	stored.Body = c.buf.Bytes()
+	stored.BodyTruncated = c.truncated()
+	stored.BodyLength = c.length
+}
+
+func (c *captureBuffer) response(res *http.Response) *models.Response {
+	stored := &models.Response{
+		Code:          res.StatusCode,
+		Message:       res.Status,
+		Proto:         res.Proto,
+		Headers:       res.Header,
+		Body:          c.buf.Bytes(),
+		BodyTruncated: c.truncated(),
+		BodyLength:    c.length,
+	}
+
+	setTLSDetails(stored, res.TLS)
+	return stored
+}
+
+// setTLSDetails notes what was negotiated with the upstream, responses that
+// came over plain http keep them empty.
+func setTLSDetails(stored *models.Response, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+
+	stored.TLSVersion = tls.VersionName(state.Version)
+	stored.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+
+	var chain bytes.Buffer
+	for _, certificate := range state.PeerCertificates {
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	stored.TLSCertificates = chain.String()
+}
+
+// teeBody copies a request body into capture as the transport consumes it.
+// The transport may keep writing the body after RoundTrip has returned, so
+// the capture is only complete once the transport has closed it.
+type teeBody struct {
+	io.Reader
+	body      io.Closer
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newTeeBody(body io.ReadCloser, capture io.Writer) *teeBody {
+	return &teeBody{
+		Reader: io.TeeReader(body, capture),
+		body:   body,
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *teeBody) Close() error {
+	err := t.body.Close()
+	t.closeOnce.Do(func() { close(t.closed) })
+	return err
+}
+
+func (t *teeBody) wait() {
+	<-t.closed
+}
+
+func teeRequestBody(r *http.Request, capture io.Writer) func() {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() {}
+	}
+
+	body := newTeeBody(r.Body, capture)
+	r.Body = body
+	return body.wait
+}
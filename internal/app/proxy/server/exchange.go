@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/intercept"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// exchange says where a proxied request came from and where it is headed.
+type exchange struct {
+	reqID        string
+	connectionId string
+	listener     string
+	scheme       string
+	host         string
+}
+
+// newStoredRequest records what the client sent and how it reached the proxy.
+// A tunnel is routed by its target, a Host header naming anything else is
+// kept with the other headers.
+func newStoredRequest(r *http.Request, ex exchange) *models.Request {
+	headers := r.Header
+	if r.Host != "" && r.Host != ex.host {
+		headers = r.Header.Clone()
+		headers["Host"] = []string{r.Host}
+	}
+
+	request := &models.Request{
+		Method:       r.Method,
+		Scheme:       ex.scheme,
+		Host:         ex.host,
+		Path:         r.URL.Path,
+		Proto:        r.Proto,
+		Headers:      headers,
+		Params:       r.URL.Query(),
+		ConnectionId: ex.connectionId,
+		CreatedAt:    time.Now(),
+		ClientAddr:   r.RemoteAddr,
+		Listener:     ex.listener,
+		ReqId:        ex.reqID,
+	}
+
+	if r.TLS != nil {
+		request.SNI = r.TLS.ServerName
+	}
+
+	return request
+}
+
+// sendRequestID passes the id of the exchange on to the upstream when the
+// proxy is configured to, so the target can log it too.
+func (ps ProxyServer) sendRequestID(outRequest *http.Request, ex exchange) {
+	if header := ps.requestIDs.UpstreamHeader(); header != "" {
+		outRequest.Header.Set(header, ex.reqID)
+	}
+}
+
+// forward sends r upstream, streams the response back and records both,
+// holding either side in the intercept queue when a breakpoint matches.
+func (ps ProxyServer) forward(w http.ResponseWriter, r *http.Request, ex exchange) {
+	outRequest := r.Clone(r.Context())
+	outRequest.RequestURI = ""
+	outRequest.URL.Scheme = ex.scheme
+	outRequest.URL.Host = ex.host
+	removeHopHeaders(outRequest.Header)
+	// Connection: close is hop by hop too, the client closing its connection
+	// must not take the pooled upstream one down with it
+	outRequest.Close = false
+	ps.sendRequestID(outRequest, ex)
+
+	request := newStoredRequest(r, ex)
+
+	if ps.rewrites != nil {
+		fired, err := ps.rewrites.Request(outRequest)
+		if err != nil {
+			ps.logger.WithField("reqID", ex.reqID).Errorln("read request body failed:", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(fired) > 0 {
+			request.RulesFired = fired
+			updateStoredRequest(request, outRequest)
+		}
+	}
+
+	if ps.intercepts != nil && ps.intercepts.Matches(intercept.KindRequest, outRequest.Method, outRequest.URL.Host, outRequest.URL.Path) {
+		if !ps.holdRequest(w, outRequest, request, ex) {
+			return
+		}
+	}
+
+	timer := newExchangeTimer()
+	outRequest = timer.trace(outRequest)
+
+	requestBody := newCaptureBuffer(ps.captureCfg.MaxBodySize)
+	requestBodyDone := teeRequestBody(outRequest, requestBody)
+
+	response, err := ps.transport.RoundTrip(outRequest)
+	if err != nil {
+		ps.logger.WithField("reqID", ex.reqID).Errorln("round trip failed:", err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+
+	var responseRules []string
+	if ps.rewrites != nil {
+		responseRules, err = ps.rewrites.Response(response)
+		if err != nil {
+			ps.logger.WithField("reqID", ex.reqID).Errorln("read response body failed:", err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	if ps.intercepts != nil && ps.intercepts.Matches(intercept.KindResponse, outRequest.Method, outRequest.URL.Host, outRequest.URL.Path) {
+		ps.holdResponse(outRequest, response, ex)
+	}
+
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	for key := range response.Trailer {
+		w.Header().Add("Trailer", key)
+	}
+
+	ps.requestIDs.Respond(w.Header(), response.Header, ex.reqID)
+
+	responseBody := newCaptureBuffer(ps.captureCfg.MaxBodySize)
+	w.WriteHeader(response.StatusCode)
+	if err = copyAndFlush(w, io.TeeReader(response.Body, responseBody)); err != nil {
+		ps.logger.WithField("reqID", ex.reqID).Errorln("write to local connection failed:", err.Error())
+	}
+
+	for key, values := range response.Trailer {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	requestBodyDone()
+
+	requestBody.request(request)
+	storedResponse := responseBody.response(response)
+	storedResponse.RulesFired = responseRules
+	storedResponse.Timings = timer.finish()
+	ps.saveExchange(ex.reqID, request, storedResponse)
+}
+
+// holdRequest parks a fully read request in the intercept queue and applies
+// the decision to it and to its stored copy. It returns false when the
+// request has been answered or dropped instead of forwarded.
+func (ps ProxyServer) holdRequest(w http.ResponseWriter, outRequest *http.Request, request *models.Request, ex exchange) bool {
+	body, err := readBody(outRequest.Body)
+	if err != nil {
+		ps.logger.WithField("reqID", ex.reqID).Errorln("read request body failed:", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	ps.logger.WithField("reqID", ex.reqID).Infoln("request held by intercept queue")
+	decision := ps.intercepts.Hold(outRequest.Context(), &intercept.Item{
+		Kind:         intercept.KindRequest,
+		ConnectionId: ex.connectionId,
+		Method:       outRequest.Method,
+		URL:          outRequest.URL.String(),
+		Headers:      outRequest.Header.Clone(),
+		Body:         body,
+	})
+
+	switch decision.Action {
+	case intercept.ActionDrop:
+		ps.logger.WithField("reqID", ex.reqID).Infoln("held request dropped")
+		// aborting closes the client connection without an answer
+		panic(http.ErrAbortHandler)
+	case intercept.ActionRespond:
+		requestBody := newCaptureBuffer(ps.captureCfg.MaxBodySize)
+		requestBody.Write(body)
+		requestBody.request(request)
+		ps.respondCanned(w, request, decision, ex)
+		return false
+	}
+
+	if decision.Method != "" {
+		outRequest.Method = decision.Method
+	}
+
+	if decision.URL != "" {
+		target, err := url.Parse(decision.URL)
+		if err != nil || target.Host == "" {
+			ps.logger.WithField("reqID", ex.reqID).Errorln("edited url is invalid:", decision.URL)
+			http.Error(w, "edited url is invalid", http.StatusBadRequest)
+			return false
+		}
+
+		outRequest.URL = target
+		outRequest.Host = target.Host
+	}
+
+	if decision.Headers != nil {
+		outRequest.Header = http.Header(decision.Headers).Clone()
+	}
+
+	if decision.Method != "" || decision.URL != "" || decision.Headers != nil {
+		updateStoredRequest(request, outRequest)
+	}
+
+	if decision.Body != nil {
+		body = decision.Body
+	}
+
+	outRequest.ContentLength = int64(len(body))
+	outRequest.TransferEncoding = nil
+	outRequest.Body = http.NoBody
+	if len(body) > 0 {
+		outRequest.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return true
+}
+
+// holdResponse parks a fully read response in the intercept queue and
+// applies the edits of the decision to it before it is written back.
+func (ps ProxyServer) holdResponse(outRequest *http.Request, response *http.Response, ex exchange) {
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		ps.logger.WithField("reqID", ex.reqID).Errorln("read response body failed:", err.Error())
+	}
+
+	ps.logger.WithField("reqID", ex.reqID).Infoln("response held by intercept queue")
+	decision := ps.intercepts.Hold(outRequest.Context(), &intercept.Item{
+		Kind:         intercept.KindResponse,
+		ConnectionId: ex.connectionId,
+		Method:       outRequest.Method,
+		URL:          outRequest.URL.String(),
+		Code:         response.StatusCode,
+		Headers:      response.Header.Clone(),
+		Body:         body,
+	})
+
+	if decision.Action == intercept.ActionDrop {
+		ps.logger.WithField("reqID", ex.reqID).Infoln("held response dropped")
+		panic(http.ErrAbortHandler)
+	}
+
+	if decision.Code != 0 {
+		response.StatusCode = decision.Code
+		response.Status = strconv.Itoa(decision.Code) + " " + http.StatusText(decision.Code)
+	}
+
+	if decision.Headers != nil {
+		response.Header = http.Header(decision.Headers).Clone()
+	}
+
+	if decision.Body != nil {
+		body = decision.Body
+		response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// respondCanned answers a held request without contacting the upstream.
+func (ps ProxyServer) respondCanned(w http.ResponseWriter, request *models.Request, decision intercept.Decision, ex exchange) {
+	code := decision.Code
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	canned := make(http.Header, len(decision.Headers))
+	for key, values := range decision.Headers {
+		for _, value := range values {
+			canned.Add(key, value)
+			w.Header().Add(key, value)
+		}
+	}
+
+	ps.requestIDs.Respond(w.Header(), canned, ex.reqID)
+	w.WriteHeader(code)
+	if _, err := w.Write(decision.Body); err != nil {
+		ps.logger.WithField("reqID", ex.reqID).Errorln("write to local connection failed:", err.Error())
+	}
+
+	ps.saveExchange(ex.reqID, request, &models.Response{
+		Code:       code,
+		Message:    strconv.Itoa(code) + " " + http.StatusText(code),
+		Proto:      request.Proto,
+		Headers:    decision.Headers,
+		Body:       decision.Body,
+		BodyLength: int64(len(decision.Body)),
+		Timings:    models.Timings{Start: time.Now()},
+	})
+}
+
+// updateStoredRequest makes the stored copy describe a request that was
+// changed on its way upstream, the body is captured as it is sent anyway.
+func updateStoredRequest(request *models.Request, outRequest *http.Request) {
+	request.Method = outRequest.Method
+	request.Scheme = outRequest.URL.Scheme
+	request.Host = outRequest.URL.Host
+	request.Path = outRequest.URL.Path
+	request.Params = outRequest.URL.Query()
+	request.Headers = outRequest.Header
+}
+
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+
+	defer body.Close()
+	return io.ReadAll(body)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/intercept"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/passthrough"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/rewrite"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/scope"
+)
+
+// tracker knows every listener, server and raw connection the proxy owns, so
+// a shutdown can stop accepting, let in-flight exchanges and tunnels finish
+// and cut off whatever is still open once the deadline passes.
+type tracker struct {
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	servers   map[*http.Server]struct{}
+	conns     map[net.Conn]struct{}
+	active    sync.WaitGroup
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		listeners: make(map[net.Listener]struct{}),
+		servers:   make(map[*http.Server]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (t *tracker) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closing
+}
+
+// addListener reports false once shutdown has begun, the caller should close
+// the listener and stop.
+func (t *tracker) addListener(listener net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closing {
+		return false
+	}
+
+	t.listeners[listener] = struct{}{}
+	return true
+}
+
+func (t *tracker) removeListener(listener net.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.listeners, listener)
+}
+
+// addServer reports false once shutdown has begun.
+func (t *tracker) addServer(server *http.Server) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closing {
+		return false
+	}
+
+	t.servers[server] = struct{}{}
+	return true
+}
+
+func (t *tracker) removeServer(server *http.Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.servers, server)
+}
+
+// addConn counts a connection as in flight until removeConn, it reports
+// false once shutdown has begun.
+func (t *tracker) addConn(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closing {
+		return false
+	}
+
+	t.conns[conn] = struct{}{}
+	t.active.Add(1)
+	return true
+}
+
+func (t *tracker) removeConn(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		t.active.Done()
+	}
+}
+
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+
+	listeners := make([]net.Listener, 0, len(t.listeners))
+	for listener := range t.listeners {
+		listeners = append(listeners, listener)
+	}
+
+	servers := make([]*http.Server, 0, len(t.servers))
+	for server := range t.servers {
+		servers = append(servers, server)
+	}
+	t.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	// Shutdown closes idle keep-alive connections right away and the busy
+	// ones as soon as their current exchange is done
+	var draining sync.WaitGroup
+	for _, server := range servers {
+		draining.Add(1)
+		go func(server *http.Server) {
+			defer draining.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		draining.Wait()
+		t.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	for server := range t.servers {
+		server.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	return ctx.Err()
+}
+
+// Shutdown stops every listener of the proxy and waits for in-flight
+// exchanges, tunnels and websocket sessions to finish. Whatever is still
+// open when ctx expires is closed.
+func (ps ProxyServer) Shutdown(ctx context.Context) error {
+	return ps.tracker.shutdown(ctx)
+}
+
+// Reload applies the rule sections of a re-read configuration. Every section
+// is checked before any is applied, so a broken file changes nothing.
+func (ps ProxyServer) Reload(cfg configs.ReloadableConfig) error {
+	if _, err := intercept.NewQueue(cfg.Intercept); err != nil {
+		return err
+	}
+	if _, err := rewrite.NewEngine(cfg.Rewrite, ps.captureCfg.MaxDecodedSize); err != nil {
+		return err
+	}
+	if _, err := scope.New(cfg.Scope); err != nil {
+		return err
+	}
+	if _, err := passthrough.NewList(cfg.Passthrough); err != nil {
+		return err
+	}
+
+	if err := ps.intercepts.Reload(cfg.Intercept); err != nil {
+		return err
+	}
+	if err := ps.rewrites.Reload(cfg.Rewrite); err != nil {
+		return err
+	}
+	if err := ps.scope.Reload(cfg.Scope); err != nil {
+		return err
+	}
+
+	return ps.passthrough.Reload(cfg.Passthrough)
+}
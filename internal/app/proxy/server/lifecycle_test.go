@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTrackerShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// finish ends the in-flight work before the deadline
+		finish  bool
+		timeout time.Duration
+		want    error
+	}{
+		{name: "drains", finish: true, timeout: 5 * time.Second},
+		{name: "deadline", timeout: 50 * time.Millisecond, want: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTracker()
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			if !tr.addListener(listener) {
+				t.Fatal("addListener() refused before shutdown")
+			}
+
+			// a tunnel held open by its client
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			if !tr.addConn(conn) {
+				t.Fatal("addConn() refused before shutdown")
+			}
+
+			// an exchange still waiting for its upstream
+			started := make(chan struct{})
+			release := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+			})}
+			if !tr.addServer(server) {
+				t.Fatal("addServer() refused before shutdown")
+			}
+			serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(serverListener)
+
+			exchangeErr := make(chan error, 1)
+			go func() {
+				response, err := http.Get("http://" + serverListener.Addr().String())
+				if err == nil {
+					response.Body.Close()
+				}
+				exchangeErr <- err
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- tr.shutdown(ctx)
+			}()
+
+			if _, err = listener.Accept(); err == nil {
+				t.Error("the listener still accepts after shutdown began")
+			}
+			for !tr.isClosing() {
+				time.Sleep(time.Millisecond)
+			}
+			if tr.addConn(&net.TCPConn{}) || tr.addServer(&http.Server{}) || tr.addListener(listener) {
+				t.Error("the tracker took new work after shutdown began")
+			}
+
+			if tt.finish {
+				select {
+				case err = <-done:
+					t.Fatalf("shutdown() = %v with work in flight", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				close(release)
+				if err = <-exchangeErr; err != nil {
+					t.Errorf("the in-flight exchange failed: %v", err)
+				}
+				tr.removeConn(conn)
+			} else {
+				defer close(release)
+			}
+
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown() did not return")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("shutdown() = %v, want %v", err, tt.want)
+			}
+
+			// the deadline closes the tunnel, a drained one is left to its owner
+			peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, readErr := peer.Read(make([]byte, 1))
+			if isTimeout(readErr) != tt.finish {
+				t.Errorf("tunnel read after shutdown = %v", readErr)
+			}
+			if !tt.finish {
+				if err = <-exchangeErr; err == nil {
+					t.Error("the in-flight exchange finished after the deadline")
+				}
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
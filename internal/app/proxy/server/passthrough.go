@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+const (
+	passthroughDialTimeout = 30 * time.Second
+
+	// pinnedCloseWindow is how soon after the handshake a client has to hang
+	// up without a request for it to count as rejecting the certificate,
+	// idle preconnects are closed much later
+	pinnedCloseWindow = 2 * time.Second
+)
+
+// errClosedAfterHandshake is how a pinning client that completes the
+// handshake and then checks the pin shows up, it sends no alert.
+var errClosedAfterHandshake = errors.New("client closed the connection after the handshake without sending a request")
+
+// readOnlyConn lets a tls.Server parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekClientHello reads the server name the client asked for and returns a
+// reader that replays everything consumed on the way.
+func peekClientHello(conn net.Conn, reader io.Reader) (string, io.Reader) {
+	var peeked bytes.Buffer
+	var serverName string
+
+	tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(reader, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, io.EOF
+		},
+	}).Handshake()
+
+	return serverName, io.MultiReader(&peeked, reader)
+}
+
+// servePassthrough tunnels the connection to target byte for byte, the
+// traffic stays encrypted end to end and is not recorded.
+func (ps ProxyServer) servePassthrough(conn net.Conn, target, connID string) {
+	ps.logger.WithField("reqID", connID).Infoln("passing tls through to", target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), passthroughDialTimeout)
+	upstream, err := ps.router.DialContext(ctx, target)
+	cancel()
+	if err != nil {
+		ps.logger.WithField("reqID", connID).Errorln("passthrough dial failed:", err.Error())
+		return
+	}
+
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+
+	// either side hanging up ends the tunnel, closing both unblocks the other copy
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+}
+
+// certificateRejections are the alerts a client answers a certificate it
+// does not accept with. Other handshake failures, a client hanging up or
+// speaking no TLS at all, say nothing about pinning.
+var certificateRejections = []tls.AlertError{
+	42, // bad_certificate
+	46, // certificate_unknown
+	48, // unknown_ca
+}
+
+// rejectedCertificate reports whether the client failed the handshake by
+// alerting that it rejects the certificate, or hung up right after it.
+func rejectedCertificate(handshakeErr error) bool {
+	if errors.Is(handshakeErr, errClosedAfterHandshake) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if !errors.As(handshakeErr, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+
+	// crypto/tls reports the alert it received with the unexported type the
+	// exported AlertError shares its messages with
+	for _, alert := range certificateRejections {
+		if opErr.Err.Error() == alert.Error() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handshakeFailed records a failed handshake with a client for host, counts
+// it when the client refused the minted certificate and switches the host to
+// passthrough once that keeps happening.
+func (ps ProxyServer) handshakeFailed(host, connID string, handshakeErr error) {
+	ps.saveTLSEvent(&models.TLSEvent{
+		Host:         host,
+		Kind:         models.TLSEventHandshakeFailed,
+		ConnectionId: connID,
+		Detail:       handshakeErr.Error(),
+		Time:         time.Now(),
+	})
+
+	if !rejectedCertificate(handshakeErr) || !ps.passthrough.HandshakeFailed(host) {
+		return
+	}
+
+	ps.logger.WithField("host", host).Warnln("client keeps rejecting the minted certificate, host added to passthrough")
+	ps.saveTLSEvent(&models.TLSEvent{
+		Host:         host,
+		Kind:         models.TLSEventPassthroughAdded,
+		ConnectionId: connID,
+		Detail:       "repeated client handshake failures, likely certificate pinning",
+		Time:         time.Now(),
+	})
+}
+
+func (ps ProxyServer) saveTLSEvent(event *models.TLSEvent) {
+	if err := ps.requestUseCase.SaveTLSEvent(event); err != nil {
+		ps.logger.WithField("reqID", event.ConnectionId).Errorln("SaveTLSEvent error: ", err.Error())
+	}
+}
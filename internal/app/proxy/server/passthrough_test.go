@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/passthrough"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// clientHandshakeError runs a handshake against the certificate of a test
+// server with client and returns the error the server side failed with.
+func clientHandshakeError(t *testing.T, client func(conn net.Conn)) error {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		client(clientConn)
+		clientConn.Close()
+	}()
+
+	tlsConn := tls.Server(serverConn, srv.TLS)
+	defer tlsConn.Close()
+
+	return tlsConn.Handshake()
+}
+
+func TestRejectedCertificate(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func(conn net.Conn)
+		want   bool
+	}{
+		{
+			name: "unknown authority",
+			client: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+			},
+			want: true,
+		},
+		{
+			name: "pinned key",
+			client: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{InsecureSkipVerify: true, VerifyConnection: func(tls.ConnectionState) error {
+					return errors.New("pinned key differs")
+				}}).Handshake()
+			},
+			want: true,
+		},
+		{
+			name:   "client hangs up",
+			client: func(conn net.Conn) {},
+		},
+		{
+			name: "no tls",
+			client: func(conn net.Conn) {
+				io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+			},
+		},
+		{
+			name: "protocol version",
+			client: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS10}).Handshake()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := clientHandshakeError(t, tt.client)
+			if err == nil {
+				t.Fatal("handshake succeeded")
+			}
+
+			if got := rejectedCertificate(err); got != tt.want {
+				t.Errorf("rejectedCertificate(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinningClientAddsPassthrough(t *testing.T) {
+	const host = "pinned.test"
+
+	tests := []struct {
+		name string
+		// clients are the connections made in order, true for a client that
+		// sends a request, false for one that hangs up after the handshake
+		clients []bool
+		want    bool
+	}{
+		{name: "hangs up after the handshake", clients: []bool{false, false}, want: true},
+		{name: "below the threshold", clients: []bool{false}},
+		{name: "sends requests", clients: []bool{true, true}},
+		{name: "a request clears the failures", clients: []bool{false, true, false}},
+	}
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "https://")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCase := newFakeUseCase()
+			ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+			ps.authority, _ = newTestAuthority(t)
+			ps.transport = upstream.Client().Transport
+
+			var err error
+			ps.passthrough, err = passthrough.NewList(configs.PassthroughConfig{AutoDetect: true, FailureThreshold: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, sendsRequest := range tt.clients {
+				client, conn := net.Pipe()
+				served := make(chan struct{})
+				go func() {
+					ps.serveIntercepted(conn, target, "conn-"+strconv.Itoa(i), models.ListenerHTTP)
+					close(served)
+				}()
+
+				// the client trusts any certificate, then checks its pin
+				tlsConn := tls.Client(client, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+				if err = tlsConn.Handshake(); err != nil {
+					t.Fatal(err)
+				}
+
+				if sendsRequest {
+					io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+					response, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					response.Body.Close()
+				}
+
+				tlsConn.Close()
+				<-served
+			}
+
+			if got := ps.passthrough.Contains(host); got != tt.want {
+				t.Fatalf("passthrough contains %s = %v, want %v", host, got, tt.want)
+			}
+
+			events, _ := useCase.GetTLSEvents()
+			added := 0
+			for _, event := range events {
+				if event.Host != host {
+					t.Errorf("event for %q, want %q", event.Host, host)
+				}
+				if event.Kind == models.TLSEventPassthroughAdded {
+					added++
+				}
+			}
+			if tt.want != (added == 1) || added > 1 {
+				t.Errorf("recorded %d passthrough additions, want the host added %v", added, tt.want)
+			}
+		})
+	}
+}
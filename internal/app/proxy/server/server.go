@@ -1,18 +1,22 @@
 package server
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
-	"io"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"os/exec"
-	"strings"
 
 	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/certs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/intercept"
 	mw2 "github.com/JuFnd/go-proxy/internal/app/proxy/pkg/mw"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/passthrough"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/rewrite"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/scope"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/transparent"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/upstream"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/websocket"
 	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
-	repo "github.com/JuFnd/go-proxy/internal/app/server/repository"
 	"github.com/JuFnd/go-proxy/internal/app/server/usecase"
 
 	"github.com/sirupsen/logrus"
@@ -22,14 +26,71 @@ type ProxyServer struct {
 	requestUseCase usecase.IUseCase
 	tlsCfg         *configs.TlsConfig
 	srvCfg         *configs.HTTPSrvConfig
-	requests       *repo.PostgresRepository
+	captureCfg     *configs.CaptureConfig
+	socks5Cfg      *configs.Socks5Config
+	transparentCfg *configs.TransparentConfig
+	originalDst    func(conn net.Conn) (string, error)
+	authority      *certs.Authority
+	transport      http.RoundTripper
+	intercepts     *intercept.Queue
+	rewrites       *rewrite.Engine
+	scope          *scope.Scope
+	passthrough    *passthrough.List
+	router         *upstream.Router
+	requestIDs     *mw2.RequestIDs
+	tracker        *tracker
 	logger         *logrus.Logger
 }
 
-func New(srvCfg *configs.HTTPSrvConfig, tlsCfg *configs.TlsConfig, psxCfg *configs.WebConfig, requestUseCase usecase.IUseCase, logger *logrus.Logger) *ProxyServer {
-	requests, err := repo.GetUserRepo(psxCfg, logger)
+func New(srvCfg *configs.HTTPSrvConfig, tlsCfg *configs.TlsConfig, captureCfg *configs.CaptureConfig, upstreamCfg *configs.UpstreamConfig, upstreamTLSCfg *configs.UpstreamTLSConfig, transportCfg *configs.TransportConfig, socks5Cfg *configs.Socks5Config, transparentCfg *configs.TransparentConfig, interceptCfg *configs.InterceptConfig, rewriteCfg *configs.RewriteConfig, scopeCfg *configs.ScopeConfig, passthroughCfg *configs.PassthroughConfig, requestIDCfg *configs.RequestIDConfig, requestUseCase usecase.IUseCase, logger *logrus.Logger) *ProxyServer {
+	authority, err := certs.NewAuthority(tlsCfg.CaCertFile, tlsCfg.CaKeyFile, tlsCfg.CertCacheSize, tlsCfg.CertTTL)
 	if err != nil {
-		logger.Error("Request repository is not responding")
+		logger.WithFields(logrus.Fields{
+			"ca cert file": tlsCfg.CaCertFile,
+			"ca key file":  tlsCfg.CaKeyFile,
+		}).Errorln("certificate authority init failed:", err.Error())
+		return nil
+	}
+
+	router, err := upstream.NewRouter(*upstreamCfg)
+	if err != nil {
+		logger.Errorln("upstream router init failed:", err.Error())
+		return nil
+	}
+
+	intercepts, err := intercept.NewQueue(*interceptCfg)
+	if err != nil {
+		logger.Errorln("intercept queue init failed:", err.Error())
+		return nil
+	}
+
+	rewrites, err := rewrite.NewEngine(*rewriteCfg, captureCfg.MaxDecodedSize)
+	if err != nil {
+		logger.Errorln("rewrite rules init failed:", err.Error())
+		return nil
+	}
+
+	targetScope, err := scope.New(*scopeCfg)
+	if err != nil {
+		logger.Errorln("scope init failed:", err.Error())
+		return nil
+	}
+
+	passthroughList, err := passthrough.NewList(*passthroughCfg)
+	if err != nil {
+		logger.Errorln("passthrough list init failed:", err.Error())
+		return nil
+	}
+
+	requestIDs, err := mw2.NewRequestIDs(*requestIDCfg)
+	if err != nil {
+		logger.Errorln("request ids init failed:", err.Error())
+		return nil
+	}
+
+	tlsTransport, err := upstream.NewTransport(upstream.NewBaseTransport(*transportCfg, router), *upstreamTLSCfg)
+	if err != nil {
+		logger.Errorln("upstream tls policy init failed:", err.Error())
 		return nil
 	}
 
@@ -37,14 +98,53 @@ func New(srvCfg *configs.HTTPSrvConfig, tlsCfg *configs.TlsConfig, psxCfg *confi
 		requestUseCase: requestUseCase,
 		srvCfg:         srvCfg,
 		tlsCfg:         tlsCfg,
-		requests:       requests,
+		captureCfg:     captureCfg,
+		socks5Cfg:      socks5Cfg,
+		transparentCfg: transparentCfg,
+		originalDst:    transparent.OriginalDst,
+		authority:      authority,
+		transport:      tlsTransport,
+		intercepts:     intercepts,
+		rewrites:       rewrites,
+		scope:          targetScope,
+		passthrough:    passthroughList,
+		router:         router,
+		requestIDs:     requestIDs,
+		tracker:        newTracker(),
 		logger:         logger,
 	}
 }
 
+// Client sends requests through the same transport, and so the same
+// upstream proxy rules, as proxied traffic.
+func (ps ProxyServer) Client() *http.Client {
+	return &http.Client{Transport: ps.transport}
+}
+
+// Intercepts is the queue of requests and responses held at breakpoints.
+func (ps ProxyServer) Intercepts() *intercept.Queue {
+	return ps.intercepts
+}
+
+// Rewrites is the match-and-replace engine applied to live traffic.
+func (ps ProxyServer) Rewrites() *rewrite.Engine {
+	return ps.rewrites
+}
+
+// InScope reports whether traffic to the target is recorded, out of scope
+// traffic is still forwarded.
+func (ps ProxyServer) InScope(scheme, host, path string) bool {
+	return ps.scope == nil || ps.scope.InScope(scheme, host, path)
+}
+
+// Passthrough is the list of hosts whose TLS is tunneled without interception.
+func (ps ProxyServer) Passthrough() *passthrough.List {
+	return ps.passthrough
+}
+
 func (ps ProxyServer) setMiddleware(handleFunc http.HandlerFunc) http.Handler {
 	h := mw2.AccessLog(ps.logger, http.HandlerFunc(handleFunc))
-	return mw2.RequestID(h)
+	return mw2.RequestID(ps.requestIDs, h)
 }
 
 func (ps ProxyServer) getRouter() http.Handler {
@@ -60,88 +160,71 @@ func (ps ProxyServer) getRouter() http.Handler {
 	return ps.setMiddleware(router)
 }
 
-func (ps ProxyServer) ListenAndServe() error {
-	server := http.Server{
-		Addr:    ps.srvCfg.ProxyHost + ":" + ps.srvCfg.ProxyPort,
-		Handler: ps.getRouter(),
-	}
+type (
+	connectionIdKey struct{}
+	listenerKey     struct{}
+)
 
-	ps.logger.Infof("start proxy-server listening at %s:%s", ps.srvCfg.ProxyHost, ps.srvCfg.ProxyPort)
-	return server.ListenAndServe()
+// WithListener names the listener a request handed to ProxyHTTP came from
+// when it is not the proxy's own, the api marks the requests it repeats.
+func WithListener(ctx context.Context, listener string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, listener)
 }
 
-func (ps ProxyServer) ProxyHTTP(w http.ResponseWriter, r *http.Request) {
-	reqID := mw2.GetRequestID(r.Context())
-	ps.logger.WithField("reqID", reqID).Infoln("entered in proxyHTTP")
-
-	r.Header.Del("Proxy-Connection")
+// connContext gives the plain http requests the id of the client connection
+// they came on.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connectionIdKey{}, mw2.NewRequestID())
+}
 
-	res, err := http.DefaultTransport.RoundTrip(r)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("round trip failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+func (ps ProxyServer) ListenAndServe() error {
+	server := &http.Server{
+		Addr:        ps.srvCfg.ProxyHost + ":" + ps.srvCfg.ProxyPort,
+		Handler:     ps.getRouter(),
+		ConnContext: connContext,
 	}
 
-	defer res.Body.Close()
-	res.Cookies()
-
-	for key, values := range res.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if !ps.tracker.addServer(server) {
+		return nil
 	}
 
-	bodyResponse, err := io.ReadAll(res.Body)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("round trip failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-	}
+	defer ps.tracker.removeServer(server)
 
-	bodyRequest, err := io.ReadAll(r.Body)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("round trip failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	ps.logger.Infof("start proxy-server listening at %s:%s", ps.srvCfg.ProxyHost, ps.srvCfg.ProxyPort)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
 	}
 
-	ps.logger.Println(reqID)
+	return nil
+}
 
-	request := &models.Request{
-		Method:  r.Method,
-		Scheme:  "http",
-		Host:    r.Host,
-		Path:    r.URL.Path,
-		Headers: r.Header,
-		Params:  r.URL.Query(),
-		Body:    string(bodyRequest),
-	}
+func (ps ProxyServer) ProxyHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID := mw2.GetRequestID(r.Context())
+	ps.logger.WithField("reqID", reqID).Infoln("entered in proxyHTTP")
 
-	err = ps.requestUseCase.SaveRequest(request)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("SaveRequest error: ", err.Error())
+	connectionId, _ := r.Context().Value(connectionIdKey{}).(string)
+	listener, ok := r.Context().Value(listenerKey{}).(string)
+	if !ok {
+		listener = models.ListenerHTTP
 	}
 
-	response := &models.Response{
-		RequestId: request.Id,
-		Code:      res.StatusCode,
-		Message:   res.Status,
-		Headers:   res.Header,
-		Body:      string(bodyResponse),
+	if websocket.IsUpgrade(r) {
+		ps.proxyWebSocket(w, r, exchange{reqID: reqID, connectionId: connectionId, listener: listener, scheme: "http", host: r.Host})
+		return
 	}
 
-	err = ps.requestUseCase.SaveResponse(response)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("SaveResponse error: ", err.Error())
+	// requests replayed through the api carry their own absolute url
+	scheme, host := r.URL.Scheme, r.URL.Host
+	if scheme == "" {
+		scheme = "http"
 	}
-
-	w.WriteHeader(res.StatusCode)
-	_, err = w.Write(bodyResponse)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("io copy failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if host == "" {
+		host = r.Host
 	}
 
+	r.Header.Del("Proxy-Connection")
+	ps.forward(w, r, exchange{reqID: reqID, connectionId: connectionId, listener: listener, scheme: scheme, host: host})
+
 	ps.logger.WithField("reqID", reqID).Infoln("exited from proxyHTTP")
 }
 
@@ -160,130 +243,67 @@ func (ps ProxyServer) ProxyHTTPS(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		ps.logger.WithField("reqID", reqID).Errorln("hijack failed:", err.Error())
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-	}
-
-	if _, err := localConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("write to local connection failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		localConn.Close()
 		return
 	}
 
-	defer localConn.Close()
-
-	tlsConfig, err := ps.hostTLSConfig(strings.Split(r.Host, ":")[0])
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("hostTLSConfig failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// the hijacked tunnel is no longer seen by the listener's own shutdown
+	if !ps.tracker.addConn(localConn) {
+		localConn.Close()
 		return
 	}
 
-	tlsLocalConn := tls.Server(localConn, tlsConfig)
-	defer tlsLocalConn.Close()
-	if err := tlsLocalConn.Handshake(); err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("tls handshake failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	defer ps.tracker.removeConn(localConn)
 
-	remoteConn, err := tls.Dial("tcp", r.Host, tlsConfig)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("tls dial failed:", err.Error())
+	if _, err := localConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		ps.logger.WithField("reqID", reqID).Errorln("write to local connection failed:", err.Error())
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		localConn.Close()
 		return
 	}
 
-	defer remoteConn.Close()
-
-	reader := bufio.NewReader(tlsLocalConn)
-	request, err := http.ReadRequest(reader)
-	if err != nil {
-		ps.logger.WithField("reqID", reqID).Errorln("read request failed:", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	requestByte, err := httputil.DumpRequest(request, true)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	defer localConn.Close()
 
-	_, err = remoteConn.Write(requestByte)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	ps.serveIntercepted(localConn, r.Host, reqID, models.ListenerHTTP)
 
-	serverReader := bufio.NewReader(remoteConn)
-	response, err := http.ReadResponse(serverReader, request)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	ps.logger.WithField("reqID", reqID).Infoln("exited from proxyHTTPS")
+}
 
-	rawResponse, err := httputil.DumpResponse(response, true)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (ps ProxyServer) saveExchange(reqID string, request *models.Request, response *models.Response) {
+	if !ps.InScope(request.Scheme, request.Host, request.Path) {
 		return
 	}
 
-	requestInfo := &models.Request{
-		Method:  r.Method,
-		Scheme:  "https",
-		Host:    r.Host,
-		Path:    r.URL.Path,
-		Headers: r.Header,
-		Params:  r.URL.Query(),
-		Body:    string(requestByte),
-	}
-
-	err = ps.requestUseCase.SaveRequest(requestInfo)
+	err := ps.requestUseCase.SaveRequest(request)
 	if err != nil {
 		ps.logger.WithField("reqID", reqID).Errorln("SaveRequest error: ", err.Error())
+		return
 	}
 
-	responseInfo := &models.Response{
-		RequestId: requestInfo.Id,
-		Code:      response.StatusCode,
-		Message:   response.Status,
-		Headers:   response.Header,
-		Body:      string(rawResponse),
-	}
-
-	err = ps.requestUseCase.SaveResponse(responseInfo)
+	response.RequestId = request.Id
+	err = ps.requestUseCase.SaveResponse(response)
 	if err != nil {
 		ps.logger.WithField("reqID", reqID).Errorln("SaveResponse error: ", err.Error())
 	}
-
-	_, err = tlsLocalConn.Write(rawResponse)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 }
 
-func (ps ProxyServer) hostTLSConfig(host string) (*tls.Config, error) {
-	if err := exec.Command(ps.tlsCfg.Script, host).Run(); err != nil {
-		ps.logger.WithFields(logrus.Fields{
-			"script": ps.tlsCfg.Script,
-			"host":   host,
-		}).Errorln("exec command failed:", err.Error())
-
-		return nil, err
-	}
-
-	tlsCert, err := tls.LoadX509KeyPair(ps.tlsCfg.CertFile, ps.tlsCfg.KeyFile)
-	if err != nil {
-		ps.logger.WithFields(logrus.Fields{
-			"cert file": ps.tlsCfg.CertFile,
-			"key file":  ps.tlsCfg.KeyFile,
-		}).Errorln("LoadX509KeyPair failed:", err.Error())
-
-		return nil, err
-	}
-
+// hostTLSConfig mints the leaf for the name the client asked for in SNI and
+// falls back to the target host for clients that send none.
+func (ps ProxyServer) hostTLSConfig(host string) *tls.Config {
 	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-	}, nil
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+
+			tlsCert, err := ps.authority.Certificate(name)
+			if err != nil {
+				ps.logger.WithField("host", name).Errorln("certificate minting failed:", err.Error())
+				return nil, err
+			}
+
+			return tlsCert, nil
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
 }
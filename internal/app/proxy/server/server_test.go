@@ -0,0 +1,925 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/certs"
+	mw2 "github.com/JuFnd/go-proxy/internal/app/proxy/pkg/mw"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/upstream"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/websocket"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+type fakeUseCase struct {
+	mu        sync.Mutex
+	requests  []*models.Request
+	responses []*models.Response
+	messages  []*models.WebSocketMessage
+	events    []*models.TLSEvent
+	saved     chan struct{}
+	relayed   chan struct{}
+}
+
+func newFakeUseCase() *fakeUseCase {
+	return &fakeUseCase{saved: make(chan struct{}, 16), relayed: make(chan struct{}, 16)}
+}
+
+// waitSaved blocks until n exchanges have been stored, the proxy saves them
+// only after the response has been streamed back to the client.
+func (f *fakeUseCase) waitSaved(t *testing.T, n int) ([]*models.Request, []*models.Response) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.saved:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for exchange %d to be saved", i+1)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests, f.responses
+}
+
+// waitMessages blocks until n websocket messages have been stored.
+func (f *fakeUseCase) waitMessages(t *testing.T, n int) []*models.WebSocketMessage {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.relayed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for websocket message %d to be saved", i+1)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.messages
+}
+
+func (f *fakeUseCase) GetRequestById(id int64) (*models.Request, error) {
+	return nil, nil
+}
+
+func (f *fakeUseCase) GetRequestDataById(id int64, raw bool) (*models.RequestData, error) {
+	return nil, nil
+}
+
+func (f *fakeUseCase) GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error) {
+	return nil, nil
+}
+
+func (f *fakeUseCase) Search(query models.SearchQuery) ([]*models.SearchResult, error) {
+	return nil, nil
+}
+
+func (f *fakeUseCase) SaveRequest(request *models.Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, request)
+	request.Id = int64(len(f.requests))
+	return nil
+}
+
+func (f *fakeUseCase) SaveResponse(response *models.Response) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.responses = append(f.responses, response)
+	f.saved <- struct{}{}
+	return nil
+}
+
+func (f *fakeUseCase) SaveWebSocketMessage(message *models.WebSocketMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.messages = append(f.messages, message)
+	f.relayed <- struct{}{}
+	return nil
+}
+
+func (f *fakeUseCase) GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error) {
+	return nil, nil
+}
+
+func (f *fakeUseCase) SaveTLSEvent(event *models.TLSEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeUseCase) GetTLSEvents() ([]*models.TLSEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.events, nil
+}
+
+func (f *fakeUseCase) Close() error {
+	return nil
+}
+
+func newTestServer(t *testing.T, useCase *fakeUseCase, captureCfg configs.CaptureConfig, requestIDCfg configs.RequestIDConfig) ProxyServer {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	requestIDs, err := mw2.NewRequestIDs(requestIDCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ProxyServer{
+		requestUseCase: useCase,
+		captureCfg:     &captureCfg,
+		transport:      &http.Transport{},
+		requestIDs:     requestIDs,
+		tracker:        newTracker(),
+		logger:         logger,
+	}
+}
+
+func newTestProxy(t *testing.T, useCase *fakeUseCase, captureCfg configs.CaptureConfig, requestIDCfg configs.RequestIDConfig) *http.Client {
+	t.Helper()
+
+	ps := newTestServer(t, useCase, captureCfg, requestIDCfg)
+	proxy := httptest.NewUnstartedServer(ps.getRouter())
+	proxy.Config.ConnContext = connContext
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+// onlyReader hides the concrete type of a reader so the client cannot
+// learn the body length and has to send it chunked.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestProxyHTTPStoresForwardedRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		body    io.Reader
+		chunked bool
+	}{
+		{name: "post", method: http.MethodPost, body: strings.NewReader("name=proxy&kind=post")},
+		{name: "put", method: http.MethodPut, body: strings.NewReader(`{"kind":"put"}`)},
+		{name: "chunked post", method: http.MethodPost, body: onlyReader{strings.NewReader(strings.Repeat("chunk ", 10000))}, chunked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamBody []byte
+			var upstreamChunked bool
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamBody, _ = io.ReadAll(r.Body)
+				upstreamChunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+
+			useCase := newFakeUseCase()
+			client := newTestProxy(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+
+			request, err := http.NewRequest(tt.method, upstream.URL+"/upload", tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+
+			if upstreamChunked != tt.chunked {
+				t.Errorf("upstream chunked = %v, want %v", upstreamChunked, tt.chunked)
+			}
+
+			requests, responses := useCase.waitSaved(t, 1)
+			if len(requests) != 1 {
+				t.Fatalf("stored %d requests, want 1", len(requests))
+			}
+
+			stored := requests[0]
+			if stored.Method != tt.method {
+				t.Errorf("stored method = %q, want %q", stored.Method, tt.method)
+			}
+
+			if stored.Listener != models.ListenerHTTP || stored.ClientAddr == "" || stored.ConnectionId == "" || stored.CreatedAt.IsZero() {
+				t.Errorf("stored listener %q, client %q, connection %q, created at %v, want them all set", stored.Listener, stored.ClientAddr, stored.ConnectionId, stored.CreatedAt)
+			}
+
+			if reqID := response.Header.Get("X-Proxy-Request-Id"); reqID == "" || stored.ReqId != reqID {
+				t.Errorf("stored request id %q, returned %q, want the same id", stored.ReqId, reqID)
+			}
+
+			if len(upstreamBody) == 0 {
+				t.Fatal("upstream received an empty body")
+			}
+
+			if !bytes.Equal(stored.Body, upstreamBody) {
+				t.Errorf("stored body (%d bytes) differs from the body sent upstream (%d bytes)", len(stored.Body), len(upstreamBody))
+			}
+
+			if stored.BodyTruncated || stored.BodyLength != int64(len(upstreamBody)) {
+				t.Errorf("stored body truncated = %v with length %d, want the whole %d bytes", stored.BodyTruncated, stored.BodyLength, len(upstreamBody))
+			}
+
+			if len(responses) != 1 || string(responses[0].Body) != "ok" {
+				t.Errorf("stored responses = %+v, want one with body %q", responses, "ok")
+			}
+		})
+	}
+}
+
+func TestProxyHTTPCapsStoredRequestBody(t *testing.T) {
+	const limit = 1024
+	body := strings.Repeat("0123456789", 1000)
+
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	useCase := newFakeUseCase()
+	client := newTestProxy(t, useCase, configs.CaptureConfig{MaxBodySize: limit}, configs.RequestIDConfig{})
+
+	response, err := client.Post(upstream.URL+"/upload", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if string(upstreamBody) != body {
+		t.Fatalf("upstream received %d bytes, want the whole %d", len(upstreamBody), len(body))
+	}
+
+	requests, _ := useCase.waitSaved(t, 1)
+	stored := requests[0]
+	if string(stored.Body) != body[:limit] {
+		t.Errorf("stored %d bytes, want the first %d", len(stored.Body), limit)
+	}
+
+	if !stored.BodyTruncated || stored.BodyLength != int64(len(body)) {
+		t.Errorf("stored body truncated = %v with length %d, want truncated with length %d", stored.BodyTruncated, stored.BodyLength, len(body))
+	}
+}
+
+func TestProxyHTTPRequestIDs(t *testing.T) {
+	const proxyHeader = "X-Proxy-Request-Id"
+
+	tests := []struct {
+		name     string
+		cfg      configs.RequestIDConfig
+		inbound  string
+		keep     bool
+		upstream string
+		// answer is the id the upstream responds with in the configured
+		// header, "echo" sends back the one it received
+		answer string
+	}{
+		{name: "new id", cfg: configs.RequestIDConfig{}},
+		{name: "untrusted client", cfg: configs.RequestIDConfig{TrustedClients: []string{"192.0.2.0/24"}}, inbound: "client-1"},
+		{name: "trusted client", cfg: configs.RequestIDConfig{TrustedClients: []string{"127.0.0.0/8"}}, inbound: "client-1", keep: true},
+		{name: "trusted address", cfg: configs.RequestIDConfig{TrustedClients: []string{"::1", "127.0.0.1"}}, inbound: "client-1", keep: true},
+		{name: "invalid inbound id", cfg: configs.RequestIDConfig{TrustedClients: []string{"127.0.0.0/8"}}, inbound: "client 1; rm"},
+		{name: "untrusted client with upstream header", cfg: configs.RequestIDConfig{UpstreamHeader: "X-Correlation-Id"}, inbound: "client-1", upstream: "X-Correlation-Id"},
+		{name: "untrusted client in the upstream header", cfg: configs.RequestIDConfig{Header: "X-Request-Id", UpstreamHeader: "X-Request-Id"}, inbound: "client-1", upstream: "X-Request-Id"},
+		{name: "upstream header", cfg: configs.RequestIDConfig{Header: "X-Trace", UpstreamHeader: "x-correlation-id"}, upstream: "X-Correlation-Id"},
+		{name: "upstream answers with its own id", cfg: configs.RequestIDConfig{Header: "X-Request-Id"}, answer: "upstream-id"},
+		{name: "upstream answers in the proxy header", cfg: configs.RequestIDConfig{}, answer: "upstream-id"},
+		{name: "upstream echoes the id", cfg: configs.RequestIDConfig{Header: "X-Request-Id", UpstreamHeader: "X-Request-Id"}, upstream: "X-Request-Id", answer: "echo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.cfg.Header
+			if header == "" {
+				header = proxyHeader
+			}
+
+			var upstreamHeaders http.Header
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamHeaders = r.Header.Clone()
+				switch tt.answer {
+				case "":
+				case "echo":
+					w.Header().Set(header, r.Header.Get(header))
+				default:
+					w.Header().Set(header, tt.answer)
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+
+			useCase := newFakeUseCase()
+			client := newTestProxy(t, useCase, configs.CaptureConfig{}, tt.cfg)
+
+			request, err := http.NewRequest(http.MethodGet, upstream.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.inbound != "" {
+				request.Header.Set(header, tt.inbound)
+			}
+
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+
+			requests, responses := useCase.waitSaved(t, 1)
+			stored := requests[0]
+
+			// the upstream's own id is never replaced, the proxy's moves aside
+			wantReturned, wantProxy := []string{stored.ReqId}, []string(nil)
+			switch tt.answer {
+			case "", "echo":
+			default:
+				wantReturned = []string{tt.answer}
+				if header != proxyHeader {
+					wantProxy = []string{stored.ReqId}
+				}
+			}
+
+			if returned := response.Header.Values(header); strings.Join(returned, ",") != strings.Join(wantReturned, ",") {
+				t.Errorf("returned ids %q, want %q", returned, wantReturned)
+			}
+			if header != proxyHeader {
+				if returned := response.Header.Values(proxyHeader); strings.Join(returned, ",") != strings.Join(wantProxy, ",") {
+					t.Errorf("returned proxy ids %q, want %q", returned, wantProxy)
+				}
+			}
+
+			if recorded := http.Header(responses[0].Headers).Get(header); tt.answer == "" && recorded != "" {
+				t.Errorf("recorded upstream response carries the id %q, want it as the upstream sent it", recorded)
+			}
+
+			if keep := stored.ReqId == tt.inbound; keep != tt.keep {
+				t.Errorf("request id %q, inbound %q kept = %v, want %v", stored.ReqId, tt.inbound, keep, tt.keep)
+			}
+
+			if tt.upstream != "" && upstreamHeaders.Get(tt.upstream) != stored.ReqId {
+				t.Errorf("upstream got id %q, want %q", upstreamHeaders.Get(tt.upstream), stored.ReqId)
+			}
+
+			// an id the proxy replaced reaches neither the upstream nor the history
+			if tt.inbound != "" && !tt.keep {
+				if sent := upstreamHeaders.Values(header); slices.Contains(sent, tt.inbound) {
+					t.Errorf("upstream got the replaced inbound id in %q", sent)
+				}
+				if recorded := http.Header(stored.Headers).Values(header); slices.Contains(recorded, tt.inbound) {
+					t.Errorf("recorded request carries the replaced inbound id in %q", recorded)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyWebSocketHandshakeKeepsUpstreamHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	defer upstream.Close()
+
+	useCase := newFakeUseCase()
+	client := newTestProxy(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request, err := http.NewRequest(http.MethodGet, upstream.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if err = request.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s, want 101", response.Status)
+	}
+
+	requests, responses := useCase.waitSaved(t, 1)
+	if reqID := response.Header.Get("X-Proxy-Request-Id"); reqID == "" || reqID != requests[0].ReqId {
+		t.Errorf("returned id %q, want the stored %q", reqID, requests[0].ReqId)
+	}
+	if recorded := http.Header(responses[0].Headers).Get("X-Proxy-Request-Id"); recorded != "" {
+		t.Errorf("recorded handshake carries the proxy id %q, want the headers the upstream sent", recorded)
+	}
+}
+
+func TestProxyWebSocketRecordsMessages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+
+		// unmask the client's text frame and answer with it as binary, then close
+		frame := make([]byte, 11)
+		if _, err = io.ReadFull(buf, frame); err != nil {
+			return
+		}
+		payload := frame[6:]
+		for i := range payload {
+			payload[i] ^= frame[2+i%4]
+		}
+		conn.Write(append([]byte{0x82, byte(len(payload))}, payload...))
+		conn.Write([]byte{0x88, 0x02, 0x03, 0xe8})
+	}))
+	defer upstream.Close()
+
+	useCase := newFakeUseCase()
+	client := newTestProxy(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request, err := http.NewRequest(http.MethodGet, upstream.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if err = request.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s, want 101", response.Status)
+	}
+
+	maskKey := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame := append([]byte{0x81, 0x80 | 5}, maskKey...)
+	for i, b := range []byte("hello") {
+		frame = append(frame, b^maskKey[i%4])
+	}
+	if _, err = conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, 11)
+	if _, err = io.ReadFull(reader, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x82, 0x05, 'h', 'e', 'l', 'l', 'o', 0x88, 0x02, 0x03, 0xe8}; !bytes.Equal(echoed, want) {
+		t.Errorf("client got frames % x, want % x", echoed, want)
+	}
+
+	requests, _ := useCase.waitSaved(t, 1)
+	stored := requests[0]
+	if stored.ConnectionId == "" {
+		t.Error("the handshake was stored without the id of its connection")
+	}
+
+	want := map[string][]struct {
+		opcode  int
+		payload string
+	}{
+		models.DirectionClient: {{opcode: websocket.OpText, payload: "hello"}},
+		models.DirectionServer: {{opcode: websocket.OpBinary, payload: "hello"}, {opcode: websocket.OpClose, payload: "\x03\xe8"}},
+	}
+
+	// the two directions are relayed concurrently, only each one is ordered
+	got := make(map[string][]*models.WebSocketMessage)
+	for _, message := range useCase.waitMessages(t, 3) {
+		if message.RequestId != stored.Id {
+			t.Errorf("message saved for request %d, want the handshake's %d on connection %s", message.RequestId, stored.Id, stored.ConnectionId)
+		}
+		got[message.Direction] = append(got[message.Direction], message)
+	}
+
+	for direction, messages := range want {
+		if len(got[direction]) != len(messages) {
+			t.Fatalf("%s sent %d messages, want %d", direction, len(got[direction]), len(messages))
+		}
+		for i, message := range messages {
+			if saved := got[direction][i]; saved.Opcode != message.opcode || string(saved.Payload) != message.payload {
+				t.Errorf("%s message %d = opcode %d %q, want opcode %d %q", direction, i, saved.Opcode, saved.Payload, message.opcode, message.payload)
+			}
+		}
+	}
+}
+
+func TestTunnelRoutesByTarget(t *testing.T) {
+	var upstreamHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "http://")
+
+	useCase := newFakeUseCase()
+	ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go ps.serveIntercepted(conn, target, "conn-1", models.ListenerSOCKS5)
+
+	// a plaintext client behind SOCKS5 names any host it likes
+	go io.WriteString(client, "GET /x HTTP/1.1\r\nHost: elsewhere.invalid\r\nConnection: close\r\n\r\n")
+
+	response, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("tunnel answered %s %q, want the target's 200 ok", response.Status, body)
+	}
+	if upstreamHost != "elsewhere.invalid" {
+		t.Errorf("target got Host %q, want the client's header passed on", upstreamHost)
+	}
+
+	requests, _ := useCase.waitSaved(t, 1)
+	if stored := requests[0]; stored.Host != target || http.Header(stored.Headers).Get("Host") != "elsewhere.invalid" {
+		t.Errorf("stored host %q with Host header %q, want %q with the client's header", stored.Host, http.Header(stored.Headers).Get("Host"), target)
+	}
+}
+
+// newTestAuthority writes a throwaway CA and returns the authority minting
+// with it and a pool trusting it.
+func newTestAuthority(t *testing.T) (*certs.Authority, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	authority, err := certs.NewAuthority(certFile, keyFile, 16, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	return authority, roots
+}
+
+func TestProxyHTTPSNegotiatesHTTP2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over " + r.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	useCase := newFakeUseCase()
+	ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+	authority, roots := newTestAuthority(t)
+	ps.authority = authority
+	ps.transport = upstream.Client().Transport
+
+	proxy := httptest.NewUnstartedServer(ps.getRouter())
+	proxy.Config.ConnContext = connContext
+	proxy.Start()
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var negotiated string
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots, VerifyConnection: func(state tls.ConnectionState) error {
+			negotiated = state.NegotiatedProtocol
+			return nil
+		}},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	// a second request reuses the client connection the first one set up
+	for i := 0; i < 2; i++ {
+		response, err := client.Get(upstream.URL + "/h2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.ProtoMajor != 2 || negotiated != "h2" {
+			t.Fatalf("client spoke %s after negotiating %q, want h2 through the tunnel", response.Proto, negotiated)
+		}
+		if response.StatusCode != http.StatusOK || string(body) != "over HTTP/2.0" {
+			t.Fatalf("tunnel answered %s %q, want the upstream's 200 over h2", response.Status, body)
+		}
+	}
+
+	requests, responses := useCase.waitSaved(t, 2)
+	for i, request := range requests {
+		if request.Proto != "HTTP/2.0" || request.Scheme != "https" || responses[i].Proto != "HTTP/2.0" {
+			t.Errorf("stored %s %s exchange answered over %s, want https over HTTP/2.0 both ways", request.Scheme, request.Proto, responses[i].Proto)
+		}
+	}
+}
+
+func TestProxyStoresUpstreamTLSDetails(t *testing.T) {
+	upstreamServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstreamServer.Close()
+
+	useCase := newFakeUseCase()
+	ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+	transport, err := upstream.NewTransport(&http.Transport{}, configs.UpstreamTLSConfig{
+		MinVersion: "1.2",
+		Hosts:      []configs.UpstreamTLSHostConfig{{Host: "127.0.0.1", InsecureSkipVerify: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	ps.transport = transport
+
+	proxy := httptest.NewServer(ps.getRouter())
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// an absolute https url, the way the repeater sends one
+	io.WriteString(conn, "GET "+upstreamServer.URL+"/tls HTTP/1.1\r\nHost: "+strings.TrimPrefix(upstreamServer.URL, "https://")+"\r\nConnection: close\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("proxy answered %s, want the upstream's 200", response.Status)
+	}
+
+	_, responses := useCase.waitSaved(t, 1)
+	stored := responses[0]
+	if stored.TLSVersion != "TLS 1.3" || stored.TLSCipher == "" || strings.HasPrefix(stored.TLSCipher, "0x") {
+		t.Errorf("stored version %q and cipher %q, want TLS 1.3 with a named suite", stored.TLSVersion, stored.TLSCipher)
+	}
+
+	block, rest := pem.Decode([]byte(stored.TLSCertificates))
+	if block == nil || block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, upstreamServer.Certificate().Raw) || len(bytes.TrimSpace(rest)) != 0 {
+		t.Errorf("stored certificates %q, want the upstream's leaf as PEM", stored.TLSCertificates)
+	}
+}
+
+func TestProxyReusesUpstreamConnections(t *testing.T) {
+	for _, keepAlive := range []bool{true, false} {
+		t.Run("client keep-alive "+strconv.FormatBool(keepAlive), func(t *testing.T) {
+			var mu sync.Mutex
+			var remotes []string
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				remotes = append(remotes, r.RemoteAddr)
+				mu.Unlock()
+				w.Write([]byte("ok"))
+			}))
+			defer upstreamServer.Close()
+
+			router, err := upstream.NewRouter(configs.UpstreamConfig{Default: upstream.Direct})
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := upstream.NewBaseTransport(configs.TransportConfig{MaxIdleConnsPerHost: 2}, router)
+			defer transport.CloseIdleConnections()
+
+			useCase := newFakeUseCase()
+			ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+			ps.transport = transport
+
+			proxy := httptest.NewUnstartedServer(ps.getRouter())
+			proxy.Config.ConnContext = connContext
+			proxy.Start()
+			defer proxy.Close()
+			proxyURL, _ := url.Parse(proxy.URL)
+
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: !keepAlive}}
+			for i := 0; i < 2; i++ {
+				response, err := client.Get(upstreamServer.URL + "/pooled")
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+
+				// the exchange is saved once the response went back, by then
+				// the upstream connection is idle in the pool again
+				useCase.waitSaved(t, 1)
+			}
+
+			useCase.mu.Lock()
+			responses := useCase.responses
+			useCase.mu.Unlock()
+			if responses[0].Timings.Reused || !responses[1].Timings.Reused {
+				t.Errorf("reused = %v then %v, want a fresh connection then a pooled one", responses[0].Timings.Reused, responses[1].Timings.Reused)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(remotes) != 2 || remotes[0] != remotes[1] {
+				t.Errorf("upstream saw the requests from %v, want one connection", remotes)
+			}
+		})
+	}
+}
+
+func TestProxyHTTPSTunnelKeepsConnectionID(t *testing.T) {
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0"} {
+		t.Run(proto, func(t *testing.T) {
+			upstreamServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.URL.Path))
+			}))
+			upstreamServer.EnableHTTP2 = true
+			upstreamServer.StartTLS()
+			defer upstreamServer.Close()
+
+			useCase := newFakeUseCase()
+			ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+			authority, roots := newTestAuthority(t)
+			ps.authority = authority
+			ps.transport = upstreamServer.Client().Transport
+
+			proxy := httptest.NewUnstartedServer(ps.getRouter())
+			proxy.Config.ConnContext = connContext
+			proxy.Start()
+			defer proxy.Close()
+			proxyURL, _ := url.Parse(proxy.URL)
+
+			// one tunnel per client, every request of a client goes through it
+			newClient := func() *http.Client {
+				transport := &http.Transport{
+					Proxy:           http.ProxyURL(proxyURL),
+					TLSClientConfig: &tls.Config{RootCAs: roots},
+					MaxConnsPerHost: 1,
+				}
+				if proto == "HTTP/2.0" {
+					transport.ForceAttemptHTTP2 = true
+				} else {
+					transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+				}
+				return &http.Client{Transport: transport}
+			}
+
+			send := func(client *http.Client, path string) {
+				response, err := client.Get(upstreamServer.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(response.Body)
+				response.Body.Close()
+				if response.Proto != proto || string(body) != path {
+					t.Fatalf("%s answered %q over %s, want it over %s", path, body, response.Proto, proto)
+				}
+			}
+
+			first := newClient()
+			for _, path := range []string{"/one", "/two", "/three"} {
+				send(first, path)
+			}
+			first.CloseIdleConnections()
+
+			second := newClient()
+			send(second, "/other")
+			second.CloseIdleConnections()
+
+			requests, _ := useCase.waitSaved(t, 4)
+			tunnelID := requests[0].ConnectionId
+			if tunnelID == "" {
+				t.Fatal("the tunnel's requests were stored without a connection id")
+			}
+			for _, request := range requests[:3] {
+				if request.ConnectionId != tunnelID || request.Proto != proto {
+					t.Errorf("%s stored on connection %q over %s, want %q over %s", request.Path, request.ConnectionId, request.Proto, tunnelID, proto)
+				}
+				if request.ReqId == tunnelID {
+					t.Errorf("%s shares its request id with the tunnel", request.Path)
+				}
+			}
+			if requests[3].ConnectionId == "" || requests[3].ConnectionId == tunnelID {
+				t.Errorf("the second tunnel stored connection %q, want its own id", requests[3].ConnectionId)
+			}
+		})
+	}
+}
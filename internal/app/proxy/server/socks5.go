@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	mw2 "github.com/JuFnd/go-proxy/internal/app/proxy/pkg/mw"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/socks5"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+const socks5HandshakeTimeout = 10 * time.Second
+
+func (ps ProxyServer) ListenAndServeSOCKS5() error {
+	addr := ps.socks5Cfg.Host + ":" + ps.socks5Cfg.Port
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if !ps.tracker.addListener(listener) {
+		listener.Close()
+		return nil
+	}
+
+	defer ps.tracker.removeListener(listener)
+	defer listener.Close()
+
+	ps.logger.Infof("start socks5-server listening at %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ps.tracker.isClosing() {
+				return nil
+			}
+			return err
+		}
+
+		if !ps.tracker.addConn(conn) {
+			conn.Close()
+			return nil
+		}
+
+		go ps.serveSOCKS5(conn)
+	}
+}
+
+func (ps ProxyServer) serveSOCKS5(conn net.Conn) {
+	defer ps.tracker.removeConn(conn)
+	defer conn.Close()
+
+	connID := mw2.NewRequestID()
+	ps.logger.WithField("reqID", connID).Infoln("entered in serveSOCKS5")
+
+	var creds *socks5.Credentials
+	if ps.socks5Cfg.Username != "" {
+		creds = &socks5.Credentials{Username: ps.socks5Cfg.Username, Password: ps.socks5Cfg.Password}
+	}
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	target, err := socks5.Accept(conn, creds)
+	if err != nil {
+		ps.logger.WithField("reqID", connID).Errorln("socks5 handshake failed:", err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	ps.logger.WithField("reqID", connID).Infoln("socks5 connect to", target)
+	ps.serveIntercepted(conn, target, connID, models.ListenerSOCKS5)
+
+	ps.logger.WithField("reqID", connID).Infoln("exited from serveSOCKS5")
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// exchangeTimer collects httptrace events of one round trip. Dialing may
+// race several addresses, so the callbacks are serialized.
+type exchangeTimer struct {
+	mu      sync.Mutex
+	timings models.Timings
+}
+
+func newExchangeTimer() *exchangeTimer {
+	return &exchangeTimer{timings: models.Timings{Start: time.Now()}}
+}
+
+func millisecondsSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+func (t *exchangeTimer) trace(r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.Reused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			now := time.Now()
+			t.timings.DNSStart = &now
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.timings.DNSStart != nil {
+				t.timings.DNS = millisecondsSince(*t.timings.DNSStart)
+			}
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.timings.ConnectStart == nil {
+				now := time.Now()
+				t.timings.ConnectStart = &now
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.timings.ConnectStart != nil {
+				t.timings.Connect = millisecondsSince(*t.timings.ConnectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			now := time.Now()
+			t.timings.TLSStart = &now
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.timings.TLSStart != nil {
+				t.timings.TLS = millisecondsSince(*t.timings.TLSStart)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.FirstByte = millisecondsSince(t.timings.Start)
+		},
+	}
+
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// finish closes the measurement, total runs until the response has been
+// handed to the client in full.
+func (t *exchangeTimer) finish() models.Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.timings.Total = millisecondsSince(t.timings.Start)
+	return t.timings
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+
+	mw2 "github.com/JuFnd/go-proxy/internal/app/proxy/pkg/mw"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// ListenAndServeTransparent accepts connections redirected to the proxy by
+// iptables rules, so clients that ignore proxy settings are recorded too.
+func (ps ProxyServer) ListenAndServeTransparent() error {
+	addr := ps.transparentCfg.Host + ":" + ps.transparentCfg.Port
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if !ps.tracker.addListener(listener) {
+		listener.Close()
+		return nil
+	}
+
+	defer ps.tracker.removeListener(listener)
+	defer listener.Close()
+
+	ps.logger.Infof("start transparent-server listening at %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ps.tracker.isClosing() {
+				return nil
+			}
+			return err
+		}
+
+		if !ps.tracker.addConn(conn) {
+			conn.Close()
+			return nil
+		}
+
+		go ps.serveTransparent(conn)
+	}
+}
+
+func (ps ProxyServer) serveTransparent(conn net.Conn) {
+	defer ps.tracker.removeConn(conn)
+	defer conn.Close()
+
+	connID := mw2.NewRequestID()
+	ps.logger.WithField("reqID", connID).Infoln("entered in serveTransparent")
+
+	// a client whose dns points the target at the proxy was not redirected,
+	// the SNI or the Host header of its requests name the target then
+	target, err := ps.originalDst(conn)
+	switch {
+	case err != nil:
+		ps.logger.WithField("reqID", connID).Infoln("original destination unknown, routing by SNI or Host header:", err.Error())
+		target = ""
+	case target == conn.LocalAddr().String():
+		// proxying to the original destination would loop back to the listener
+		ps.logger.WithField("reqID", connID).Infoln("connection was made to the listener itself, routing by SNI or Host header")
+		target = ""
+	default:
+		ps.logger.WithField("reqID", connID).Infoln("transparent connection to", target)
+	}
+
+	ps.serveIntercepted(conn, target, connID, models.ListenerTransparent)
+
+	ps.logger.WithField("reqID", connID).Infoln("exited from serveTransparent")
+}
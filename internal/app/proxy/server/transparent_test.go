@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/transparent"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+func TestServeTransparent(t *testing.T) {
+	answer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+	plain := httptest.NewServer(answer)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(answer)
+	defer secure.Close()
+	plainAddr := strings.TrimPrefix(plain.URL, "http://")
+	secureAddr := strings.TrimPrefix(secure.URL, "https://")
+
+	// app.test only resolves here, everything else is dialed as it is
+	var mu sync.Mutex
+	var dialed []string
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+
+			if addr == "app.test:443" {
+				addr = secureAddr
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer transport.CloseIdleConnections()
+
+	redirectedTo := func(target string) func(net.Conn) (string, error) {
+		return func(net.Conn) (string, error) { return target, nil }
+	}
+	notRedirected := func(net.Conn) (string, error) { return "", transparent.ErrUnsupported }
+
+	tests := []struct {
+		name        string
+		originalDst func(net.Conn) (string, error)
+		// serverName starts a TLS handshake with that SNI
+		serverName string
+		host       string
+		wantScheme string
+		wantHost   string
+		wantDial   string
+	}{
+		{name: "mitm over sni", originalDst: redirectedTo(secureAddr), serverName: "app.test", host: "app.test", wantScheme: "https", wantHost: secureAddr, wantDial: secureAddr},
+		{name: "plain to the original destination", originalDst: redirectedTo(plainAddr), host: "elsewhere.invalid", wantScheme: "http", wantHost: plainAddr, wantDial: plainAddr},
+		{name: "sni without original destination", originalDst: notRedirected, serverName: "app.test", host: "app.test", wantScheme: "https", wantHost: "app.test:443", wantDial: "app.test:443"},
+		{name: "host header without original destination", originalDst: notRedirected, host: plainAddr, wantScheme: "http", wantHost: plainAddr, wantDial: plainAddr},
+		{name: "made to the listener itself", originalDst: func(conn net.Conn) (string, error) { return conn.LocalAddr().String(), nil }, host: plainAddr, wantScheme: "http", wantHost: plainAddr, wantDial: plainAddr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCase := newFakeUseCase()
+			ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+			authority, roots := newTestAuthority(t)
+			ps.authority = authority
+			ps.transport = transport
+			ps.originalDst = tt.originalDst
+
+			// every case dials its own upstream connection
+			transport.CloseIdleConnections()
+			mu.Lock()
+			dialed = nil
+			mu.Unlock()
+
+			client, conn := net.Pipe()
+			served := make(chan struct{})
+			go func() {
+				ps.serveTransparent(conn)
+				close(served)
+			}()
+
+			var clientConn net.Conn = client
+			if tt.serverName != "" {
+				tlsConn := tls.Client(client, &tls.Config{ServerName: tt.serverName, RootCAs: roots})
+				if err := tlsConn.Handshake(); err != nil {
+					t.Fatalf("handshake with the minted certificate: %v", err)
+				}
+				clientConn = tlsConn
+			}
+
+			go io.WriteString(clientConn, "GET /path HTTP/1.1\r\nHost: "+tt.host+"\r\nConnection: close\r\n\r\n")
+			response, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			clientConn.Close()
+			<-served
+
+			if response.StatusCode != http.StatusOK || string(body) != "/path" {
+				t.Fatalf("answered %s %q, want the target's 200 /path", response.Status, body)
+			}
+
+			mu.Lock()
+			if len(dialed) != 1 || dialed[0] != tt.wantDial {
+				t.Errorf("dialed %v, want %s", dialed, tt.wantDial)
+			}
+			mu.Unlock()
+
+			requests, _ := useCase.waitSaved(t, 1)
+			stored := requests[0]
+			if stored.Listener != models.ListenerTransparent || stored.Scheme != tt.wantScheme || stored.Host != tt.wantHost || stored.SNI != tt.serverName {
+				t.Errorf("stored %s %s://%s with SNI %q, want %s %s://%s with SNI %q",
+					stored.Listener, stored.Scheme, stored.Host, stored.SNI, models.ListenerTransparent, tt.wantScheme, tt.wantHost, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestServeTransparentNeedsATarget(t *testing.T) {
+	useCase := newFakeUseCase()
+	ps := newTestServer(t, useCase, configs.CaptureConfig{}, configs.RequestIDConfig{})
+	ps.authority, _ = newTestAuthority(t)
+	ps.originalDst = func(net.Conn) (string, error) { return "", errors.New("not redirected") }
+
+	// neither an SNI nor a Host header name where the client was going
+	client, conn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		ps.serveTransparent(conn)
+		close(served)
+	}()
+
+	go io.WriteString(client, "GET /path HTTP/1.0\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	client.Close()
+	<-served
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("answered %s, want 400 for a request without a target", response.Status)
+	}
+
+	tlsErr := make(chan error, 1)
+	client, conn = net.Pipe()
+	go ps.serveTransparent(conn)
+	go func() {
+		tlsErr <- tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	}()
+	if err = <-tlsErr; err == nil {
+		t.Error("a tls client without SNI got a certificate for an unknown target")
+	}
+	client.Close()
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const tlsRecordTypeHandshake = 0x16
+
+type tunnel struct {
+	id       string
+	listener string
+	host     string
+	scheme   string
+	// pinHost is the host a client accepted the minted certificate for, its
+	// first request proves the client does not pin it
+	pinHost string
+	served  atomic.Bool
+}
+
+// peekedConn is a connection whose first bytes were already buffered while
+// sniffing the protocol.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connListener hands a single already accepted connection to an http.Server,
+// so the decrypted side of a tunnel gets keep-alive and h2 handling for free.
+type connListener struct {
+	conn      net.Conn
+	accepted  bool
+	done      chan struct{}
+	closeOnce sync.Once
+	connDone  chan struct{}
+	connOnce  sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{
+		conn:     conn,
+		done:     make(chan struct{}),
+		connDone: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *connListener) trackState(_ net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.connOnce.Do(func() { close(l.connDone) })
+		l.Close()
+	}
+}
+
+// serveIntercepted records everything a client sends over a raw connection to
+// target, terminating TLS with a minted certificate when the client starts a
+// handshake and parsing plain HTTP otherwise. TLS to passthrough hosts is
+// tunneled untouched. Without a target TLS goes to port 443 of the SNI and
+// plain HTTP to the Host header of each request.
+func (ps ProxyServer) serveIntercepted(conn net.Conn, target, connID, listener string) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			ps.logger.WithField("reqID", connID).Errorln("read from local connection failed:", err.Error())
+		}
+		return
+	}
+
+	if first[0] != tlsRecordTypeHandshake {
+		ps.serveTunnel(&tunnel{id: connID, listener: listener, host: target, scheme: "http"}, &peekedConn{Conn: conn, reader: reader})
+		return
+	}
+
+	serverName, replay := peekClientHello(conn, reader)
+	conn = &peekedConn{Conn: conn, reader: replay}
+
+	if target == "" {
+		if serverName == "" {
+			ps.logger.WithField("reqID", connID).Errorln("tls client sent no SNI, the target is unknown")
+			return
+		}
+		target = net.JoinHostPort(serverName, "443")
+	}
+
+	host := serverName
+	if host == "" {
+		host = hostname(target)
+	}
+
+	if ps.passthrough != nil && ps.passthrough.Contains(host) {
+		ps.servePassthrough(conn, target, connID)
+		return
+	}
+
+	tlsConn := tls.Server(conn, ps.hostTLSConfig(target))
+	defer tlsConn.Close()
+
+	if err = tlsConn.Handshake(); err != nil {
+		ps.logger.WithField("reqID", connID).Errorln("tls handshake failed:", err.Error())
+		if ps.passthrough != nil {
+			ps.handshakeFailed(host, connID, err)
+		}
+		return
+	}
+
+	tun := &tunnel{id: connID, listener: listener, host: target, scheme: "https"}
+	if ps.passthrough != nil {
+		tun.pinHost = host
+	}
+
+	handshakeDone := time.Now()
+	ps.serveTunnel(tun, tlsConn)
+
+	// pinning clients finish the handshake, check the pin and hang up
+	if tun.pinHost != "" && !tun.served.Load() && time.Since(handshakeDone) < pinnedCloseWindow {
+		ps.handshakeFailed(host, connID, errClosedAfterHandshake)
+	}
+}
+
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+
+	return hostport
+}
+
+func (ps ProxyServer) serveTunnel(tun *tunnel, conn net.Conn) {
+	var handlers sync.WaitGroup
+
+	listener := newConnListener(conn)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+
+			ps.proxyTunnelRequest(tun, w, r)
+		}),
+		ConnState: listener.trackState,
+		ErrorLog:  log.New(ps.logger.WriterLevel(logrus.DebugLevel), "", 0),
+	}
+
+	// a tunnel opened just before shutdown still gets its exchange, but no more
+	if ps.tracker.addServer(server) {
+		defer ps.tracker.removeServer(server)
+	} else {
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	server.Serve(listener)
+
+	// a shutdown returns from Serve while the connection finishes its exchange
+	if listener.accepted {
+		<-listener.connDone
+	}
+
+	// a hijacked connection (websocket) outlives Serve, keep the tunnel open until it is done
+	handlers.Wait()
+}
+
+func (ps ProxyServer) proxyTunnelRequest(tun *tunnel, w http.ResponseWriter, r *http.Request) {
+	// the requests of a tunnel skip the middleware, they get their ids here
+	reqID := ps.requestIDs.Assign(w, r)
+	ps.logger.WithFields(logrus.Fields{"reqID": reqID, "connID": tun.id}).Infoln("entered in proxyTunnelRequest")
+
+	if !tun.served.Swap(true) && tun.pinHost != "" {
+		ps.passthrough.HandshakeSucceeded(tun.pinHost)
+	}
+
+	host := tun.host
+	if host == "" {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "no Host header to route the request by", http.StatusBadRequest)
+		return
+	}
+
+	ex := exchange{reqID: reqID, connectionId: tun.id, listener: tun.listener, scheme: tun.scheme, host: host}
+	if websocket.IsUpgrade(r) {
+		ps.proxyWebSocket(w, r, ex)
+		return
+	}
+
+	ps.forward(w, r, ex)
+}
+
+func copyAndFlush(w http.ResponseWriter, body io.Reader) error {
+	controller := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			controller.Flush()
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		if name == "Te" && header.Get(name) == "trailers" {
+			continue
+		}
+		header.Del(name)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/websocket"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+func (ps ProxyServer) proxyWebSocket(w http.ResponseWriter, r *http.Request, ex exchange) {
+	reqID := ex.reqID
+	ps.logger.WithField("reqID", reqID).Infoln("entered in proxyWebSocket")
+
+	outRequest := r.Clone(r.Context())
+	outRequest.RequestURI = ""
+	outRequest.URL.Scheme = ex.scheme
+	outRequest.URL.Host = ex.host
+	outRequest.Header.Del("Proxy-Connection")
+	// without extensions frames stay uncompressed and their payloads readable
+	outRequest.Header.Del("Sec-Websocket-Extensions")
+	ps.sendRequestID(outRequest, ex)
+
+	timer := newExchangeTimer()
+	response, err := ps.transport.RoundTrip(timer.trace(outRequest))
+	if err != nil {
+		ps.logger.WithField("reqID", reqID).Errorln("websocket handshake failed:", err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer response.Body.Close()
+
+	request := newStoredRequest(r, ex)
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		responseBody := newCaptureBuffer(ps.captureCfg.MaxBodySize)
+		for key, values := range response.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+
+		ps.requestIDs.Respond(w.Header(), response.Header, reqID)
+		w.WriteHeader(response.StatusCode)
+		if _, err = io.Copy(w, io.TeeReader(response.Body, responseBody)); err != nil {
+			ps.logger.WithField("reqID", reqID).Errorln("io copy failed:", err.Error())
+		}
+
+		storedResponse := responseBody.response(response)
+		storedResponse.Timings = timer.finish()
+		ps.saveExchange(reqID, request, storedResponse)
+		return
+	}
+
+	upstream, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		ps.logger.WithField("reqID", reqID).Errorln("upstream connection is not writable after upgrade")
+		http.Error(w, "upstream connection is not writable after upgrade", http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		ps.logger.WithField("reqID", reqID).Errorln("hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		ps.logger.WithField("reqID", reqID).Errorln("hijack failed:", err.Error())
+		return
+	}
+
+	defer clientConn.Close()
+
+	if !ps.tracker.addConn(clientConn) {
+		return
+	}
+
+	defer ps.tracker.removeConn(clientConn)
+
+	// the hijacked connection skips the headers set on w, the id included,
+	// and the recorded handshake keeps the headers the upstream sent
+	handshake := *response
+	handshake.Header = response.Header.Clone()
+	handshake.Body = nil
+	ps.requestIDs.Respond(handshake.Header, response.Header, reqID)
+	if err = handshake.Write(clientConn); err != nil {
+		ps.logger.WithField("reqID", reqID).Errorln("write to local connection failed:", err.Error())
+		return
+	}
+
+	handshakeResponse := &models.Response{
+		Code:    response.StatusCode,
+		Message: response.Status,
+		Proto:   response.Proto,
+		Headers: response.Header,
+	}
+	setTLSDetails(handshakeResponse, response.TLS)
+	// the session itself is open ended, the handshake is what gets timed
+	handshakeResponse.Timings = timer.finish()
+	ps.saveExchange(reqID, request, handshakeResponse)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		websocket.Relay(upstream, clientBuf.Reader, ps.webSocketRecorder(request.Id, models.DirectionClient, reqID))
+		done <- struct{}{}
+	}()
+	go func() {
+		websocket.Relay(clientConn, bufio.NewReader(upstream), ps.webSocketRecorder(request.Id, models.DirectionServer, reqID))
+		done <- struct{}{}
+	}()
+
+	// either side hanging up ends the session, closing both unblocks the other relay
+	<-done
+	clientConn.Close()
+	upstream.Close()
+	<-done
+
+	ps.logger.WithField("reqID", reqID).Infoln("exited from proxyWebSocket")
+}
+
+func (ps ProxyServer) webSocketRecorder(requestId int64, direction, reqID string) func(websocket.Message) {
+	return func(message websocket.Message) {
+		if requestId == 0 {
+			return
+		}
+
+		err := ps.requestUseCase.SaveWebSocketMessage(&models.WebSocketMessage{
+			RequestId: requestId,
+			Direction: direction,
+			Opcode:    message.Opcode,
+			Time:      message.Time,
+			Payload:   message.Payload,
+		})
+		if err != nil {
+			ps.logger.WithField("reqID", reqID).Errorln("SaveWebSocketMessage error: ", err.Error())
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package delivery
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
-	"strings"
 
 	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/intercept"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/mw"
+	"github.com/JuFnd/go-proxy/internal/app/proxy/pkg/rewrite"
 	proxy "github.com/JuFnd/go-proxy/internal/app/proxy/server"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+	"github.com/JuFnd/go-proxy/internal/app/server/repository"
 	"github.com/JuFnd/go-proxy/internal/app/server/usecase"
 	scanner "github.com/JuFnd/go-proxy/pkg"
 
@@ -24,6 +31,7 @@ type API struct {
 	cfg            *configs.HTTPSrvConfig
 	lg             *logrus.Logger
 	mx             *mux.Router
+	server         *http.Server
 }
 
 func GetApi(requestUseCase usecase.IUseCase, proxyServer *proxy.ProxyServer, cfg *configs.HTTPSrvConfig, lg *logrus.Logger) *API {
@@ -37,8 +45,19 @@ func GetApi(requestUseCase usecase.IUseCase, proxyServer *proxy.ProxyServer, cfg
 
 	api.mx.HandleFunc("/requests", api.GetRequests)
 	api.mx.HandleFunc("/requests/{id:[0-9]+}", api.GetRequest)
+	api.mx.HandleFunc("/search", api.Search).Methods(http.MethodGet)
+	api.mx.HandleFunc("/requests/{id:[0-9]+}/messages", api.GetWebSocketMessages)
 	api.mx.HandleFunc("/scan/{id:[0-9]+}", api.ScanRequest)
 	api.mx.HandleFunc("/repeat/{id:[0-9]+}", api.RepeatRequest)
+	api.mx.HandleFunc("/rules", api.RewriteRules).Methods(http.MethodGet, http.MethodPut)
+	api.mx.HandleFunc("/tls/events", api.GetTLSEvents).Methods(http.MethodGet)
+	api.mx.HandleFunc("/tls/passthrough", api.GetPassthrough).Methods(http.MethodGet)
+	api.mx.HandleFunc("/tls/passthrough/{host}", api.RemovePassthrough).Methods(http.MethodDelete)
+	api.mx.HandleFunc("/intercept", api.GetIntercepted).Methods(http.MethodGet)
+	api.mx.HandleFunc("/intercept/settings", api.InterceptSettings).Methods(http.MethodGet, http.MethodPut)
+	api.mx.HandleFunc("/intercept/{id:[0-9]+}", api.ResolveIntercepted).Methods(http.MethodPost)
+
+	api.server = &http.Server{Addr: ":" + cfg.WebPort, Handler: api.mx}
 
 	return api
 }
@@ -46,8 +65,8 @@ func GetApi(requestUseCase usecase.IUseCase, proxyServer *proxy.ProxyServer, cfg
 func (a *API) ListenAndServe() error {
 	a.lg.Infof("start application-server listening at: " + a.cfg.WebPort)
 
-	err := http.ListenAndServe(":"+a.cfg.WebPort, a.mx)
-	if err != nil {
+	err := a.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		a.lg.Error("Listen and serve error: ", err.Error())
 		return err
 	}
@@ -55,6 +74,17 @@ func (a *API) ListenAndServe() error {
 	return nil
 }
 
+// Shutdown stops accepting api calls and waits for the running ones, those
+// still running when ctx expires are cut off.
+func (a *API) Shutdown(ctx context.Context) error {
+	if err := a.server.Shutdown(ctx); err != nil {
+		a.server.Close()
+		return err
+	}
+
+	return nil
+}
+
 func (a *API) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	a.proxyHttpOrHttps(w, r, true)
 }
@@ -77,9 +107,15 @@ func (a *API) proxyHttpOrHttps(w http.ResponseWriter, r *http.Request, save bool
 
 func (a *API) GetRequest(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
-	selectedRequest, err := a.requestUseCase.GetRequestDataById(id)
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	selectedRequest, err := a.requestUseCase.GetRequestDataById(id, raw)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	answer, err := json.Marshal(selectedRequest)
@@ -94,9 +130,24 @@ func (a *API) GetRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) GetRequests(w http.ResponseWriter, r *http.Request) {
-	selectedRequests, err := a.requestUseCase.GetAllRequestsData()
+	query, err := historyQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	selectedRequests, err := a.requestUseCase.GetAllRequestsData(query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if selectedRequests == nil {
+		selectedRequests = []*models.RequestData{}
+	}
+
+	if next := query.NextCursor(selectedRequests); next != nil {
+		w.Header().Set(nextCursorHeader, encodeCursor(query.SortBy, next))
 	}
 
 	answer, err := json.Marshal(selectedRequests)
@@ -110,34 +161,265 @@ func (a *API) GetRequests(w http.ResponseWriter, r *http.Request) {
 	w.Write(answer)
 }
 
+func (a *API) Search(w http.ResponseWriter, r *http.Request) {
+	query, err := searchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := a.requestUseCase.Search(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if results == nil {
+		results = []*models.SearchResult{}
+	}
+
+	answer, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) GetWebSocketMessages(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, err := a.requestUseCase.GetWebSocketMessages(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	answer, err := json.Marshal(messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) GetTLSEvents(w http.ResponseWriter, r *http.Request) {
+	events, err := a.requestUseCase.GetTLSEvents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	answer, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) GetPassthrough(w http.ResponseWriter, r *http.Request) {
+	answer, err := json.Marshal(a.proxyServer.Passthrough().Entries())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) RemovePassthrough(w http.ResponseWriter, r *http.Request) {
+	if !a.proxyServer.Passthrough().Remove(mux.Vars(r)["host"]) {
+		http.Error(w, "host was not added to passthrough automatically", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) RewriteRules(w http.ResponseWriter, r *http.Request) {
+	rewrites := a.proxyServer.Rewrites()
+
+	if r.Method == http.MethodPut {
+		var rules []rewrite.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := rewrites.SetRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	answer, err := json.Marshal(rewrites.Rules())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) GetIntercepted(w http.ResponseWriter, r *http.Request) {
+	answer, err := json.Marshal(a.proxyServer.Intercepts().List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) InterceptSettings(w http.ResponseWriter, r *http.Request) {
+	intercepts := a.proxyServer.Intercepts()
+
+	if r.Method == http.MethodPut {
+		var settings intercept.Settings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := intercepts.SetSettings(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	answer, err := json.Marshal(intercepts.Settings())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(answer)
+}
+
+func (a *API) ResolveIntercepted(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var decision intercept.Decision
+	if err = json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = a.proxyServer.Intercepts().Resolve(id, decision)
+	switch {
+	case errors.Is(err, intercept.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (a *API) RepeatRequest(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
 	selectedRequest, err := a.requestUseCase.GetRequestById(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	a.proxyHttpOrHttps(w, &http.Request{
+	if !a.targetAllowed(selectedRequest, r) {
+		http.Error(w, errOutOfScope, http.StatusForbidden)
+		return
+	}
+
+	// the stored body stops at the capture limit, replaying it sends
+	// something the client never did
+	if truncated, _ := strconv.ParseBool(r.URL.Query().Get("truncated")); selectedRequest.BodyTruncated && !truncated {
+		http.Error(w, errTruncatedBody, http.StatusConflict)
+		return
+	}
+
+	repeated := &http.Request{
 		Method: selectedRequest.Method,
 		URL: &url.URL{
 			Scheme: selectedRequest.Scheme,
 			Host:   selectedRequest.Host,
 			Path:   selectedRequest.Path,
 		},
-		Header: selectedRequest.Headers,
-		Body:   ioutil.NopCloser(strings.NewReader(selectedRequest.Body)),
-		Host:   r.Host,
-	}, false)
+		Header:     selectedRequest.Headers,
+		Body:       ioutil.NopCloser(bytes.NewReader(selectedRequest.Body)),
+		// the target's host, not the api's the repeat was asked on
+		Host:       selectedRequest.Host,
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	// the api has no request id middleware, a repeated request gets its own id
+	ctx := mw.SetRequestID(r.Context(), mw.NewRequestID())
+	a.proxyHttpOrHttps(w, repeated.WithContext(proxy.WithListener(ctx, models.ListenerRepeater)), false)
+}
+
+const (
+	errOutOfScope    = "target is out of scope, pass override=true to send it anyway"
+	errTruncatedBody = "the stored body was cut at the capture limit, pass truncated=true to send it anyway"
+)
+
+// targetAllowed keeps the scanner and repeater away from out of scope targets
+// unless the caller overrides the scope explicitly.
+func (a *API) targetAllowed(request *models.Request, r *http.Request) bool {
+	return overridden(r) || a.proxyServer.InScope(request.Scheme, request.Host, request.Path)
+}
+
+func overridden(r *http.Request) bool {
+	override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+	return override
 }
 
 func (a *API) ScanRequest(w http.ResponseWriter, r *http.Request) {
     id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
     selectedRequest, err := a.requestUseCase.GetRequestById(id)
+    if errors.Is(err, repository.ErrNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
+    if !a.targetAllowed(selectedRequest, r) {
+        http.Error(w, errOutOfScope, http.StatusForbidden)
+        return
+    }
+
     request := &http.Request{
         Method: selectedRequest.Method,
         URL: &url.URL{
@@ -146,13 +428,21 @@ func (a *API) ScanRequest(w http.ResponseWriter, r *http.Request) {
             Path:   selectedRequest.Path,
         },
         Header: selectedRequest.Headers,
-        Body:   ioutil.NopCloser(strings.NewReader(selectedRequest.Body)),
-        Host:   r.Host,
+        Body:   ioutil.NopCloser(bytes.NewReader(selectedRequest.Body)),
+        Host:   selectedRequest.Host,
     }
 
 	rootDir, _ := os.Getwd()
     dictFilePath := rootDir + "/pkg/dicc.txt"
-    scanResults := scanner.Scan(request, dictFilePath)
+    // every dictionary path is checked on its own, the scope may exclude
+    // prefixes of a host it otherwise includes
+    var allowed func(u *url.URL) bool
+    if !overridden(r) {
+        allowed = func(u *url.URL) bool {
+            return a.proxyServer.InScope(u.Scheme, u.Host, u.Path)
+        }
+    }
+    scanResults := scanner.Scan(a.proxyServer.Client(), request, dictFilePath, allowed)
 
     var foundPaths []string
 
@@ -0,0 +1,241 @@
+package delivery
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+const (
+	defaultHistoryLimit = 100
+	defaultSearchLimit  = 50
+	maxLimit            = 1000
+
+	// nextCursorHeader carries the cursor of the next page, it is left out on
+	// the last one.
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// historyQuery reads the query parameters of GET /requests:
+//
+//	sort=id|latency|ttfb, order=asc|desc
+//	host, method, status=404 or status=400-499
+//	path (substring), path_regex, content_type (substring of the response's)
+//	client (address, with or without the port), listener, sni, proto, connection
+//	req_id (the id the proxy logged and returned the exchange under)
+//	since, until (when the request was captured, RFC 3339, until is exclusive)
+//	q (text searched in the request and response bodies)
+//	limit (at most 1000), after (the cursor of the next page)
+//
+// Without limit or after the whole history is listed, as it was before
+// pagination. A page asked for with after alone holds 100 exchanges.
+//
+// path_regex is a POSIX extended regular expression, the syntax Go and the
+// postgres ~ operator read the same way. Perl classes like \d and flags
+// are refused rather than matched differently per backend.
+//
+// path, path_regex, content_type and q have no index behind them, postgres
+// checks them on every row the other filters leave. On a large history they
+// are best narrowed by host, method, status or a time range.
+func historyQuery(r *http.Request) (models.HistoryQuery, error) {
+	values := r.URL.Query()
+	query := models.HistoryQuery{
+		SortBy:       models.SortById,
+		Host:         values.Get("host"),
+		Method:       strings.ToUpper(values.Get("method")),
+		Path:         values.Get("path"),
+		PathRegex:    values.Get("path_regex"),
+		ContentType:  values.Get("content_type"),
+		ClientAddr:   values.Get("client"),
+		Listener:     values.Get("listener"),
+		SNI:          values.Get("sni"),
+		Proto:        values.Get("proto"),
+		ConnectionId: values.Get("connection"),
+		ReqId:        values.Get("req_id"),
+		BodyContains: []byte(values.Get("q")),
+	}
+
+	switch sortBy := values.Get("sort"); sortBy {
+	case "":
+	case models.SortById, models.SortByLatency, models.SortByTTFB:
+		query.SortBy = sortBy
+	default:
+		return query, fmt.Errorf("unknown sort %q, use id, latency or ttfb", sortBy)
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("unknown order %q, use asc or desc", order)
+	}
+
+	if status := values.Get("status"); status != "" {
+		var err error
+		if query.StatusMin, query.StatusMax, err = statusRange(status); err != nil {
+			return query, err
+		}
+	}
+
+	if query.PathRegex != "" {
+		if _, err := regexp.CompilePOSIX(query.PathRegex); err != nil {
+			return query, fmt.Errorf("bad path_regex: %w", err)
+		}
+	}
+
+	var err error
+	if query.Since, query.Until, err = timeRange(values); err != nil {
+		return query, err
+	}
+
+	defaultLimit := 0
+	if values.Get("after") != "" {
+		defaultLimit = defaultHistoryLimit
+	}
+	if query.Limit, err = limit(values, defaultLimit); err != nil {
+		return query, err
+	}
+
+	if after := values.Get("after"); after != "" {
+		cursor, err := decodeCursor(query.SortBy, after)
+		if err != nil {
+			return query, err
+		}
+		query.After = cursor
+	}
+
+	return query, nil
+}
+
+// searchQuery reads the query parameters of GET /search:
+//
+//	q (what to look for), mode=text|regex
+//	host, since, until (limit the exchanges searched like they do the history)
+//	limit (50 by default, at most 1000)
+//
+// A regex is a POSIX extended regular expression, like path_regex is.
+func searchQuery(r *http.Request) (models.SearchQuery, error) {
+	values := r.URL.Query()
+	query := models.SearchQuery{
+		Text: values.Get("q"),
+		Mode: models.SearchText,
+		Host: values.Get("host"),
+	}
+
+	if strings.TrimSpace(query.Text) == "" {
+		return query, errors.New("nothing to search for, pass q")
+	}
+
+	switch mode := values.Get("mode"); mode {
+	case "", models.SearchText:
+	case models.SearchRegex:
+		query.Mode = mode
+		if _, err := regexp.CompilePOSIX(query.Text); err != nil {
+			return query, fmt.Errorf("bad regex: %w", err)
+		}
+	default:
+		return query, fmt.Errorf("unknown mode %q, use text or regex", mode)
+	}
+
+	var err error
+	if query.Since, query.Until, err = timeRange(values); err != nil {
+		return query, err
+	}
+
+	if query.Limit, err = limit(values, defaultSearchLimit); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// timeRange reads since and until as RFC 3339 times, zero when left out.
+func timeRange(values url.Values) (time.Time, time.Time, error) {
+	var bounds [2]time.Time
+	for i, name := range []string{"since", "until"} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return bounds[0], bounds[1], fmt.Errorf("bad %s %q, use RFC 3339", name, value)
+		}
+		bounds[i] = t
+	}
+
+	return bounds[0], bounds[1], nil
+}
+
+func limit(values url.Values, defaultLimit int) (int, error) {
+	value := values.Get("limit")
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > maxLimit {
+		return 0, fmt.Errorf("bad limit %q, use 1 to %d", value, maxLimit)
+	}
+
+	return n, nil
+}
+
+// statusRange reads a single status code or an inclusive range like 400-499.
+func statusRange(status string) (int, int, error) {
+	low, high, isRange := strings.Cut(status, "-")
+	if !isRange {
+		high = low
+	}
+
+	from, errFrom := strconv.Atoi(low)
+	to, errTo := strconv.Atoi(high)
+	if errFrom != nil || errTo != nil || from < 100 || to > 599 || from > to {
+		return 0, 0, fmt.Errorf("bad status %q, use a code like 404 or a range like 400-499", status)
+	}
+
+	return from, to, nil
+}
+
+// A cursor names the sort it was made for, so a page is never continued in
+// another order.
+func encodeCursor(sortBy string, cursor *models.HistoryCursor) string {
+	plain := sortBy + ":" + strconv.FormatFloat(cursor.Key, 'g', -1, 64) + ":" + strconv.FormatInt(cursor.Id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(plain))
+}
+
+func decodeCursor(sortBy, encoded string) (*models.HistoryCursor, error) {
+	errCursor := fmt.Errorf("bad cursor %q, pass on the %s header of the previous page", encoded, nextCursorHeader)
+
+	plain, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errCursor
+	}
+
+	parts := strings.Split(string(plain), ":")
+	if len(parts) != 3 {
+		return nil, errCursor
+	}
+
+	if parts[0] != sortBy {
+		return nil, fmt.Errorf("cursor was made for sort=%s, not sort=%s", parts[0], sortBy)
+	}
+
+	key, errKey := strconv.ParseFloat(parts[1], 64)
+	id, errId := strconv.ParseInt(parts[2], 10, 64)
+	if errKey != nil || errId != nil {
+		return nil, errCursor
+	}
+
+	return &models.HistoryCursor{Key: key, Id: id}, nil
+}
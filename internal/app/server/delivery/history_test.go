@@ -0,0 +1,68 @@
+package delivery
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	after := encodeCursor(models.SortById, &models.HistoryCursor{Id: 7})
+
+	tests := []struct {
+		name      string
+		query     url.Values
+		wantLimit int
+		wantErr   bool
+	}{
+		{name: "everything without paging", query: url.Values{}, wantLimit: 0},
+		{name: "explicit limit", query: url.Values{"limit": {"20"}}, wantLimit: 20},
+		{name: "page after a cursor", query: url.Values{"after": {after}}, wantLimit: defaultHistoryLimit},
+		{name: "limit and cursor", query: url.Values{"limit": {"5"}, "after": {after}}, wantLimit: 5},
+		{name: "limit over the maximum", query: url.Values{"limit": {"1001"}}, wantErr: true},
+		{name: "posix path regex", query: url.Values{"path_regex": {"^/api/[0-9]+$"}}},
+		{name: "posix class", query: url.Values{"path_regex": {"[[:digit:]]"}}},
+		{name: "perl class", query: url.Values{"path_regex": {`\d`}}, wantErr: true},
+		{name: "flags", query: url.Values{"path_regex": {"(?i)api"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := historyQuery(httptest.NewRequest("GET", "/requests?"+test.query.Encode(), nil))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("historyQuery accepted %q", test.query.Encode())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("historyQuery(%q): %v", test.query.Encode(), err)
+			}
+
+			if query.Limit != test.wantLimit {
+				t.Fatalf("Limit = %d, want %d", query.Limit, test.wantLimit)
+			}
+		})
+	}
+}
+
+func TestSearchQueryRegex(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+	}{
+		{text: "order[[:space:]]+ship"},
+		{text: "(get|post) /api"},
+		{text: `order\s+ship`, wantErr: true},
+		{text: `\bword\b`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, err := searchQuery(httptest.NewRequest("GET", "/search?"+url.Values{"mode": {"regex"}, "q": {test.text}}.Encode(), nil))
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("searchQuery(%q) error = %v, want error %t", test.text, err, test.wantErr)
+		}
+	}
+}
@@ -6,6 +6,14 @@ type IAPI interface {
 	ProxyRequest(w http.ResponseWriter, r *http.Request)
 	GetRequest(w http.ResponseWriter, r *http.Request)
 	GetRequests(w http.ResponseWriter, r *http.Request)
+	GetWebSocketMessages(w http.ResponseWriter, r *http.Request)
 	RepeatRequest(w http.ResponseWriter, r *http.Request)
 	ScanRequest(w http.ResponseWriter, r *http.Request)
+	GetTLSEvents(w http.ResponseWriter, r *http.Request)
+	GetPassthrough(w http.ResponseWriter, r *http.Request)
+	RemovePassthrough(w http.ResponseWriter, r *http.Request)
+	RewriteRules(w http.ResponseWriter, r *http.Request)
+	GetIntercepted(w http.ResponseWriter, r *http.Request)
+	InterceptSettings(w http.ResponseWriter, r *http.Request)
+	ResolveIntercepted(w http.ResponseWriter, r *http.Request)
 }
@@ -0,0 +1,99 @@
+package decoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings lists the codings from a Content-Encoding header in the order
+// they were applied, identity codings are dropped.
+func Encodings(headers map[string][]string) []string {
+	var encodings []string
+	for key, values := range headers {
+		if !strings.EqualFold(key, "Content-Encoding") {
+			continue
+		}
+
+		for _, value := range values {
+			for _, coding := range strings.Split(value, ",") {
+				coding = strings.ToLower(strings.TrimSpace(coding))
+				if coding != "" && coding != "identity" {
+					encodings = append(encodings, coding)
+				}
+			}
+		}
+	}
+
+	return encodings
+}
+
+// DefaultLimit is how much a body may decode to when no limit is configured.
+const DefaultLimit = 16 << 20
+
+// ErrTooLarge is returned with the first limit bytes of a body that decodes
+// to more than that.
+var ErrTooLarge = errors.New("decoded body exceeds the limit")
+
+// Decode undoes the given content codings, last applied first, and stops at
+// limit bytes of output, DefaultLimit when limit is zero or less. On error
+// the bytes decoded so far are returned, which is all a truncated body can
+// give.
+func Decode(body []byte, encodings []string, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	tooLarge := false
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, err := newReader(encodings[i], body)
+		if err != nil {
+			return body, err
+		}
+
+		// one byte past the limit tells a body of exactly limit bytes from a larger one
+		decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+		if int64(len(decoded)) > limit {
+			decoded, tooLarge, err = decoded[:limit], true, nil
+		}
+		if err != nil {
+			// the cut output of an earlier coding cannot decode to the end
+			if tooLarge {
+				return decoded, ErrTooLarge
+			}
+			return decoded, fmt.Errorf("decode %s err: %w", encodings[i], err)
+		}
+
+		body = decoded
+	}
+
+	if tooLarge {
+		return body, ErrTooLarge
+	}
+
+	return body, nil
+}
+
+func newReader(encoding string, body []byte) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// "deflate" is meant to be zlib wrapped, but plenty of servers send a raw stream
+		if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return reader, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	case "br":
+		return brotli.NewReader(bytes.NewReader(body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,135 @@
+package decoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func encode(t *testing.T, plain []byte, encodings ...string) []byte {
+	t.Helper()
+
+	body := plain
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "zlib":
+			w = zlib.NewWriter(&buf)
+		case "flate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		default:
+			t.Fatalf("no writer for %s", encoding)
+		}
+
+		if _, err := w.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		body = buf.Bytes()
+	}
+
+	return body
+}
+
+func TestDecode(t *testing.T) {
+	plain := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+	gzipped := encode(t, plain, "gzip")
+
+	tests := []struct {
+		name      string
+		body      []byte
+		encodings []string
+		limit     int64
+		want      []byte
+		wantErr   error
+		anyErr    bool
+	}{
+		{name: "gzip", body: gzipped, encodings: []string{"gzip"}, want: plain},
+		{name: "x-gzip", body: gzipped, encodings: []string{"x-gzip"}, want: plain},
+		{name: "deflate zlib", body: encode(t, plain, "zlib"), encodings: []string{"deflate"}, want: plain},
+		{name: "deflate raw", body: encode(t, plain, "flate"), encodings: []string{"deflate"}, want: plain},
+		{name: "br", body: encode(t, plain, "br"), encodings: []string{"br"}, want: plain},
+		{name: "chained", body: encode(t, plain, "gzip", "br"), encodings: []string{"gzip", "br"}, want: plain},
+		{name: "no encodings", body: plain, want: plain},
+		{name: "exactly the limit", body: gzipped, encodings: []string{"gzip"}, limit: int64(len(plain)), want: plain},
+		{name: "over the limit", body: gzipped, encodings: []string{"gzip"}, limit: 100, want: plain[:100], wantErr: ErrTooLarge},
+		{name: "chained over the limit", body: encode(t, plain, "gzip", "br"), encodings: []string{"gzip", "br"}, limit: 100, want: plain[:100], wantErr: ErrTooLarge},
+		{name: "truncated gzip", body: gzipped[:len(gzipped)/2], encodings: []string{"gzip"}, anyErr: true},
+		{name: "corrupt gzip", body: []byte("not gzip at all"), encodings: []string{"gzip"}, anyErr: true},
+		{name: "corrupt br", body: []byte("not brotli at all"), encodings: []string{"br"}, anyErr: true},
+		{name: "corrupt deflate", body: []byte{0xff, 0xff, 0xff, 0xff}, encodings: []string{"deflate"}, anyErr: true},
+		{name: "unsupported", body: plain, encodings: []string{"zstd"}, anyErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.body, tt.encodings, tt.limit)
+			switch {
+			case tt.anyErr:
+				if err == nil {
+					t.Fatalf("Decode() = %d bytes, want an error", len(got))
+				}
+				return
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decode() = %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecodeBomb(t *testing.T) {
+	// a few kilobytes on the wire that inflate a thousand times over
+	const limit = 64 << 10
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(make([]byte, 16<<20))
+	w.Close()
+
+	got, err := Decode(buf.Bytes(), []string{"gzip"}, limit)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Decode() error = %v, want %v", err, ErrTooLarge)
+	}
+	if len(got) != limit {
+		t.Errorf("Decode() = %d bytes, want the limit of %d", len(got), limit)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    []string
+	}{
+		{name: "none", headers: map[string][]string{"Content-Type": {"text/plain"}}},
+		{name: "single", headers: map[string][]string{"Content-Encoding": {"gzip"}}, want: []string{"gzip"}},
+		{name: "list in order", headers: map[string][]string{"Content-Encoding": {"GZIP, identity, br"}}, want: []string{"gzip", "br"}},
+		{name: "lower case key", headers: map[string][]string{"content-encoding": {"deflate"}}, want: []string{"deflate"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Encodings(tt.headers)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Encodings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+)
+
+var textMediaTypeMarkers = []string{"json", "xml", "javascript", "ecmascript", "x-www-form-urlencoded", "graphql", "yaml", "csv", "html"}
+
+// encodeBody renders a stored body for the JSON API: text bodies are passed
+// through, anything else is base64 encoded so it survives the round trip.
+func encodeBody(body []byte, headers map[string][]string) (string, string, string) {
+	contentType := bodyContentType(body, headers)
+	if isText(body, contentType) {
+		return string(body), BodyEncodingText, contentType
+	}
+
+	return base64.StdEncoding.EncodeToString(body), BodyEncodingBase64, contentType
+}
+
+// BodyText returns a body as text for searching, false when it is binary.
+func BodyText(body []byte, headers map[string][]string) (string, bool) {
+	if !isText(body, bodyContentType(body, headers)) {
+		return "", false
+	}
+
+	return string(body), true
+}
+
+// bodyContentType is the declared content type of a body, sniffed when the
+// headers do not name one.
+func bodyContentType(body []byte, headers map[string][]string) string {
+	contentType := http.Header(headers).Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+	}
+
+	return contentType
+}
+
+func isText(body []byte, contentType string) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" || strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	for _, marker := range textMediaTypeMarkers {
+		if strings.Contains(mediaType, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Request) MarshalJSON() ([]byte, error) {
+	type request Request
+	body, encoding, contentType := encodeBody(r.Body, r.Headers)
+
+	return json.Marshal(struct {
+		request
+		Body         string `json:"body"`
+		BodyEncoding string `json:"body_encoding"`
+		ContentType  string `json:"content_type"`
+	}{request(r), body, encoding, contentType})
+}
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	type response Response
+	body, encoding, contentType := encodeBody(r.Body, r.Headers)
+
+	return json.Marshal(struct {
+		response
+		Body         string `json:"body"`
+		BodyEncoding string `json:"body_encoding"`
+		ContentType  string `json:"content_type"`
+	}{response(r), body, encoding, contentType})
+}
+
+func (m WebSocketMessage) MarshalJSON() ([]byte, error) {
+	type webSocketMessage WebSocketMessage
+
+	payload, encoding := string(m.Payload), BodyEncodingText
+	if !utf8.Valid(m.Payload) {
+		payload, encoding = base64.StdEncoding.EncodeToString(m.Payload), BodyEncodingBase64
+	}
+
+	return json.Marshal(struct {
+		webSocketMessage
+		Payload         string `json:"payload"`
+		PayloadEncoding string `json:"payload_encoding"`
+	}{webSocketMessage(m), payload, encoding})
+}
@@ -1,26 +1,172 @@
 package models
 
+import "time"
+
+const (
+	DirectionClient = "client"
+	DirectionServer = "server"
+
+	TLSEventHandshakeFailed  = "handshake_failed"
+	TLSEventPassthroughAdded = "passthrough_added"
+
+	// The listeners a request can arrive on, repeater requests are the ones
+	// sent again through the api.
+	ListenerHTTP        = "http"
+	ListenerSOCKS5      = "socks5"
+	ListenerTransparent = "transparent"
+	ListenerRepeater    = "repeater"
+)
+
 type Request struct {
-	Id      int64               `json:"id"`
-	Method  string              `json:"method"`
-	Scheme  string              `json:"scheme"`
-	Host    string              `json:"host"`
-	Path    string              `json:"path"`
-	Headers map[string][]string `json:"headers"`
-	Params  map[string][]string `json:"params"`
-	Body    string              `json:"body"`
+	Id               int64               `json:"id"`
+	Method           string              `json:"method"`
+	Scheme           string              `json:"scheme"`
+	Host             string              `json:"host"`
+	Path             string              `json:"path"`
+	Proto            string              `json:"proto"`
+	Headers          map[string][]string `json:"headers"`
+	Params           map[string][]string `json:"params"`
+	Body             []byte              `json:"body"`
+	BodyDecoded      bool                `json:"body_decoded"`
+	BodyTruncated    bool                `json:"body_truncated"`
+	BodyLength       int64               `json:"body_length"`
+	DecodedTruncated bool                `json:"decoded_truncated"`
+	ConnectionId     string              `json:"connection_id"`
+	RulesFired       []string            `json:"rules_fired"`
+	CreatedAt        time.Time           `json:"created_at"`
+	ClientAddr       string              `json:"client_addr"`
+	Listener         string              `json:"listener"`
+	SNI              string              `json:"sni"`
+	// ReqId is the id the proxy logged the exchange under and returned to the
+	// client, and sent upstream when configured to.
+	ReqId string `json:"req_id"`
 }
 
 type Response struct {
-	Id        int64               `json:"id"`
-	RequestId int64               `json:"request_id"`
-	Code      int                 `json:"code"`
-	Message   string              `json:"message"`
-	Headers   map[string][]string `json:"headers"`
-	Body      string              `json:"body"`
+	Id               int64               `json:"id"`
+	RequestId        int64               `json:"request_id"`
+	Code             int                 `json:"code"`
+	Message          string              `json:"message"`
+	Proto            string              `json:"proto"`
+	Headers          map[string][]string `json:"headers"`
+	Body             []byte              `json:"body"`
+	BodyDecoded      bool                `json:"body_decoded"`
+	BodyTruncated    bool                `json:"body_truncated"`
+	BodyLength       int64               `json:"body_length"`
+	DecodedTruncated bool                `json:"decoded_truncated"`
+	RulesFired       []string            `json:"rules_fired"`
+	TLSVersion       string              `json:"tls_version"`
+	TLSCipher        string              `json:"tls_cipher"`
+	TLSCertificates  string              `json:"tls_certificates"`
+	Timings          Timings             `json:"timings"`
+}
+
+// Timings break down where the time of an exchange went, durations are in
+// milliseconds from the matching start. Phases a reused connection skips
+// keep a nil start.
+type Timings struct {
+	Start        time.Time  `json:"start"`
+	DNSStart     *time.Time `json:"dns_start"`
+	DNS          float64    `json:"dns_ms"`
+	ConnectStart *time.Time `json:"connect_start"`
+	Connect      float64    `json:"connect_ms"`
+	TLSStart     *time.Time `json:"tls_start"`
+	TLS          float64    `json:"tls_ms"`
+	FirstByte    float64    `json:"ttfb_ms"`
+	Total        float64    `json:"total_ms"`
+	Reused       bool       `json:"reused"`
+}
+
+const (
+	SortById      = "id"
+	SortByLatency = "latency"
+	SortByTTFB    = "ttfb"
+)
+
+// HistoryQuery selects which exchanges of the history are listed and how.
+// Zero values leave a filter out, a zero Limit lists every match. PathRegex
+// is a POSIX extended regular expression, see regexp.CompilePOSIX.
+type HistoryQuery struct {
+	SortBy     string
+	Descending bool
+
+	Host        string
+	Method      string
+	StatusMin   int
+	StatusMax   int
+	Path        string
+	PathRegex   string
+	ContentType string
+	// ClientAddr matches the client's address, with or without its port.
+	ClientAddr   string
+	Listener     string
+	SNI          string
+	Proto        string
+	ConnectionId string
+	ReqId        string
+	// Since and Until bound when the request was captured, Until is exclusive.
+	Since time.Time
+	Until time.Time
+	// BodyContains is searched in the decoded request and response bodies,
+	// the wire bodies when they were not encoded. It is not indexed on
+	// postgres, like Path, PathRegex and ContentType.
+	BodyContains []byte
+
+	Limit int
+	After *HistoryCursor
+}
+
+// HistoryCursor is the position of the last exchange of a page, the next page
+// starts after it in the order of the query.
+type HistoryCursor struct {
+	Key float64
+	Id  int64
+}
+
+// SortKey is the value the history is ordered by, ties are broken by id.
+func (q HistoryQuery) SortKey(requestData *RequestData) float64 {
+	switch q.SortBy {
+	case SortByLatency:
+		return requestData.Response.Timings.Total
+	case SortByTTFB:
+		return requestData.Response.Timings.FirstByte
+	default:
+		return float64(requestData.Request.Id)
+	}
+}
+
+// NextCursor returns where the page after page starts, nil once page was the
+// last one.
+func (q HistoryQuery) NextCursor(page []*RequestData) *HistoryCursor {
+	if q.Limit <= 0 || len(page) < q.Limit {
+		return nil
+	}
+
+	last := page[len(page)-1]
+	return &HistoryCursor{Key: q.SortKey(last), Id: last.Request.Id}
 }
 
 type RequestData struct {
 	Request  Request  `json:"request"`
 	Response Response `json:"response"`
 }
+
+type WebSocketMessage struct {
+	Id        int64     `json:"id"`
+	RequestId int64     `json:"request_id"`
+	Direction string    `json:"direction"`
+	Opcode    int       `json:"opcode"`
+	Time      time.Time `json:"time"`
+	Payload   []byte    `json:"payload"`
+}
+
+// TLSEvent records a client refusing the minted certificate for a host and
+// the host being switched to passthrough because of it.
+type TLSEvent struct {
+	Id           int64     `json:"id"`
+	Host         string    `json:"host"`
+	Kind         string    `json:"kind"`
+	ConnectionId string    `json:"connection_id"`
+	Detail       string    `json:"detail"`
+	Time         time.Time `json:"time"`
+}
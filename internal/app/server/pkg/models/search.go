@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+const (
+	// SearchText looks for words, the way Postgres full-text search splits
+	// the stored text into them.
+	SearchText = "text"
+	// SearchRegex looks for a POSIX extended regular expression anywhere in
+	// the stored text.
+	SearchRegex = "regex"
+
+	SearchPartRequestHeaders  = "request_headers"
+	SearchPartRequestBody     = "request_body"
+	SearchPartResponseHeaders = "response_headers"
+	SearchPartResponseBody    = "response_body"
+
+	// SnippetStart and SnippetStop enclose what matched inside a snippet.
+	SnippetStart = "<mark>"
+	SnippetStop  = "</mark>"
+)
+
+// SearchQuery looks through the headers and bodies of the stored exchanges.
+// Host, Since and Until limit the exchanges searched like they limit the
+// history, a zero Limit returns every match.
+type SearchQuery struct {
+	Text  string
+	Mode  string
+	Host  string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+type SearchMatch struct {
+	Part    string `json:"part"`
+	Snippet string `json:"snippet"`
+}
+
+// SearchResult is an exchange that matched, newest first, with a snippet of
+// every part of it that did.
+type SearchResult struct {
+	RequestId int64         `json:"request_id"`
+	Matches   []SearchMatch `json:"matches"`
+}
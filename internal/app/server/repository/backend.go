@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/JuFnd/go-proxy/configs"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BackendPostgres = "postgres"
+	BackendFile     = "file"
+	BackendMemory   = "memory"
+
+	defaultHistoryPath = "data/history.log"
+)
+
+// New opens the storage backend picked in the configuration, postgres when
+// none is set. Pending postgres migrations run first when migrate_on_start
+// is set. Every backend cuts the decoded copies of bodies at
+// capture.max_decoded_size.
+func New(cfg configs.StorageConfig, captureCfg configs.CaptureConfig, psxCfg *configs.WebConfig, lg *logrus.Logger) (IRepository, error) {
+	switch cfg.Backend {
+	case "", BackendPostgres:
+		repo, err := GetUserRepo(psxCfg, lg)
+		if err != nil {
+			return nil, err
+		}
+
+		repo.decodeLimit = captureCfg.MaxDecodedSize
+
+		if cfg.MigrateOnStart {
+			applied, err := repo.MigrateUp()
+			if err != nil {
+				repo.Close()
+				return nil, fmt.Errorf("migrate: %w", err)
+			}
+
+			for _, m := range applied {
+				lg.WithField("version", m.Version).Infoln("applied migration", m.Name)
+			}
+		}
+
+		return repo, nil
+	case BackendFile:
+		path := cfg.Path
+		if path == "" {
+			path = defaultHistoryPath
+		}
+
+		repo, err := NewFileRepository(path)
+		if err != nil {
+			return nil, err
+		}
+
+		repo.decodeLimit = captureCfg.MaxDecodedSize
+		return repo, nil
+	case BackendMemory:
+		repo := NewMemoryRepository()
+		repo.decodeLimit = captureCfg.MaxDecodedSize
+		return repo, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, use %s, %s or %s", cfg.Backend, BackendPostgres, BackendFile, BackendMemory)
+	}
+}
@@ -0,0 +1,853 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runConformance checks the behaviour every backend has to share, open must
+// return an empty repository.
+func runConformance(t *testing.T, open func(t *testing.T) IRepository) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo IRepository)
+	}{
+		{name: "request round trip", run: testRequestRoundTrip},
+		{name: "exchange round trip", run: testExchangeRoundTrip},
+		{name: "decoded bodies", run: testDecodedBodies},
+		{name: "truncated decoded bodies", run: testTruncatedDecodedBodies},
+		{name: "missing records", run: testMissingRecords},
+		{name: "history order", run: testHistoryOrder},
+		{name: "history filters", run: testHistoryFilters},
+		{name: "history pages", run: testHistoryPages},
+		{name: "search", run: testSearch},
+		{name: "stored copies", run: testStoredCopies},
+		{name: "websocket messages", run: testWebSocketMessages},
+		{name: "tls events", run: testTLSEvents},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, open(t))
+		})
+	}
+}
+
+// postgres keeps microseconds, the fixtures do not carry more than that
+var baseTime = time.Date(2024, 3, 1, 12, 0, 0, 123456000, time.UTC)
+
+func newRequest(path string) *models.Request {
+	return &models.Request{
+		Method:        "POST",
+		Scheme:        "https",
+		Host:          "example.com",
+		Path:          path,
+		Proto:         "HTTP/1.1",
+		Headers:       map[string][]string{"Content-Type": {"application/json"}},
+		Params:        map[string][]string{"q": {"1", "2"}},
+		Body:          []byte(`{"name":"proxy"}`),
+		BodyTruncated: true,
+		BodyLength:    4096,
+		ConnectionId:  "conn1234",
+		RulesFired:    []string{"strip-cookie"},
+		CreatedAt:     baseTime,
+		ClientAddr:    "192.0.2.10:51234",
+		Listener:      models.ListenerHTTP,
+		SNI:           "example.com",
+		ReqId:         "AbCdEfGh",
+	}
+}
+
+func newResponse(requestId int64, total float64) *models.Response {
+	dnsStart := baseTime.Add(time.Millisecond)
+	return &models.Response{
+		RequestId:       requestId,
+		Code:            200,
+		Message:         "200 OK",
+		Proto:           "HTTP/1.1",
+		Headers:         map[string][]string{"Content-Type": {"text/plain"}},
+		Body:            []byte("ok"),
+		BodyLength:      2,
+		RulesFired:      []string{},
+		TLSVersion:      "TLS 1.3",
+		TLSCipher:       "TLS_AES_128_GCM_SHA256",
+		TLSCertificates: "-----BEGIN CERTIFICATE-----\n",
+		Timings: models.Timings{
+			Start:     baseTime,
+			DNSStart:  &dnsStart,
+			DNS:       1.5,
+			FirstByte: total / 2,
+			Total:     total,
+		},
+	}
+}
+
+func saveExchange(t *testing.T, repo IRepository, path string, total float64) (*models.Request, *models.Response) {
+	t.Helper()
+
+	request := newRequest(path)
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatalf("InsertRequest: %v", err)
+	}
+
+	response := newResponse(request.Id, total)
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatalf("InsertResponse: %v", err)
+	}
+
+	return request, response
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func checkRequest(t *testing.T, got, want *models.Request) {
+	t.Helper()
+
+	if got.Id != want.Id || got.Method != want.Method || got.Scheme != want.Scheme || got.Host != want.Host ||
+		got.Path != want.Path || got.Proto != want.Proto || got.ConnectionId != want.ConnectionId || got.ReqId != want.ReqId ||
+		got.BodyTruncated != want.BodyTruncated || got.BodyLength != want.BodyLength {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.ClientAddr != want.ClientAddr || got.Listener != want.Listener || got.SNI != want.SNI {
+		t.Errorf("request metadata = %v %q %q %q, want %v %q %q %q",
+			got.CreatedAt, got.ClientAddr, got.Listener, got.SNI, want.CreatedAt, want.ClientAddr, want.Listener, want.SNI)
+	}
+
+	if !bytes.Equal(got.Body, want.Body) {
+		t.Errorf("request body = %q, want %q", got.Body, want.Body)
+	}
+
+	if len(got.Headers["Content-Type"]) != 1 || len(got.Params["q"]) != 2 || len(got.RulesFired) != len(want.RulesFired) {
+		t.Errorf("request headers, params or rules = %v %v %v, want %v %v %v",
+			got.Headers, got.Params, got.RulesFired, want.Headers, want.Params, want.RulesFired)
+	}
+}
+
+func testRequestRoundTrip(t *testing.T, repo IRepository) {
+	first, second := newRequest("/first"), newRequest("/second")
+	if err := repo.InsertRequest(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertRequest(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Id == 0 || second.Id <= first.Id {
+		t.Fatalf("ids = %d, %d, want increasing ids", first.Id, second.Id)
+	}
+
+	stored, err := repo.GetRequestById(second.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, stored, second)
+
+	undated := newRequest("/undated")
+	undated.CreatedAt = time.Time{}
+	if err = repo.InsertRequest(undated); err != nil {
+		t.Fatal(err)
+	}
+	if undated.CreatedAt.IsZero() {
+		t.Error("a request stored without a time was not dated")
+	}
+}
+
+func testExchangeRoundTrip(t *testing.T, repo IRepository) {
+	request, response := saveExchange(t, repo, "/exchange", 42)
+	if response.Id == 0 {
+		t.Fatal("InsertResponse did not assign an id")
+	}
+
+	stored, err := repo.GetRequestDataById(request.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, &stored.Request, request)
+
+	got := stored.Response
+	if got.Id != response.Id || got.RequestId != request.Id || got.Code != 200 || got.Message != "200 OK" ||
+		got.BodyLength != 2 || got.BodyDecoded || !bytes.Equal(got.Body, []byte("ok")) {
+		t.Errorf("response = %+v, want %+v", got, response)
+	}
+
+	if got.TLSVersion != response.TLSVersion || got.TLSCipher != response.TLSCipher || got.TLSCertificates != response.TLSCertificates {
+		t.Errorf("tls details = %q %q %q, want %q %q %q", got.TLSVersion, got.TLSCipher, got.TLSCertificates,
+			response.TLSVersion, response.TLSCipher, response.TLSCertificates)
+	}
+
+	timings := got.Timings
+	if !timings.Start.Equal(baseTime) || timings.DNSStart == nil || !timings.DNSStart.Equal(*response.Timings.DNSStart) ||
+		timings.ConnectStart != nil || timings.DNS != 1.5 || timings.FirstByte != 21 || timings.Total != 42 {
+		t.Errorf("timings = %+v, want %+v", timings, response.Timings)
+	}
+}
+
+func testDecodedBodies(t *testing.T, repo IRepository) {
+	plain := []byte(`{"token":"secret"}`)
+
+	request := newRequest("/gzip")
+	request.Headers["Content-Encoding"] = []string{"gzip"}
+	request.Body = gzipped(t, plain)
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+
+	response := newResponse(request.Id, 1)
+	response.Headers["Content-Encoding"] = []string{"gzip"}
+	response.Body = gzipped(t, plain)
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := repo.GetRequestDataById(request.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !decoded.Request.BodyDecoded || !bytes.Equal(decoded.Request.Body, plain) {
+		t.Errorf("decoded request body = %q (decoded %v), want %q", decoded.Request.Body, decoded.Request.BodyDecoded, plain)
+	}
+	if !decoded.Response.BodyDecoded || !bytes.Equal(decoded.Response.Body, plain) {
+		t.Errorf("decoded response body = %q (decoded %v), want %q", decoded.Response.Body, decoded.Response.BodyDecoded, plain)
+	}
+
+	raw, err := repo.GetRequestDataById(request.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw.Request.BodyDecoded || !bytes.Equal(raw.Request.Body, request.Body) {
+		t.Errorf("raw request body was decoded")
+	}
+	if raw.Response.BodyDecoded || !bytes.Equal(raw.Response.Body, response.Body) {
+		t.Errorf("raw response body was decoded")
+	}
+}
+
+func testTruncatedDecodedBodies(t *testing.T, repo IRepository) {
+	var plain []byte
+	for i := 0; len(plain) < 64<<10; i++ {
+		plain = strconv.AppendInt(append(plain, " item="...), int64(i*i), 10)
+	}
+
+	// the capture limit cut the compressed body in half
+	request := newRequest("/upload")
+	request.Headers["Content-Encoding"] = []string{"gzip"}
+	body := gzipped(t, plain)
+	request.Body = body[:len(body)/2]
+	request.BodyTruncated = true
+	request.BodyLength = int64(len(body))
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertResponse(newResponse(request.Id, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := repo.GetRequestDataById(request.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := decoded.Request.Body
+	if !decoded.Request.BodyDecoded || len(got) == 0 || !bytes.HasPrefix(plain, got) {
+		t.Errorf("decoded truncated request body = %d bytes (decoded %v), want a prefix of the %d plain bytes", len(got), decoded.Request.BodyDecoded, len(plain))
+	}
+}
+
+func testMissingRecords(t *testing.T, repo IRepository) {
+	if _, err := repo.GetRequestById(1000); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRequestById of a missing id: err = %v, want ErrNotFound", err)
+	}
+
+	if _, err := repo.GetRequestDataById(1000, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRequestDataById of a missing id: err = %v, want ErrNotFound", err)
+	}
+
+	// a request whose response was never saved is not part of the history
+	request := newRequest("/unanswered")
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.GetRequestDataById(request.Id, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRequestDataById of an unanswered request: err = %v, want ErrNotFound", err)
+	}
+
+	history, err := repo.GetAllRequestsData(models.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("history holds %d exchanges, want none", len(history))
+	}
+
+	if err := repo.InsertResponse(newResponse(request.Id+1000, 1)); err == nil {
+		t.Error("InsertResponse for a missing request succeeded")
+	}
+}
+
+func testHistoryOrder(t *testing.T, repo IRepository) {
+	slow, _ := saveExchange(t, repo, "/slow", 300)
+	fast, _ := saveExchange(t, repo, "/fast", 10)
+	medium, _ := saveExchange(t, repo, "/medium", 50)
+
+	tests := []struct {
+		query models.HistoryQuery
+		want  []int64
+	}{
+		{query: models.HistoryQuery{}, want: []int64{slow.Id, fast.Id, medium.Id}},
+		{query: models.HistoryQuery{SortBy: models.SortById, Descending: true}, want: []int64{medium.Id, fast.Id, slow.Id}},
+		{query: models.HistoryQuery{SortBy: models.SortByLatency}, want: []int64{fast.Id, medium.Id, slow.Id}},
+		{query: models.HistoryQuery{SortBy: models.SortByLatency, Descending: true}, want: []int64{slow.Id, medium.Id, fast.Id}},
+		{query: models.HistoryQuery{SortBy: models.SortByTTFB}, want: []int64{fast.Id, medium.Id, slow.Id}},
+	}
+
+	for _, tt := range tests {
+		checkHistory(t, repo, tt.query, tt.want)
+	}
+}
+
+// checkHistory lists the history for query and compares the request ids.
+func checkHistory(t *testing.T, repo IRepository, query models.HistoryQuery, want []int64) []*models.RequestData {
+	t.Helper()
+
+	history, err := repo.GetAllRequestsData(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]int64, 0, len(history))
+	for _, requestData := range history {
+		got = append(got, requestData.Request.Id)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("%+v: ids = %v, want %v", query, got, want)
+		return history
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%+v: ids = %v, want %v", query, got, want)
+			break
+		}
+	}
+
+	return history
+}
+
+func testHistoryFilters(t *testing.T, repo IRepository) {
+	plain, _ := saveExchange(t, repo, "/api/users/1", 10)
+
+	request := newRequest("/static/app.js")
+	request.Method = "GET"
+	request.Host = "CDN.example.com:8443"
+	request.Body = []byte{}
+	request.Proto = "HTTP/2.0"
+	request.CreatedAt = baseTime.Add(time.Hour)
+	request.ClientAddr = "[2001:db8::1]:40000"
+	request.Listener = models.ListenerSOCKS5
+	request.SNI = "CDN.example.com"
+	request.ConnectionId = "tunnel42"
+	request.ReqId = "upstream-7f3a"
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	response := newResponse(request.Id, 20)
+	response.Code = 404
+	response.Headers = map[string][]string{"Content-Type": {"Application/JavaScript; charset=utf-8"}}
+	response.Timings.Start = baseTime.Add(time.Hour)
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	static := request
+
+	request = newRequest("/api/search")
+	request.Headers = map[string][]string{"Content-Encoding": {"gzip"}}
+	request.Body = gzipped(t, []byte(`{"query":"needle"}`))
+	request.CreatedAt = baseTime.Add(2 * time.Hour)
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	response = newResponse(request.Id, 30)
+	response.Code = 500
+	response.Timings.Start = baseTime.Add(2 * time.Hour)
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	search := request
+
+	tests := []struct {
+		name  string
+		query models.HistoryQuery
+		want  []int64
+	}{
+		{name: "host on any port", query: models.HistoryQuery{Host: "cdn.example.com"}, want: []int64{static.Id}},
+		{name: "host with port", query: models.HistoryQuery{Host: "cdn.example.com:8443"}, want: []int64{static.Id}},
+		{name: "host is not a prefix", query: models.HistoryQuery{Host: "example"}, want: []int64{}},
+		{name: "method", query: models.HistoryQuery{Method: "GET"}, want: []int64{static.Id}},
+		{name: "status", query: models.HistoryQuery{StatusMin: 404, StatusMax: 404}, want: []int64{static.Id}},
+		{name: "status range", query: models.HistoryQuery{StatusMin: 400, StatusMax: 599}, want: []int64{static.Id, search.Id}},
+		{name: "status from", query: models.HistoryQuery{StatusMin: 500}, want: []int64{search.Id}},
+		{name: "path", query: models.HistoryQuery{Path: "/api/"}, want: []int64{plain.Id, search.Id}},
+		{name: "path regex", query: models.HistoryQuery{PathRegex: `^/api/users/[0-9]+$`}, want: []int64{plain.Id}},
+		{name: "content type", query: models.HistoryQuery{ContentType: "javascript"}, want: []int64{static.Id}},
+		{name: "since", query: models.HistoryQuery{Since: baseTime.Add(time.Hour)}, want: []int64{static.Id, search.Id}},
+		{name: "until is exclusive", query: models.HistoryQuery{Until: baseTime.Add(2 * time.Hour)}, want: []int64{plain.Id, static.Id}},
+		{name: "decoded body", query: models.HistoryQuery{BodyContains: []byte("needle")}, want: []int64{search.Id}},
+		{name: "response body", query: models.HistoryQuery{BodyContains: []byte("ok")}, want: []int64{plain.Id, static.Id, search.Id}},
+		{name: "client address", query: models.HistoryQuery{ClientAddr: "192.0.2.10:51234"}, want: []int64{plain.Id, search.Id}},
+		{name: "client ip", query: models.HistoryQuery{ClientAddr: "2001:db8::1"}, want: []int64{static.Id}},
+		{name: "client ip is not a prefix", query: models.HistoryQuery{ClientAddr: "192.0.2.1"}, want: []int64{}},
+		{name: "listener", query: models.HistoryQuery{Listener: models.ListenerSOCKS5}, want: []int64{static.Id}},
+		{name: "sni", query: models.HistoryQuery{SNI: "cdn.example.com"}, want: []int64{static.Id}},
+		{name: "proto", query: models.HistoryQuery{Proto: "HTTP/2.0"}, want: []int64{static.Id}},
+		{name: "connection", query: models.HistoryQuery{ConnectionId: "tunnel42"}, want: []int64{static.Id}},
+		{name: "request id", query: models.HistoryQuery{ReqId: "upstream-7f3a"}, want: []int64{static.Id}},
+		{name: "filters combine", query: models.HistoryQuery{Path: "/api/", StatusMin: 200, StatusMax: 299}, want: []int64{plain.Id}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHistory(t, repo, tt.query, tt.want)
+		})
+	}
+}
+
+func testHistoryPages(t *testing.T, repo IRepository) {
+	var ids []int64
+	for _, total := range []float64{40, 10, 40, 30, 20} {
+		request, _ := saveExchange(t, repo, "/page", total)
+		ids = append(ids, request.Id)
+	}
+
+	tests := []struct {
+		query models.HistoryQuery
+		want  []int64
+	}{
+		{query: models.HistoryQuery{}, want: ids},
+		{query: models.HistoryQuery{Descending: true}, want: []int64{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{query: models.HistoryQuery{SortBy: models.SortByLatency}, want: []int64{ids[1], ids[4], ids[3], ids[0], ids[2]}},
+		{query: models.HistoryQuery{SortBy: models.SortByLatency, Descending: true}, want: []int64{ids[2], ids[0], ids[3], ids[4], ids[1]}},
+	}
+
+	for _, tt := range tests {
+		query := tt.query
+		query.Limit = 2
+
+		var got []int64
+		for pages := 0; pages < 5; pages++ {
+			want := tt.want[len(got):min(len(got)+2, len(tt.want))]
+			page := checkHistory(t, repo, query, want)
+			for _, requestData := range page {
+				got = append(got, requestData.Request.Id)
+			}
+
+			if query.After = query.NextCursor(page); query.After == nil {
+				break
+			}
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%+v: paged through %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func testSearch(t *testing.T, repo IRepository) {
+	profile, _ := saveExchange(t, repo, "/profile", 10)
+
+	request := newRequest("/login")
+	request.Host = "auth.example.com"
+	request.Headers = map[string][]string{"Authorization": {"Bearer leak@example.com"}}
+	request.CreatedAt = baseTime.Add(time.Hour)
+	if err := repo.InsertRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	response := newResponse(request.Id, 20)
+	response.Headers = map[string][]string{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}
+	response.Body = gzipped(t, []byte("welcome back leak@example.com, your order shipped"))
+	response.Timings.Start = baseTime.Add(time.Hour)
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	login := request
+
+	avatar := newRequest("/avatar")
+	if err := repo.InsertRequest(avatar); err != nil {
+		t.Fatal(err)
+	}
+	response = newResponse(avatar.Id, 30)
+	response.Headers = map[string][]string{"Content-Type": {"image/png"}}
+	response.Body = []byte("\x89PNG leak@example.com \xff\xfe")
+	if err := repo.InsertResponse(response); err != nil {
+		t.Fatal(err)
+	}
+
+	// a request that never got a response is searched as well
+	pending := newRequest("/pending")
+	pending.Body = []byte(`{"email":"leak@example.com"}`)
+	if err := repo.InsertRequest(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query models.SearchQuery
+		want  map[int64][]string
+	}{
+		{
+			name:  "text across parts",
+			query: models.SearchQuery{Text: "LEAK@example.com"},
+			want: map[int64][]string{
+				pending.Id: {models.SearchPartRequestBody},
+				login.Id:   {models.SearchPartRequestHeaders, models.SearchPartResponseBody},
+			},
+		},
+		{
+			name:  "every word in one part",
+			query: models.SearchQuery{Text: "order shipped"},
+			want:  map[int64][]string{login.Id: {models.SearchPartResponseBody}},
+		},
+		{
+			name:  "words split over parts",
+			query: models.SearchQuery{Text: "proxy shipped"},
+			want:  map[int64][]string{},
+		},
+		{
+			name:  "host",
+			query: models.SearchQuery{Text: "leak@example.com", Host: "auth.example.com"},
+			want:  map[int64][]string{login.Id: {models.SearchPartRequestHeaders, models.SearchPartResponseBody}},
+		},
+		{
+			name:  "time range",
+			query: models.SearchQuery{Text: "proxy", Until: baseTime.Add(time.Hour)},
+			want:  map[int64][]string{profile.Id: {models.SearchPartRequestBody}, avatar.Id: {models.SearchPartRequestBody}},
+		},
+		{
+			name:  "regex",
+			query: models.SearchQuery{Text: `order[[:space:]]+ship`, Mode: models.SearchRegex},
+			want:  map[int64][]string{login.Id: {models.SearchPartResponseBody}},
+		},
+		{
+			name:  "limit keeps the newest",
+			query: models.SearchQuery{Text: "proxy", Limit: 1},
+			want:  map[int64][]string{avatar.Id: {models.SearchPartRequestBody}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := repo.Search(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != len(tt.want) {
+				t.Fatalf("%d results, want %d: %+v", len(results), len(tt.want), results)
+			}
+
+			for i, result := range results {
+				if i > 0 && result.RequestId > results[i-1].RequestId {
+					t.Errorf("result %d is newer than the one before it", result.RequestId)
+				}
+
+				parts, ok := tt.want[result.RequestId]
+				if !ok {
+					t.Errorf("request %d matched: %+v", result.RequestId, result.Matches)
+					continue
+				}
+
+				if len(result.Matches) != len(parts) {
+					t.Errorf("request %d matched in %+v, want %v", result.RequestId, result.Matches, parts)
+					continue
+				}
+				for j, match := range result.Matches {
+					if match.Part != parts[j] || !strings.Contains(match.Snippet, models.SnippetStart) {
+						t.Errorf("request %d match %d = %+v, want a marked snippet of %s", result.RequestId, j, match, parts[j])
+					}
+				}
+			}
+		})
+	}
+
+	results, err := repo.Search(models.SearchQuery{Text: "leak@example.com", Host: "auth.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 1 && !strings.Contains(results[0].Matches[1].Snippet, models.SnippetStart+"leak@example.com"+models.SnippetStop) {
+		t.Errorf("snippet %q does not mark the address", results[0].Matches[1].Snippet)
+	}
+}
+
+func testStoredCopies(t *testing.T, repo IRepository) {
+	request, response := saveExchange(t, repo, "/copies", 1)
+
+	request.Body[0] = 'X'
+	request.Headers["Content-Type"][0] = "changed"
+	response.Body[0] = 'X'
+
+	stored, err := repo.GetRequestDataById(request.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Request.Body[0] == 'X' || stored.Request.Headers["Content-Type"][0] == "changed" || stored.Response.Body[0] == 'X' {
+		t.Error("changing a saved record changed the stored one")
+	}
+
+	stored.Request.Path = "/changed"
+	again, err := repo.GetRequestDataById(request.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Request.Path != "/copies" {
+		t.Error("changing a read record changed the stored one")
+	}
+}
+
+func testWebSocketMessages(t *testing.T, repo IRepository) {
+	request, _ := saveExchange(t, repo, "/socket", 1)
+	other, _ := saveExchange(t, repo, "/other", 1)
+
+	messages := []*models.WebSocketMessage{
+		{RequestId: request.Id, Direction: models.DirectionClient, Opcode: 1, Time: baseTime, Payload: []byte("hello")},
+		{RequestId: other.Id, Direction: models.DirectionClient, Opcode: 1, Time: baseTime, Payload: []byte("elsewhere")},
+		{RequestId: request.Id, Direction: models.DirectionServer, Opcode: 2, Time: baseTime.Add(time.Second), Payload: []byte{0, 1}},
+	}
+	for _, message := range messages {
+		if err := repo.InsertWebSocketMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := repo.GetWebSocketMessages(request.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 2 {
+		t.Fatalf("stored %d messages for the request, want 2", len(stored))
+	}
+
+	for i, want := range []*models.WebSocketMessage{messages[0], messages[2]} {
+		got := stored[i]
+		if got.Id != want.Id || got.Direction != want.Direction || got.Opcode != want.Opcode ||
+			!got.Time.Equal(want.Time) || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("message %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	none, err := repo.GetWebSocketMessages(request.Id + 1000)
+	if err != nil || len(none) != 0 {
+		t.Errorf("messages of a missing request = %v, %v, want none", none, err)
+	}
+}
+
+func testTLSEvents(t *testing.T, repo IRepository) {
+	events := []*models.TLSEvent{
+		{Host: "pinned.example", Kind: models.TLSEventHandshakeFailed, ConnectionId: "c1", Detail: "bad certificate", Time: baseTime},
+		{Host: "pinned.example", Kind: models.TLSEventPassthroughAdded, ConnectionId: "c2", Detail: "pinning", Time: baseTime.Add(time.Second)},
+	}
+	for _, event := range events {
+		if err := repo.InsertTLSEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := repo.GetTLSEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != len(events) {
+		t.Fatalf("stored %d events, want %d", len(stored), len(events))
+	}
+
+	for i, want := range events {
+		got := stored[i]
+		if got.Id != want.Id || got.Host != want.Host || got.Kind != want.Kind || got.ConnectionId != want.ConnectionId ||
+			got.Detail != want.Detail || !got.Time.Equal(want.Time) {
+			t.Errorf("event %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestMemoryRepository(t *testing.T) {
+	runConformance(t, func(t *testing.T) IRepository {
+		return NewMemoryRepository()
+	})
+}
+
+func TestFileRepository(t *testing.T) {
+	runConformance(t, func(t *testing.T) IRepository {
+		repo, err := NewFileRepository(filepath.Join(t.TempDir(), "history.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+
+		return repo
+	})
+}
+
+func TestFileRepositoryReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+
+	repo, err := NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := saveExchange(t, repo, "/kept", 5)
+	if err = repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves half a record behind
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"kind":"request","request":{"id":`)
+	file.Close()
+
+	repo, err = NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	stored, err := repo.GetRequestDataById(request.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRequest(t, &stored.Request, request)
+
+	next, _ := saveExchange(t, repo, "/next", 5)
+	if next.Id != request.Id+1 {
+		t.Errorf("id after reopening = %d, want %d", next.Id, request.Id+1)
+	}
+
+	history, err := repo.GetAllRequestsData(models.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("history holds %d exchanges after reopening, want 2", len(history))
+	}
+}
+
+func TestFileRepositoryReadsOnlyThePage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+
+	repo, err := NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	saveExchange(t, repo, "/oldest", 5)
+	saveExchange(t, repo, "/middle", 10)
+	newest, _ := saveExchange(t, repo, "/newest", 15)
+
+	// the oldest request no longer decodes, only reading it can fail
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := bytes.Index(content, []byte(`"/oldest"`))
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("{"), int64(offset))
+	file.Close()
+
+	tests := []struct {
+		name  string
+		query models.HistoryQuery
+		want  []int64
+	}{
+		{name: "newest page", query: models.HistoryQuery{Descending: true, Limit: 2}, want: []int64{newest.Id, newest.Id - 1}},
+		{name: "slowest by latency", query: models.HistoryQuery{SortBy: models.SortByLatency, Descending: true, Limit: 1}, want: []int64{newest.Id}},
+		{name: "indexed filter", query: models.HistoryQuery{Host: "example.com", StatusMin: 200, Since: baseTime, Limit: 1, Descending: true}, want: []int64{newest.Id}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHistory(t, repo, tt.query, tt.want)
+		})
+	}
+
+	if _, err = repo.GetAllRequestsData(models.HistoryQuery{}); err == nil {
+		t.Error("listing the whole history read past the corrupt record")
+	}
+
+	results, err := repo.Search(models.SearchQuery{Text: "proxy", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].RequestId != newest.Id {
+		t.Errorf("search found %+v, want only request %d", results, newest.Id)
+	}
+}
+
+// TestPostgresRepository runs against the database of the psx config named
+// by PROXY_TEST_PSX_CONFIG. Its tables are dropped and created again, so
+// never point it at a database holding history worth keeping.
+func TestPostgresRepository(t *testing.T) {
+	cfgPath := os.Getenv("PROXY_TEST_PSX_CONFIG")
+	if cfgPath == "" {
+		t.Skip("PROXY_TEST_PSX_CONFIG is not set")
+	}
+
+	psxCfg := configs.GetWebSrvConfig(cfgPath)
+	logger := logrus.New()
+
+	runConformance(t, func(t *testing.T) IRepository {
+		repo, err := GetUserRepo(&psxCfg, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+
+		// down and up again leaves empty tables and runs every migration both ways
+		if _, err = repo.MigrateDown(math.MaxInt); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = repo.MigrateUp(); err != nil {
+			t.Fatal(err)
+		}
+
+		return repo
+	})
+}
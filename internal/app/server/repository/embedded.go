@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// The helpers below are shared by the backends that keep the history
+// themselves instead of handing it to a database.
+
+// stampCreatedAt dates a request captured without a time to when it is
+// stored.
+func stampCreatedAt(request *models.Request) {
+	if request.CreatedAt.IsZero() {
+		request.CreatedAt = time.Now()
+	}
+}
+
+// storedRequest prepares a request for storage the way the postgres backend
+// stores it, so every backend reads back the same values.
+func storedRequest(request *models.Request) models.Request {
+	stored := *request
+	stored.Headers = cloneValues(request.Headers)
+	stored.Params = cloneValues(request.Params)
+	stored.Body = notNull(bytes.Clone(request.Body))
+	stored.BodyDecoded = false
+	stored.RulesFired = notNullRules(cloneStrings(request.RulesFired))
+
+	return stored
+}
+
+func storedResponse(response *models.Response) models.Response {
+	stored := *response
+	stored.Headers = cloneValues(response.Headers)
+	stored.Body = notNull(bytes.Clone(response.Body))
+	stored.BodyDecoded = false
+	stored.RulesFired = notNullRules(cloneStrings(response.RulesFired))
+	stored.Timings.DNSStart = cloneTime(response.Timings.DNSStart)
+	stored.Timings.ConnectStart = cloneTime(response.Timings.ConnectStart)
+	stored.Timings.TLSStart = cloneTime(response.Timings.TLSStart)
+
+	return stored
+}
+
+// newRequestData joins a stored request with its response, the decoded bodies
+// replace the raw ones unless raw is set.
+func newRequestData(request models.Request, requestDecoded []byte, response models.Response, responseDecoded []byte, raw bool) *models.RequestData {
+	requestData := &models.RequestData{Request: request, Response: response}
+	if !raw {
+		useDecodedBodies(requestData, requestDecoded, responseDecoded)
+	}
+
+	return requestData
+}
+
+// selectHistory answers a history query the way GetAllRequestsData of the
+// postgres backend does: the matches in the order of the query, ties broken
+// by request id in the same direction, starting after the cursor.
+func selectHistory(history []*models.RequestData, query models.HistoryQuery) ([]*models.RequestData, error) {
+	match, err := historyFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := history[:0]
+	for _, requestData := range history {
+		if match(requestData) {
+			selected = append(selected, requestData)
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return historyLess(query, query.SortKey(selected[i]), selected[i].Request.Id, query.SortKey(selected[j]), selected[j].Request.Id)
+	})
+
+	if query.After != nil {
+		start := sort.Search(len(selected), func(i int) bool {
+			return historyLess(query, query.After.Key, query.After.Id, query.SortKey(selected[i]), selected[i].Request.Id)
+		})
+		selected = selected[start:]
+	}
+
+	if query.Limit > 0 && len(selected) > query.Limit {
+		selected = selected[:query.Limit]
+	}
+
+	return selected, nil
+}
+
+// exchangeView is an exchange as the embedded backends search it, with the
+// decoded bodies in place and a nil response while it has none.
+type exchangeView struct {
+	request  models.Request
+	response *models.Response
+}
+
+// searchExchanges answers a search the way Search of the postgres backend
+// does, newest exchange first. A backend that hands in views with the request
+// summary only passes load, it is called once an exchange passed the host and
+// time filters and has to fill the view in.
+func searchExchanges(exchanges []exchangeView, query models.SearchQuery, load func(*exchangeView) error) ([]*models.SearchResult, error) {
+	s, err := newSearcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(exchanges, func(i, j int) bool {
+		return exchanges[i].request.Id > exchanges[j].request.Id
+	})
+
+	host := strings.ToLower(query.Host)
+
+	var results []*models.SearchResult
+	for i := range exchanges {
+		exchange := &exchanges[i]
+		if host != "" && !matchHost(exchange.request.Host, host) {
+			continue
+		}
+
+		if !inTimeRange(exchange.request.CreatedAt, query.Since, query.Until) {
+			continue
+		}
+
+		if load != nil {
+			if err = load(exchange); err != nil {
+				return nil, err
+			}
+		}
+
+		matches := s.searchParts(&exchange.request, exchange.response)
+		if len(matches) == 0 {
+			continue
+		}
+
+		results = append(results, &models.SearchResult{RequestId: exchange.request.Id, Matches: matches})
+		if query.Limit > 0 && len(results) == query.Limit {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+func historyLess(query models.HistoryQuery, aKey float64, aId int64, bKey float64, bId int64) bool {
+	if aKey == bKey {
+		if query.Descending {
+			return aId > bId
+		}
+		return aId < bId
+	}
+
+	if query.Descending {
+		return aKey > bKey
+	}
+	return aKey < bKey
+}
+
+// historyFilter matches exchanges against the filters of a history query,
+// the bodies of the exchanges have to be the decoded ones.
+func historyFilter(query models.HistoryQuery) (func(requestData *models.RequestData) bool, error) {
+	var pathRegex *regexp.Regexp
+	if query.PathRegex != "" {
+		var err error
+		if pathRegex, err = regexp.CompilePOSIX(query.PathRegex); err != nil {
+			return nil, fmt.Errorf("path regex: %w", err)
+		}
+	}
+
+	host := strings.ToLower(query.Host)
+	contentType := strings.ToLower(query.ContentType)
+
+	return func(requestData *models.RequestData) bool {
+		request, response := &requestData.Request, &requestData.Response
+
+		switch {
+		case host != "" && !matchHost(request.Host, host):
+		case query.Method != "" && request.Method != query.Method:
+		case query.StatusMin > 0 && response.Code < query.StatusMin:
+		case query.StatusMax > 0 && response.Code > query.StatusMax:
+		case query.Path != "" && !strings.Contains(request.Path, query.Path):
+		case pathRegex != nil && !pathRegex.MatchString(request.Path):
+		case contentType != "" && !strings.Contains(strings.ToLower(firstValue(response.Headers, "Content-Type")), contentType):
+		case query.ClientAddr != "" && !matchAddr(request.ClientAddr, query.ClientAddr):
+		case query.Listener != "" && request.Listener != query.Listener:
+		case query.SNI != "" && !strings.EqualFold(request.SNI, query.SNI):
+		case query.Proto != "" && request.Proto != query.Proto:
+		case query.ConnectionId != "" && request.ConnectionId != query.ConnectionId:
+		case query.ReqId != "" && request.ReqId != query.ReqId:
+		case !inTimeRange(request.CreatedAt, query.Since, query.Until):
+		case len(query.BodyContains) > 0 &&
+			!bytes.Contains(request.Body, query.BodyContains) && !bytes.Contains(response.Body, query.BodyContains):
+		default:
+			return true
+		}
+
+		return false
+	}, nil
+}
+
+// matchAddr compares a stored address with a filter, a filter without a
+// port matches the address on every port.
+func matchAddr(stored, addr string) bool {
+	return stored == addr || strings.HasPrefix(stored, addr+":") || strings.HasPrefix(stored, "["+addr+"]:")
+}
+
+// inTimeRange reports whether t lies in [since, until), zero bounds are open.
+func inTimeRange(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || t.Before(until))
+}
+
+// matchHost compares a stored host with a lower case filter, a filter
+// without a port matches the host on every port.
+func matchHost(stored, host string) bool {
+	stored = strings.ToLower(stored)
+	return stored == host || strings.HasPrefix(stored, host+":")
+}
+
+func firstValue(values map[string][]string, key string) string {
+	if len(values[key]) == 0 {
+		return ""
+	}
+
+	return values[key][0]
+}
+
+func cloneValues(values map[string][]string) map[string][]string {
+	if values == nil {
+		return nil
+	}
+
+	cloned := make(map[string][]string, len(values))
+	for key, value := range values {
+		cloned[key] = cloneStrings(value)
+	}
+
+	return cloned
+}
+
+func cloneStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	return append([]string{}, values...)
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	cloned := *t
+	return &cloned
+}
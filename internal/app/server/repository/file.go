@@ -0,0 +1,532 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+const (
+	recordRequest          = "request"
+	recordResponse         = "response"
+	recordWebSocketMessage = "websocket_message"
+	recordTLSEvent         = "tls_event"
+)
+
+// The record types drop the JSON methods of the models, those render bodies
+// for the api and do not read back.
+type (
+	requestRecord  models.Request
+	responseRecord models.Response
+	messageRecord  models.WebSocketMessage
+	tlsEventRecord models.TLSEvent
+)
+
+// fileRecord is one line of the history log. Decoded holds the decoded body
+// of a request or response, null when the body was not encoded.
+type fileRecord struct {
+	Kind     string          `json:"kind"`
+	Request  *requestRecord  `json:"request,omitempty"`
+	Response *responseRecord `json:"response,omitempty"`
+	Decoded  []byte          `json:"decoded"`
+	Message  *messageRecord  `json:"message,omitempty"`
+	Event    *tlsEventRecord `json:"event,omitempty"`
+}
+
+type recordIds struct {
+	Id        int64 `json:"id"`
+	RequestId int64 `json:"request_id"`
+}
+
+// recordSummary is the part of a request or response record the history is
+// listed by: the ids, host, method, code, capture time and the timings the
+// history sorts by.
+type recordSummary struct {
+	Id        int64     `json:"id"`
+	RequestId int64     `json:"request_id"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	CreatedAt time.Time `json:"created_at"`
+	Code      int       `json:"code"`
+	Timings   struct {
+		FirstByte float64 `json:"ttfb_ms"`
+		Total     float64 `json:"total_ms"`
+	} `json:"timings"`
+}
+
+// fileRecordHeader is the part of a record the index is built from, bodies
+// are skipped while the log is opened.
+type fileRecordHeader struct {
+	Kind     string         `json:"kind"`
+	Request  *recordSummary `json:"request"`
+	Response *recordSummary `json:"response"`
+	Message  *recordIds     `json:"message"`
+	Event    *recordIds     `json:"event"`
+}
+
+type recordRef struct {
+	offset int64
+	length int64
+}
+
+// FileRepository keeps the history in a single append-only log of JSON lines
+// and needs nothing but a writable path. Only the index of where each record
+// starts and the summaries of the exchanges live in memory, they are rebuilt
+// from the log when the file is opened. Listing and searching the history
+// filter and sort on the summaries and read just the records they return.
+type FileRepository struct {
+	mu             sync.RWMutex
+	file           *os.File
+	size           int64
+	requests       map[int64]recordRef
+	responses      map[int64]recordRef
+	summaries      map[int64]*models.RequestData
+	messages       map[int64][]recordRef
+	events         []recordRef
+	lastRequestId  int64
+	lastResponseId int64
+	lastMessageId  int64
+	lastEventId    int64
+	// decodeLimit caps the decoded copies of bodies, see decoder.Decode.
+	decodeLimit int64
+}
+
+func NewFileRepository(path string) (*FileRepository, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("history log dir: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open history log: %w", err)
+	}
+
+	r := &FileRepository{
+		file:      file,
+		requests:  make(map[int64]recordRef),
+		responses: make(map[int64]recordRef),
+		summaries: make(map[int64]*models.RequestData),
+		messages:  make(map[int64][]recordRef),
+	}
+
+	if err = r.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("history log %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+// load indexes every record of the log. A record cut short by a crash while
+// it was written can only be the last one and is dropped.
+func (r *FileRepository) load() error {
+	reader := bufio.NewReader(r.file)
+
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err = r.file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var header fileRecordHeader
+		if err = json.Unmarshal(line, &header); err != nil {
+			return fmt.Errorf("corrupt record at offset %d: %w", offset, err)
+		}
+
+		if err = r.index(header, recordRef{offset: offset, length: int64(len(line))}); err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+
+		offset += int64(len(line))
+	}
+
+	r.size = offset
+	return nil
+}
+
+func (r *FileRepository) index(header fileRecordHeader, ref recordRef) error {
+	switch {
+	case header.Kind == recordRequest && header.Request != nil:
+		request := header.Request
+		r.requests[request.Id] = ref
+		r.summaries[request.Id] = &models.RequestData{Request: models.Request{
+			Id:        request.Id,
+			Method:    request.Method,
+			Host:      request.Host,
+			CreatedAt: request.CreatedAt,
+		}}
+		r.lastRequestId = max(r.lastRequestId, request.Id)
+	case header.Kind == recordResponse && header.Response != nil:
+		response := header.Response
+		summary, ok := r.summaries[response.RequestId]
+		if !ok {
+			return fmt.Errorf("response %d of unknown request %d", response.Id, response.RequestId)
+		}
+
+		r.responses[response.RequestId] = ref
+		summary.Response = models.Response{
+			Id:        response.Id,
+			RequestId: response.RequestId,
+			Code:      response.Code,
+			Timings:   models.Timings{FirstByte: response.Timings.FirstByte, Total: response.Timings.Total},
+		}
+		r.lastResponseId = max(r.lastResponseId, response.Id)
+	case header.Kind == recordWebSocketMessage && header.Message != nil:
+		r.messages[header.Message.RequestId] = append(r.messages[header.Message.RequestId], ref)
+		r.lastMessageId = max(r.lastMessageId, header.Message.Id)
+	case header.Kind == recordTLSEvent && header.Event != nil:
+		r.events = append(r.events, ref)
+		r.lastEventId = max(r.lastEventId, header.Event.Id)
+	default:
+		return fmt.Errorf("unknown record kind %q", header.Kind)
+	}
+
+	return nil
+}
+
+// append writes one record at the end of the log, a failed write is cut off
+// again so the next record does not follow half a line.
+func (r *FileRepository) append(record *fileRecord) (recordRef, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return recordRef{}, err
+	}
+	line = append(line, '\n')
+
+	if _, err = r.file.WriteAt(line, r.size); err != nil {
+		r.file.Truncate(r.size)
+		return recordRef{}, err
+	}
+
+	ref := recordRef{offset: r.size, length: int64(len(line))}
+	r.size += ref.length
+	return ref, nil
+}
+
+func (r *FileRepository) read(ref recordRef) (*fileRecord, error) {
+	line := make([]byte, ref.length)
+	if _, err := r.file.ReadAt(line, ref.offset); err != nil {
+		return nil, err
+	}
+
+	record := &fileRecord{}
+	if err := json.Unmarshal(line, record); err != nil {
+		return nil, fmt.Errorf("corrupt record at offset %d: %w", ref.offset, err)
+	}
+
+	return record, nil
+}
+
+func (r *FileRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.file.Sync(); err != nil {
+		r.file.Close()
+		return err
+	}
+
+	return r.file.Close()
+}
+
+func (r *FileRepository) InsertRequest(request *models.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stampCreatedAt(request)
+	decoded, decodedTruncated := decodedBody(request.Body, request.Headers, request.BodyTruncated, r.decodeLimit)
+	request.DecodedTruncated = decodedTruncated
+
+	stored := storedRequest(request)
+	stored.Id = r.lastRequestId + 1
+
+	ref, err := r.append(&fileRecord{
+		Kind:    recordRequest,
+		Request: (*requestRecord)(&stored),
+		Decoded: decoded,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.index(fileRecordHeader{Kind: recordRequest, Request: &recordSummary{
+		Id:        stored.Id,
+		Host:      stored.Host,
+		Method:    stored.Method,
+		CreatedAt: stored.CreatedAt,
+	}}, ref)
+	request.Id = stored.Id
+
+	return nil
+}
+
+func (r *FileRepository) InsertResponse(response *models.Response) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.requests[response.RequestId]; !ok {
+		return fmt.Errorf("insert response: request %d does not exist", response.RequestId)
+	}
+
+	decoded, decodedTruncated := decodedBody(response.Body, response.Headers, response.BodyTruncated, r.decodeLimit)
+	response.DecodedTruncated = decodedTruncated
+
+	stored := storedResponse(response)
+	stored.Id = r.lastResponseId + 1
+
+	ref, err := r.append(&fileRecord{
+		Kind:     recordResponse,
+		Response: (*responseRecord)(&stored),
+		Decoded:  decoded,
+	})
+	if err != nil {
+		return err
+	}
+
+	summary := &recordSummary{Id: stored.Id, RequestId: stored.RequestId, Code: stored.Code}
+	summary.Timings.FirstByte, summary.Timings.Total = stored.Timings.FirstByte, stored.Timings.Total
+	r.index(fileRecordHeader{Kind: recordResponse, Response: summary}, ref)
+	response.Id = stored.Id
+
+	return nil
+}
+
+func (r *FileRepository) GetRequestById(id int64) (*models.Request, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ref, ok := r.requests[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	record, err := r.read(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*models.Request)(record.Request), nil
+}
+
+func (r *FileRepository) GetRequestDataById(id int64, raw bool) (*models.RequestData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.requestData(id, raw)
+}
+
+func (r *FileRepository) requestData(id int64, raw bool) (*models.RequestData, error) {
+	requestRef, ok := r.requests[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	responseRef, ok := r.responses[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	request, err := r.read(requestRef)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := r.read(responseRef)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRequestData(models.Request(*request.Request), request.Decoded, models.Response(*response.Response), response.Decoded, raw), nil
+}
+
+func (r *FileRepository) GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	match, err := historyFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]*models.RequestData, 0, len(r.responses))
+	for id := range r.responses {
+		summaries = append(summaries, r.summaries[id])
+	}
+
+	// the summaries answer the indexed filters and the order, the records are
+	// read in that order until the page is full
+	candidates, err := selectHistory(summaries, indexedHistoryQuery(query))
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []*models.RequestData
+	for _, summary := range candidates {
+		if query.Limit > 0 && len(requests) == query.Limit {
+			break
+		}
+
+		requestData, err := r.requestData(summary.Request.Id, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if match(requestData) {
+			requests = append(requests, requestData)
+		}
+	}
+
+	return requests, nil
+}
+
+// indexedHistoryQuery keeps the filters, order and cursor of query the
+// summaries of the file backend can answer on their own.
+func indexedHistoryQuery(query models.HistoryQuery) models.HistoryQuery {
+	return models.HistoryQuery{
+		SortBy:     query.SortBy,
+		Descending: query.Descending,
+		Host:       query.Host,
+		Method:     query.Method,
+		StatusMin:  query.StatusMin,
+		StatusMax:  query.StatusMax,
+		Since:      query.Since,
+		Until:      query.Until,
+		After:      query.After,
+	}
+}
+
+func (r *FileRepository) Search(query models.SearchQuery) ([]*models.SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exchanges := make([]exchangeView, 0, len(r.summaries))
+	for _, summary := range r.summaries {
+		exchanges = append(exchanges, exchangeView{request: summary.Request})
+	}
+
+	return searchExchanges(exchanges, query, r.loadExchange)
+}
+
+// loadExchange reads the records of an exchange a search got to, view only
+// holds the summary of its request until then.
+func (r *FileRepository) loadExchange(view *exchangeView) error {
+	id := view.request.Id
+	request, err := r.read(r.requests[id])
+	if err != nil {
+		return err
+	}
+
+	var response models.Response
+	var responseDecoded []byte
+	responseRef, hasResponse := r.responses[id]
+	if hasResponse {
+		record, err := r.read(responseRef)
+		if err != nil {
+			return err
+		}
+
+		response, responseDecoded = models.Response(*record.Response), record.Decoded
+	}
+
+	requestData := newRequestData(models.Request(*request.Request), request.Decoded, response, responseDecoded, false)
+	view.request, view.response = requestData.Request, nil
+	if hasResponse {
+		view.response = &requestData.Response
+	}
+
+	return nil
+}
+
+func (r *FileRepository) InsertWebSocketMessage(message *models.WebSocketMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.requests[message.RequestId]; !ok {
+		return fmt.Errorf("insert websocket message: request %d does not exist", message.RequestId)
+	}
+
+	stored := *message
+	stored.Id = r.lastMessageId + 1
+	stored.Payload = notNull(message.Payload)
+
+	ref, err := r.append(&fileRecord{Kind: recordWebSocketMessage, Message: (*messageRecord)(&stored)})
+	if err != nil {
+		return err
+	}
+
+	r.lastMessageId = stored.Id
+	r.messages[stored.RequestId] = append(r.messages[stored.RequestId], ref)
+	message.Id = stored.Id
+
+	return nil
+}
+
+func (r *FileRepository) GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	messages := make([]*models.WebSocketMessage, 0, len(r.messages[requestId]))
+	for _, ref := range r.messages[requestId] {
+		record, err := r.read(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, (*models.WebSocketMessage)(record.Message))
+	}
+
+	return messages, nil
+}
+
+func (r *FileRepository) InsertTLSEvent(event *models.TLSEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := *event
+	stored.Id = r.lastEventId + 1
+
+	ref, err := r.append(&fileRecord{Kind: recordTLSEvent, Event: (*tlsEventRecord)(&stored)})
+	if err != nil {
+		return err
+	}
+
+	r.lastEventId = stored.Id
+	r.events = append(r.events, ref)
+	event.Id = stored.Id
+
+	return nil
+}
+
+func (r *FileRepository) GetTLSEvents() ([]*models.TLSEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := make([]*models.TLSEvent, 0, len(r.events))
+	for _, ref := range r.events {
+		record, err := r.read(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, (*models.TLSEvent)(record.Event))
+	}
+
+	return events, nil
+}
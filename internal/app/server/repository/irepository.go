@@ -1,11 +1,23 @@
 package repository
 
-import "github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+import (
+	"errors"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+var ErrNotFound = errors.New("record not found")
 
 type IRepository interface {
-	GetAllRequestsData() ([]*models.RequestData, error)
+	GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error)
+	Search(query models.SearchQuery) ([]*models.SearchResult, error)
 	GetRequestById(id int64) (*models.Request, error)
-	GetRequestDataById(id int64) (*models.RequestData, error)
+	GetRequestDataById(id int64, raw bool) (*models.RequestData, error)
 	InsertRequest(request *models.Request) error
 	InsertResponse(response *models.Response) error
+	InsertWebSocketMessage(message *models.WebSocketMessage) error
+	GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error)
+	InsertTLSEvent(event *models.TLSEvent) error
+	GetTLSEvents() ([]*models.TLSEvent, error)
+	Close() error
 }
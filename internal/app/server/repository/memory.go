@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+type memoryExchange struct {
+	request         models.Request
+	requestDecoded  []byte
+	response        *models.Response
+	responseDecoded []byte
+}
+
+// MemoryRepository keeps the history in process memory only, it is meant for
+// tests and for short sessions that do not need to outlive the proxy.
+type MemoryRepository struct {
+	mu             sync.RWMutex
+	exchanges      map[int64]*memoryExchange
+	messages       map[int64][]*models.WebSocketMessage
+	events         []*models.TLSEvent
+	lastRequestId  int64
+	lastResponseId int64
+	lastMessageId  int64
+	lastEventId    int64
+	// decodeLimit caps the decoded copies of bodies, see decoder.Decode.
+	decodeLimit int64
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		exchanges: make(map[int64]*memoryExchange),
+		messages:  make(map[int64][]*models.WebSocketMessage),
+	}
+}
+
+func (r *MemoryRepository) Close() error {
+	return nil
+}
+
+func (r *MemoryRepository) InsertRequest(request *models.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stampCreatedAt(request)
+
+	r.lastRequestId++
+	request.Id = r.lastRequestId
+
+	decoded, decodedTruncated := decodedBody(request.Body, request.Headers, request.BodyTruncated, r.decodeLimit)
+	request.DecodedTruncated = decodedTruncated
+
+	r.exchanges[request.Id] = &memoryExchange{
+		request:        storedRequest(request),
+		requestDecoded: decoded,
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) InsertResponse(response *models.Response) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exchange, ok := r.exchanges[response.RequestId]
+	if !ok {
+		return fmt.Errorf("insert response: request %d does not exist", response.RequestId)
+	}
+
+	r.lastResponseId++
+	response.Id = r.lastResponseId
+
+	decoded, decodedTruncated := decodedBody(response.Body, response.Headers, response.BodyTruncated, r.decodeLimit)
+	response.DecodedTruncated = decodedTruncated
+
+	stored := storedResponse(response)
+	exchange.response = &stored
+	exchange.responseDecoded = decoded
+
+	return nil
+}
+
+func (r *MemoryRepository) GetRequestById(id int64) (*models.Request, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exchange, ok := r.exchanges[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	request := storedRequest(&exchange.request)
+	return &request, nil
+}
+
+func (r *MemoryRepository) GetRequestDataById(id int64, raw bool) (*models.RequestData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exchange, ok := r.exchanges[id]
+	if !ok || exchange.response == nil {
+		return nil, ErrNotFound
+	}
+
+	return exchange.requestData(raw), nil
+}
+
+func (r *MemoryRepository) GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var requests []*models.RequestData
+	for _, exchange := range r.exchanges {
+		if exchange.response != nil {
+			requests = append(requests, exchange.requestData(false))
+		}
+	}
+
+	return selectHistory(requests, query)
+}
+
+func (r *MemoryRepository) Search(query models.SearchQuery) ([]*models.SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exchanges := make([]exchangeView, 0, len(r.exchanges))
+	for _, exchange := range r.exchanges {
+		// searching only reads, the stored values need no copies
+		var response models.Response
+		if exchange.response != nil {
+			response = *exchange.response
+		}
+
+		requestData := newRequestData(exchange.request, exchange.requestDecoded, response, exchange.responseDecoded, false)
+		view := exchangeView{request: requestData.Request}
+		if exchange.response != nil {
+			view.response = &requestData.Response
+		}
+
+		exchanges = append(exchanges, view)
+	}
+
+	return searchExchanges(exchanges, query, nil)
+}
+
+func (e *memoryExchange) requestData(raw bool) *models.RequestData {
+	return newRequestData(storedRequest(&e.request), bytes.Clone(e.requestDecoded),
+		storedResponse(e.response), bytes.Clone(e.responseDecoded), raw)
+}
+
+func (r *MemoryRepository) InsertWebSocketMessage(message *models.WebSocketMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exchanges[message.RequestId]; !ok {
+		return fmt.Errorf("insert websocket message: request %d does not exist", message.RequestId)
+	}
+
+	r.lastMessageId++
+	message.Id = r.lastMessageId
+
+	stored := *message
+	stored.Payload = notNull(bytes.Clone(message.Payload))
+	r.messages[message.RequestId] = append(r.messages[message.RequestId], &stored)
+
+	return nil
+}
+
+func (r *MemoryRepository) GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	messages := make([]*models.WebSocketMessage, 0, len(r.messages[requestId]))
+	for _, message := range r.messages[requestId] {
+		stored := *message
+		stored.Payload = bytes.Clone(message.Payload)
+		messages = append(messages, &stored)
+	}
+
+	return messages, nil
+}
+
+func (r *MemoryRepository) InsertTLSEvent(event *models.TLSEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastEventId++
+	event.Id = r.lastEventId
+
+	stored := *event
+	r.events = append(r.events, &stored)
+
+	return nil
+}
+
+func (r *MemoryRepository) GetTLSEvents() ([]*models.TLSEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := make([]*models.TLSEvent, 0, len(r.events))
+	for _, event := range r.events {
+		stored := *event
+		events = append(events, &stored)
+	}
+
+	return events, nil
+}
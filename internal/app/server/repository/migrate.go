@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations live in migrations/ as <version>_<name>.up.sql and a matching
+// .down.sql. Each one runs inside its own transaction, so the files must not
+// contain BEGIN or COMMIT themselves.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock that keeps two processes starting
+// against the same database from applying a migration twice.
+const migrationLockKey = 7020211
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		match := migrationFileName.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named <version>_<name>.up.sql or .down.sql", name)
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %s: bad version %q", name, match[1])
+		}
+
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d %s needs both an up and a down file", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateUp applies every migration the database has not seen yet in version
+// order and returns the ones it applied.
+func (r *PostgresRepository) MigrateUp() ([]Migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		done, err := r.applyMigration(m)
+		if err != nil {
+			return applied, err
+		}
+
+		if done {
+			applied = append(applied, m)
+		}
+	}
+
+	return applied, nil
+}
+
+func (r *PostgresRepository) applyMigration(m Migration) (bool, error) {
+	done := false
+	err := r.inMigrationTx(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.Version).
+			Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+
+		if _, err := tx.Exec(m.up); err != nil {
+			return fmt.Errorf("migration %d %s up: %w", m.Version, m.Name, err)
+		}
+
+		if _, err := tx.Exec("INSERT INTO schema_migrations(version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			return err
+		}
+
+		done = true
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted. It stops early once nothing is left applied.
+func (r *PostgresRepository) MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	var reverted []Migration
+	for len(reverted) < steps {
+		var m Migration
+		err := r.inMigrationTx(func(tx *sql.Tx) error {
+			var version sql.NullInt64
+			if err := tx.QueryRow("SELECT max(version) FROM schema_migrations").Scan(&version); err != nil {
+				return err
+			}
+			if !version.Valid {
+				return nil
+			}
+
+			var ok bool
+			if m, ok = byVersion[int(version.Int64)]; !ok {
+				return fmt.Errorf("migration %d is applied but not known to this binary", version.Int64)
+			}
+
+			if _, err := tx.Exec(m.down); err != nil {
+				return fmt.Errorf("migration %d %s down: %w", m.Version, m.Name, err)
+			}
+
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, err
+		}
+
+		if m.Version == 0 {
+			break
+		}
+
+		reverted = append(reverted, m)
+	}
+
+	return reverted, nil
+}
+
+// Migrations lists every migration known to the binary together with the
+// ones only the database knows about, AppliedAt is nil while pending.
+func (r *PostgresRepository) Migrations() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[int]*MigrationStatus, len(migrations))
+	for _, m := range migrations {
+		statuses[m.Version] = &MigrationStatus{Version: m.Version, Name: m.Name}
+	}
+
+	err = r.inMigrationTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT version, name, applied_at FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var status MigrationStatus
+			var appliedAt time.Time
+			if err = rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+				return err
+			}
+
+			status.AppliedAt = &appliedAt
+			statuses[status.Version] = &status
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]MigrationStatus, 0, len(statuses))
+	for _, status := range statuses {
+		list = append(list, *status)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+
+	return list, nil
+}
+
+// inMigrationTx runs fn in a transaction holding the migration lock, with the
+// schema_migrations table in place.
+func (r *PostgresRepository) inMigrationTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version integer NOT NULL PRIMARY KEY, " +
+		"name text NOT NULL, " +
+		"applied_at timestamptz NOT NULL DEFAULT now())"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatal("no migrations are embedded")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d %s follows version %d, versions must count up from 1", m.Version, m.Name, i)
+		}
+	}
+}
+
+func TestLoadMigrationsRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_init.up.sql": {Data: []byte("CREATE TABLE a (id integer);")},
+			},
+		},
+		{
+			name: "bad file name",
+			files: fstest.MapFS{
+				"migrations/init.up.sql":   {Data: []byte("CREATE TABLE a (id integer);")},
+				"migrations/init.down.sql": {Data: []byte("DROP TABLE a;")},
+			},
+		},
+		{
+			name: "one version with two names",
+			files: fstest.MapFS{
+				"migrations/0001_init.up.sql":    {Data: []byte("CREATE TABLE a (id integer);")},
+				"migrations/0001_other.down.sql": {Data: []byte("DROP TABLE a;")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := loadMigrations(test.files); err == nil {
+				t.Error("loadMigrations accepted the migrations")
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS websocket_messages;
+DROP TABLE IF EXISTS responses;
+DROP TABLE IF EXISTS requests;
+DROP TABLE IF EXISTS tls_events;
@@ -0,0 +1,116 @@
+-- IF NOT EXISTS and the upgrade at the end let a database created by the old
+-- scripts/sql/migrations.sql take this version over without losing its
+-- history: its tables get the columns they lack and their text bodies are
+-- converted to bytea.
+CREATE TABLE IF NOT EXISTS requests (
+    id        serial NOT NULL PRIMARY KEY,
+    method    text NOT NULL,
+    scheme    text NOT NULL,
+    host      text NOT NULL,
+    path      text NOT NULL,
+    proto     text NOT NULL DEFAULT '',
+    headers   jsonb NOT NULL,
+    params   jsonb NOT NULL,
+    body      bytea NOT NULL,
+    decoded_body bytea,
+    connection_id text NOT NULL DEFAULT '',
+    rules_fired jsonb NOT NULL DEFAULT '[]'
+);
+
+CREATE TABLE IF NOT EXISTS responses (
+    id  serial NOT NULL PRIMARY KEY,
+    request_id  integer NOT NULL,
+    code integer NOT NULL,
+    message text NOT NULL,
+    proto     text NOT NULL DEFAULT '',
+    headers   jsonb NOT NULL,
+    body      bytea NOT NULL,
+    decoded_body bytea,
+    body_truncated boolean NOT NULL DEFAULT false,
+    body_length bigint NOT NULL DEFAULT 0,
+    rules_fired jsonb NOT NULL DEFAULT '[]',
+    tls_version text NOT NULL DEFAULT '',
+    tls_cipher text NOT NULL DEFAULT '',
+    tls_certificates text NOT NULL DEFAULT '',
+    started_at timestamptz NOT NULL DEFAULT now(),
+    dns_start timestamptz,
+    dns_ms double precision NOT NULL DEFAULT 0,
+    connect_start timestamptz,
+    connect_ms double precision NOT NULL DEFAULT 0,
+    tls_start timestamptz,
+    tls_ms double precision NOT NULL DEFAULT 0,
+    ttfb_ms double precision NOT NULL DEFAULT 0,
+    total_ms double precision NOT NULL DEFAULT 0,
+    conn_reused boolean NOT NULL DEFAULT false,
+
+    FOREIGN KEY (request_id) REFERENCES requests(id)
+);
+
+CREATE TABLE IF NOT EXISTS websocket_messages (
+    id  serial NOT NULL PRIMARY KEY,
+    request_id  integer NOT NULL,
+    direction text NOT NULL,
+    opcode integer NOT NULL,
+    created_at timestamptz NOT NULL,
+    payload   bytea NOT NULL,
+
+    FOREIGN KEY (request_id) REFERENCES requests(id)
+);
+
+CREATE TABLE IF NOT EXISTS tls_events (
+    id  serial NOT NULL PRIMARY KEY,
+    host text NOT NULL,
+    kind text NOT NULL,
+    connection_id text NOT NULL DEFAULT '',
+    detail text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL
+);
+
+ALTER TABLE requests
+    ADD COLUMN IF NOT EXISTS proto text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS decoded_body bytea,
+    ADD COLUMN IF NOT EXISTS connection_id text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS rules_fired jsonb NOT NULL DEFAULT '[]';
+
+ALTER TABLE responses
+    ADD COLUMN IF NOT EXISTS proto text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS decoded_body bytea,
+    ADD COLUMN IF NOT EXISTS body_truncated boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS body_length bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rules_fired jsonb NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS tls_version text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tls_cipher text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tls_certificates text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS started_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS dns_start timestamptz,
+    ADD COLUMN IF NOT EXISTS dns_ms double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS connect_start timestamptz,
+    ADD COLUMN IF NOT EXISTS connect_ms double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS tls_start timestamptz,
+    ADD COLUMN IF NOT EXISTS tls_ms double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS ttfb_ms double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS total_ms double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS conn_reused boolean NOT NULL DEFAULT false;
+
+-- The old schema stored bodies as text. Only columns that are still text are
+-- converted, so the upgrade is a no-op on a database created here.
+DO $$
+DECLARE
+    col record;
+BEGIN
+    FOR col IN
+        SELECT table_name, column_name FROM information_schema.columns
+        WHERE table_schema = current_schema()
+            AND data_type = 'text'
+            AND (table_name, column_name) IN (
+                ('requests', 'body'), ('requests', 'decoded_body'),
+                ('responses', 'body'), ('responses', 'decoded_body'),
+                ('websocket_messages', 'payload'))
+    LOOP
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN %I TYPE bytea USING convert_to(%I, ''UTF8'')',
+            col.table_name, col.column_name, col.column_name);
+    END LOOP;
+END
+$$;
+
+UPDATE responses SET body_length = octet_length(body) WHERE body_length = 0;
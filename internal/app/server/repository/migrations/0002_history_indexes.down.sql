@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS responses_ttfb_ms_idx;
+DROP INDEX IF EXISTS responses_total_ms_idx;
+DROP INDEX IF EXISTS responses_started_at_idx;
+DROP INDEX IF EXISTS responses_code_idx;
+DROP INDEX IF EXISTS requests_method_idx;
+DROP INDEX IF EXISTS requests_host_idx;
+DROP INDEX IF EXISTS websocket_messages_request_id_idx;
+DROP INDEX IF EXISTS responses_request_id_idx;
@@ -0,0 +1,11 @@
+-- The history is joined on request_id and listed by the filters and sort
+-- keys of GET /requests. text_pattern_ops serves both the exact host match
+-- and the host:port prefix match.
+CREATE INDEX IF NOT EXISTS responses_request_id_idx ON responses (request_id);
+CREATE INDEX IF NOT EXISTS websocket_messages_request_id_idx ON websocket_messages (request_id);
+CREATE INDEX IF NOT EXISTS requests_host_idx ON requests (lower(host) text_pattern_ops);
+CREATE INDEX IF NOT EXISTS requests_method_idx ON requests (method);
+CREATE INDEX IF NOT EXISTS responses_code_idx ON responses (code);
+CREATE INDEX IF NOT EXISTS responses_started_at_idx ON responses (started_at);
+CREATE INDEX IF NOT EXISTS responses_total_ms_idx ON responses (total_ms, request_id);
+CREATE INDEX IF NOT EXISTS responses_ttfb_ms_idx ON responses (ttfb_ms, request_id);
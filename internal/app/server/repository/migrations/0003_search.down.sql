@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS responses_body_search_idx;
+DROP INDEX IF EXISTS responses_headers_search_idx;
+DROP INDEX IF EXISTS requests_body_search_idx;
+DROP INDEX IF EXISTS requests_headers_search_idx;
+
+ALTER TABLE responses DROP COLUMN IF EXISTS body_text;
+ALTER TABLE requests DROP COLUMN IF EXISTS body_text;
@@ -0,0 +1,15 @@
+-- body_text is the text a body is searched by: the decoded body when it was
+-- content-encoded, NULL when it is binary. Exchanges stored before this
+-- migration have no body_text and are searched by their headers only.
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS body_text text;
+ALTER TABLE responses ADD COLUMN IF NOT EXISTS body_text text;
+
+-- The expressions have to stay the ones Search queries with.
+CREATE INDEX IF NOT EXISTS requests_headers_search_idx ON requests
+    USING gin (to_tsvector('simple', coalesce(headers::text, '')));
+CREATE INDEX IF NOT EXISTS requests_body_search_idx ON requests
+    USING gin (to_tsvector('simple', coalesce(body_text, '')));
+CREATE INDEX IF NOT EXISTS responses_headers_search_idx ON responses
+    USING gin (to_tsvector('simple', coalesce(headers::text, '')));
+CREATE INDEX IF NOT EXISTS responses_body_search_idx ON responses
+    USING gin (to_tsvector('simple', coalesce(body_text, '')));
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS requests_connection_id_idx;
+DROP INDEX IF EXISTS requests_client_addr_idx;
+DROP INDEX IF EXISTS requests_created_at_idx;
+
+ALTER TABLE requests
+    DROP COLUMN IF EXISTS sni,
+    DROP COLUMN IF EXISTS listener,
+    DROP COLUMN IF EXISTS client_addr,
+    DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,15 @@
+-- Requests stored before this migration are dated by the start of their
+-- response, the ones without a response by when the migration ran.
+ALTER TABLE requests
+    ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS client_addr text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS listener text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS sni text NOT NULL DEFAULT '';
+
+UPDATE requests r SET created_at = rp.started_at
+    FROM responses rp
+    WHERE rp.request_id = r.id;
+
+CREATE INDEX IF NOT EXISTS requests_created_at_idx ON requests (created_at);
+CREATE INDEX IF NOT EXISTS requests_client_addr_idx ON requests (client_addr text_pattern_ops);
+CREATE INDEX IF NOT EXISTS requests_connection_id_idx ON requests (connection_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS requests_req_id_idx;
+
+ALTER TABLE requests
+    DROP COLUMN IF EXISTS req_id;
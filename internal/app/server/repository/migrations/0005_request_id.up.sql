@@ -0,0 +1,6 @@
+-- Requests stored before this migration were never given an id outside the
+-- logs and keep an empty one.
+ALTER TABLE requests
+    ADD COLUMN IF NOT EXISTS req_id text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS requests_req_id_idx ON requests (req_id);
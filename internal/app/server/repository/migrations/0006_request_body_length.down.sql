@@ -0,0 +1,3 @@
+ALTER TABLE requests
+    DROP COLUMN IF EXISTS body_length,
+    DROP COLUMN IF EXISTS body_truncated;
@@ -0,0 +1,6 @@
+-- Request bodies stored before this migration were kept whole.
+ALTER TABLE requests
+    ADD COLUMN IF NOT EXISTS body_truncated boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS body_length bigint NOT NULL DEFAULT 0;
+
+UPDATE requests SET body_length = octet_length(body) WHERE body IS NOT NULL;
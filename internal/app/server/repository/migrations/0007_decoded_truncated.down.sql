@@ -0,0 +1,5 @@
+ALTER TABLE responses
+    DROP COLUMN IF EXISTS decoded_truncated;
+
+ALTER TABLE requests
+    DROP COLUMN IF EXISTS decoded_truncated;
@@ -0,0 +1,6 @@
+-- Decoded copies stored before this migration were never cut.
+ALTER TABLE requests
+    ADD COLUMN IF NOT EXISTS decoded_truncated boolean NOT NULL DEFAULT false;
+
+ALTER TABLE responses
+    ADD COLUMN IF NOT EXISTS decoded_truncated boolean NOT NULL DEFAULT false;
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+// fakeDB answers every query with rows whose columns are taken from the
+// select list of the query, so the scans of the postgres backend are checked
+// against the queries they belong to without a database.
+type fakeDB struct {
+	rows int
+	// failAfter makes the iteration fail once that many rows were read, zero
+	// ends it cleanly
+	failAfter int
+	// bodyTexts are the body_text columns of the rows, in order
+	bodyTexts []string
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: db}, nil
+}
+
+func (db *fakeDB) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake db prepares no statements")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake db runs no transactions")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	lower := strings.ToLower(query)
+	start := strings.Index(lower, "select ") + len("select ")
+	end := strings.Index(lower, " from ")
+	if start < len("select ") || end < start {
+		return nil, errors.New("fake db answers selects only")
+	}
+
+	var columns []string
+	for _, column := range strings.Split(query[start:end], ",") {
+		column = strings.TrimSpace(column)
+		if _, name, ok := strings.Cut(column, "."); ok {
+			column = name
+		}
+		columns = append(columns, column)
+	}
+
+	return &fakeRows{db: c.db, columns: columns}, nil
+}
+
+type fakeRows struct {
+	db      *fakeDB
+	columns []string
+	row     int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+// errIteration is what a fake query fails with after failAfter rows.
+var errIteration = errors.New("connection lost mid-query")
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.db.failAfter > 0 && r.row == r.db.failAfter {
+		return errIteration
+	}
+	if r.row == r.db.rows {
+		return io.EOF
+	}
+
+	r.row++
+	for i, column := range r.columns {
+		dest[i] = fakeValue(column, r.row)
+		if column == "body_text" && r.row <= len(r.db.bodyTexts) {
+			dest[i] = r.db.bodyTexts[r.row-1]
+		}
+	}
+
+	return nil
+}
+
+// fakeTimings are the timings every fake response was recorded with.
+var fakeTimings = models.Timings{Start: baseTime, DNS: 1.5, Connect: 2.5, TLS: 3.5, FirstByte: 4.5, Total: 10.5}
+
+func fakeValue(column string, row int) driver.Value {
+	switch column {
+	case "id", "request_id":
+		return int64(row)
+	case "code":
+		return int64(200)
+	case "body_length":
+		return int64(2)
+	case "started_at", "created_at", "dns_start", "connect_start", "tls_start":
+		return baseTime
+	case "dns_ms":
+		return fakeTimings.DNS
+	case "connect_ms":
+		return fakeTimings.Connect
+	case "tls_ms":
+		return fakeTimings.TLS
+	case "ttfb_ms":
+		return fakeTimings.FirstByte
+	case "total_ms":
+		return fakeTimings.Total
+	case "conn_reused", "body_truncated", "decoded_truncated":
+		return false
+	case "headers", "params":
+		return []byte(`{}`)
+	case "rules_fired":
+		return []byte(`[]`)
+	case "body":
+		return []byte("ok")
+	case "decoded_body":
+		return nil
+	default:
+		return ""
+	}
+}
+
+func checkFakeTimings(t *testing.T, got models.Timings) {
+	t.Helper()
+
+	if !got.Start.Equal(fakeTimings.Start) || got.DNSStart == nil || got.ConnectStart == nil || got.TLSStart == nil ||
+		got.DNS != fakeTimings.DNS || got.Connect != fakeTimings.Connect || got.TLS != fakeTimings.TLS ||
+		got.FirstByte != fakeTimings.FirstByte || got.Total != fakeTimings.Total {
+		t.Errorf("timings = %+v, want %+v with every start set", got, fakeTimings)
+	}
+}
+
+func TestPostgresScansTimings(t *testing.T) {
+	repo := &PostgresRepository{db: sql.OpenDB(&fakeDB{rows: 2})}
+	defer repo.db.Close()
+
+	for _, sortBy := range []string{models.SortById, models.SortByLatency, models.SortByTTFB} {
+		history, err := repo.GetAllRequestsData(models.HistoryQuery{SortBy: sortBy})
+		if err != nil {
+			t.Fatalf("sort=%s: %v", sortBy, err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("sort=%s: listed %d exchanges, want 2", sortBy, len(history))
+		}
+
+		for _, requestData := range history {
+			checkFakeTimings(t, requestData.Response.Timings)
+		}
+	}
+
+	requestData, err := repo.GetRequestDataById(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFakeTimings(t, requestData.Response.Timings)
+}
+
+func TestPostgresHistoryReportsIterationErrors(t *testing.T) {
+	repo := &PostgresRepository{db: sql.OpenDB(&fakeDB{rows: 3, failAfter: 1})}
+	defer repo.db.Close()
+
+	history, err := repo.GetAllRequestsData(models.HistoryQuery{})
+	if !errors.Is(err, errIteration) {
+		t.Fatalf("GetAllRequestsData() = %d exchanges, error %v, want %v", len(history), err, errIteration)
+	}
+}
+
+func TestPostgresRegexSearchDropsRowsWithoutSnippets(t *testing.T) {
+	// postgres matched every row, Go's regexp only the second and fourth
+	db := &fakeDB{rows: 4, bodyTexts: []string{"order", "order ships", "shipped order", "order ship"}}
+	repo := &PostgresRepository{db: sql.OpenDB(db)}
+	defer repo.db.Close()
+
+	tests := []struct {
+		limit int
+		want  []int64
+	}{
+		{limit: 0, want: []int64{2, 4}},
+		{limit: 1, want: []int64{2}},
+	}
+
+	for _, test := range tests {
+		results, err := repo.Search(models.SearchQuery{Text: "order ship", Mode: models.SearchRegex, Limit: test.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int64
+		for _, result := range results {
+			if len(result.Matches) == 0 {
+				t.Errorf("limit %d: result %d has no matches", test.limit, result.RequestId)
+			}
+			got = append(got, result.RequestId)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("limit %d: results %v, want %v", test.limit, got, test.want)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package repository
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"unicode/utf8"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/JuFnd/go-proxy/configs"
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/decoder"
 	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
 
 	_ "github.com/jackc/pgx/stdlib"
@@ -16,6 +19,8 @@ import (
 
 type PostgresRepository struct {
 	db *sql.DB
+	// decodeLimit caps the decoded copies of bodies, see decoder.Decode.
+	decodeLimit int64
 }
 
 func GetUserRepo(config *configs.WebConfig, lg *logrus.Logger) (*PostgresRepository, error) {
@@ -37,6 +42,10 @@ func GetUserRepo(config *configs.WebConfig, lg *logrus.Logger) (*PostgresReposit
 	return &postgreDb, nil
 }
 
+func (r *PostgresRepository) Close() error {
+	return r.db.Close()
+}
+
 func (r *PostgresRepository) InsertRequest(request *models.Request) error {
 	byteHeaders, err := json.Marshal(request.Headers)
 	if err != nil {
@@ -48,12 +57,24 @@ func (r *PostgresRepository) InsertRequest(request *models.Request) error {
 		return err
 	}
 
+	byteRules, err := json.Marshal(notNullRules(request.RulesFired))
+	if err != nil {
+		return err
+	}
+
+	stampCreatedAt(request)
+	decoded, decodedTruncated := decodedBody(request.Body, request.Headers, request.BodyTruncated, r.decodeLimit)
+	request.DecodedTruncated = decodedTruncated
 	if err = r.db.QueryRow(
-		"INSERT INTO requests(method, scheme, host, path, headers, body, params) "+
-			"VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+		"INSERT INTO requests(method, scheme, host, path, proto, headers, body, decoded_body, params, connection_id, rules_fired, body_text, "+
+			"created_at, client_addr, listener, sni, req_id, body_truncated, body_length, decoded_truncated) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) "+
 			"RETURNING id",
-		request.Method, request.Scheme, request.Host, request.Path,
-		string(byteHeaders), request.Body, byteParams).
+		request.Method, request.Scheme, request.Host, request.Path, request.Proto,
+		string(byteHeaders), notNull(request.Body), decoded, byteParams, request.ConnectionId,
+		string(byteRules), bodyText(request.Body, decoded, request.Headers),
+		request.CreatedAt, request.ClientAddr, request.Listener, request.SNI, request.ReqId,
+		request.BodyTruncated, request.BodyLength, request.DecodedTruncated).
 		Scan(&request.Id); err != nil {
 		return err
 	}
@@ -61,38 +82,121 @@ func (r *PostgresRepository) InsertRequest(request *models.Request) error {
 	return nil
 }
 
-func safeJSONMarshal(data interface{}) ([]byte, error) {
-    rawBytes, err := json.Marshal(data)
-    if err == nil {
-        return rawBytes, nil
-    }
+// decodedBody is the decoded copy of an encoded body, nil when the body is
+// not encoded or does not decode. A copy cut at limit is kept and reported.
+func decodedBody(body []byte, headers map[string][]string, truncated bool, limit int64) ([]byte, bool) {
+	encodings := decoder.Encodings(headers)
+	if len(encodings) == 0 {
+		return nil, false
+	}
+
+	decoded, err := decoder.Decode(body, encodings, limit)
+	tooLarge := errors.Is(err, decoder.ErrTooLarge)
+	if err != nil && !tooLarge && !(truncated && len(decoded) > 0) {
+		return nil, false
+	}
+
+	if decoded == nil {
+		decoded = []byte{}
+	}
+
+	return decoded, tooLarge
+}
+
+// sqlArgs collects the arguments of a query built from filters, add returns
+// the placeholder of the argument it added.
+type sqlArgs []interface{}
+
+func (a *sqlArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// hostCondition matches r.host like matchHost does.
+func hostCondition(args *sqlArgs, host string) string {
+	host = strings.ToLower(host)
+	return "(lower(r.host) = " + args.add(host) + " OR lower(r.host) LIKE " + args.add(likePrefix(host+":")) + ")"
+}
+
+// addrCondition matches an address column like matchAddr does.
+func addrCondition(args *sqlArgs, column, addr string) string {
+	return "(" + column + " = " + args.add(addr) +
+		" OR " + column + " LIKE " + args.add(likePrefix(addr+":")) +
+		" OR " + column + " LIKE " + args.add(likePrefix("["+addr+"]:")) + ")"
+}
+
+func timeConditions(args *sqlArgs, since, until time.Time) []string {
+	var conditions []string
+	if !since.IsZero() {
+		conditions = append(conditions, "r.created_at >= "+args.add(since))
+	}
+	if !until.IsZero() {
+		conditions = append(conditions, "r.created_at < "+args.add(until))
+	}
 
-    safeBytes := bytes.Map(func(r rune) rune {
-        if r < utf8.RuneSelf {
-            return -1
-        }
-        return r
-    }, rawBytes)
+	return conditions
+}
 
-    return json.Marshal(struct {
-        Headers string
-    }{
-        Headers: string(safeBytes),
-    })
+// likePrefix escapes the LIKE wildcards of prefix and matches anything after it
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+// notNull keeps empty bodies from being sent as NULL into NOT NULL bytea columns
+func notNull(body []byte) []byte {
+	if body == nil {
+		return []byte{}
+	}
+
+	return body
+}
+
+func notNullRules(rules []string) []string {
+	if rules == nil {
+		return []string{}
+	}
+
+	return rules
+}
+
+func useDecodedBodies(requestData *models.RequestData, requestDecoded, responseDecoded []byte) {
+	if requestDecoded != nil {
+		requestData.Request.Body = requestDecoded
+		requestData.Request.BodyDecoded = true
+	}
+
+	if responseDecoded != nil {
+		requestData.Response.Body = responseDecoded
+		requestData.Response.BodyDecoded = true
+	}
 }
 
 func (r *PostgresRepository) InsertResponse(response *models.Response) error {
-	byteHeaders, err := safeJSONMarshal(response.Headers)
+	byteHeaders, err := json.Marshal(response.Headers)
+	if err != nil {
+		return err
+	}
+
+	byteRules, err := json.Marshal(notNullRules(response.RulesFired))
 	if err != nil {
 		return err
 	}
 
+	decoded, decodedTruncated := decodedBody(response.Body, response.Headers, response.BodyTruncated, r.decodeLimit)
+	response.DecodedTruncated = decodedTruncated
 	if err = r.db.QueryRow(
-		"INSERT INTO responses(request_id, code, message, headers, body) "+
-			"VALUES ($1, $2, $3, $4, $5) "+
+		"INSERT INTO responses(request_id, code, message, proto, headers, body, decoded_body, body_truncated, body_length, rules_fired, "+
+			"tls_version, tls_cipher, tls_certificates, started_at, dns_start, dns_ms, connect_start, connect_ms, tls_start, tls_ms, "+
+			"ttfb_ms, total_ms, conn_reused, body_text, decoded_truncated) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25) "+
 			"RETURNING id",
-		response.RequestId, response.Code, response.Message,
-		string(byteHeaders), response.Body).
+		response.RequestId, response.Code, response.Message, response.Proto,
+		string(byteHeaders), notNull(response.Body), decoded,
+		response.BodyTruncated, response.BodyLength, string(byteRules),
+		response.TLSVersion, response.TLSCipher, response.TLSCertificates,
+		response.Timings.Start, response.Timings.DNSStart, response.Timings.DNS, response.Timings.ConnectStart, response.Timings.Connect,
+		response.Timings.TLSStart, response.Timings.TLS, response.Timings.FirstByte, response.Timings.Total, response.Timings.Reused,
+		bodyText(response.Body, decoded, response.Headers), response.DecodedTruncated).
 		Scan(&response.Id); err != nil {
 		return err
 	}
@@ -101,9 +205,10 @@ func (r *PostgresRepository) InsertResponse(response *models.Response) error {
 }
 
 func (r *PostgresRepository) GetRequestById(id int64) (*models.Request, error) {
-	row := r.db.QueryRow("SELECT id, method, scheme, host, path, headers, body, params from requests where id = $1", id)
+	row := r.db.QueryRow("SELECT id, method, scheme, host, path, proto, headers, body, params, connection_id, rules_fired, "+
+		"created_at, client_addr, listener, sni, req_id, body_truncated, body_length, decoded_truncated from requests where id = $1", id)
 
-	var headersRaw, paramsRaw []byte
+	var headersRaw, paramsRaw, rulesRaw []byte
 	selectedRequest := &models.Request{}
 	err := row.Scan(
 		&selectedRequest.Id,
@@ -111,10 +216,24 @@ func (r *PostgresRepository) GetRequestById(id int64) (*models.Request, error) {
 		&selectedRequest.Scheme,
 		&selectedRequest.Host,
 		&selectedRequest.Path,
+		&selectedRequest.Proto,
 		&headersRaw,
 		&selectedRequest.Body,
 		&paramsRaw,
+		&selectedRequest.ConnectionId,
+		&rulesRaw,
+		&selectedRequest.CreatedAt,
+		&selectedRequest.ClientAddr,
+		&selectedRequest.Listener,
+		&selectedRequest.SNI,
+		&selectedRequest.ReqId,
+		&selectedRequest.BodyTruncated,
+		&selectedRequest.BodyLength,
+		&selectedRequest.DecodedTruncated,
 	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -129,18 +248,26 @@ func (r *PostgresRepository) GetRequestById(id int64) (*models.Request, error) {
 		return nil, err
 	}
 
+	err = json.Unmarshal(rulesRaw, &selectedRequest.RulesFired)
+	if err != nil {
+		return nil, err
+	}
+
 	return selectedRequest, nil
 }
 
-func (r *PostgresRepository) GetRequestDataById(id int64) (*models.RequestData, error) {
+func (r *PostgresRepository) GetRequestDataById(id int64, raw bool) (*models.RequestData, error) {
 	row := r.db.QueryRow(
-		"SELECT r.id, r.method, r.scheme, r.host, r.path, r.headers, r.body, r.params, "+
-			"rp.id, rp.request_id, rp.code, rp.message, rp.headers, rp.body "+
+		"SELECT r.id, r.method, r.scheme, r.host, r.path, r.proto, r.headers, r.body, r.decoded_body, r.params, r.connection_id, r.rules_fired, "+
+			"r.created_at, r.client_addr, r.listener, r.sni, r.req_id, r.body_truncated, r.body_length, r.decoded_truncated, "+
+			"rp.id, rp.request_id, rp.code, rp.message, rp.proto, rp.headers, rp.body, rp.decoded_body, rp.body_truncated, rp.body_length, rp.decoded_truncated, rp.rules_fired, rp.tls_version, rp.tls_cipher, rp.tls_certificates, "+
+			"rp.started_at, rp.dns_start, rp.dns_ms, rp.connect_start, rp.connect_ms, rp.tls_start, rp.tls_ms, rp.ttfb_ms, rp.total_ms, rp.conn_reused "+
 			"from requests r "+
 			"JOIN responses rp ON r.id = rp.request_id "+
 			"where r.id = $1", id)
 
-	var headersRaw, paramsRaw, respRaw []byte
+	var headersRaw, paramsRaw, respRaw, reqRulesRaw, respRulesRaw []byte
+	var requestDecoded, responseDecoded []byte
 	requestData := &models.RequestData{}
 	err := row.Scan(
 		&requestData.Request.Id,
@@ -148,16 +275,50 @@ func (r *PostgresRepository) GetRequestDataById(id int64) (*models.RequestData,
 		&requestData.Request.Scheme,
 		&requestData.Request.Host,
 		&requestData.Request.Path,
+		&requestData.Request.Proto,
 		&headersRaw,
 		&requestData.Request.Body,
+		&requestDecoded,
 		&paramsRaw,
+		&requestData.Request.ConnectionId,
+		&reqRulesRaw,
+		&requestData.Request.CreatedAt,
+		&requestData.Request.ClientAddr,
+		&requestData.Request.Listener,
+		&requestData.Request.SNI,
+		&requestData.Request.ReqId,
+		&requestData.Request.BodyTruncated,
+		&requestData.Request.BodyLength,
+		&requestData.Request.DecodedTruncated,
 		&requestData.Response.Id,
 		&requestData.Response.RequestId,
 		&requestData.Response.Code,
 		&requestData.Response.Message,
+		&requestData.Response.Proto,
 		&respRaw,
 		&requestData.Response.Body,
+		&responseDecoded,
+		&requestData.Response.BodyTruncated,
+		&requestData.Response.BodyLength,
+		&requestData.Response.DecodedTruncated,
+		&respRulesRaw,
+		&requestData.Response.TLSVersion,
+		&requestData.Response.TLSCipher,
+		&requestData.Response.TLSCertificates,
+		&requestData.Response.Timings.Start,
+		&requestData.Response.Timings.DNSStart,
+		&requestData.Response.Timings.DNS,
+		&requestData.Response.Timings.ConnectStart,
+		&requestData.Response.Timings.Connect,
+		&requestData.Response.Timings.TLSStart,
+		&requestData.Response.Timings.TLS,
+		&requestData.Response.Timings.FirstByte,
+		&requestData.Response.Timings.Total,
+		&requestData.Response.Timings.Reused,
 	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -177,22 +338,124 @@ func (r *PostgresRepository) GetRequestDataById(id int64) (*models.RequestData,
 		return nil, err
 	}
 
+	err = unmarshalRulesFired(requestData, reqRulesRaw, respRulesRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	if !raw {
+		useDecodedBodies(requestData, requestDecoded, responseDecoded)
+	}
+
 	return requestData, nil
 }
 
-func (r *PostgresRepository) GetAllRequestsData() ([]*models.RequestData, error) {
+// historyOrder maps the sort keys of a history query onto columns, anything
+// else would end up in the SQL text. Ties are broken by request id, for the
+// timings through responses.request_id so the timing indexes cover the order.
+var historyOrder = map[string][2]string{
+	models.SortById:      {"r.id", "r.id"},
+	models.SortByLatency: {"rp.total_ms", "rp.request_id"},
+	models.SortByTTFB:    {"rp.ttfb_ms", "rp.request_id"},
+}
+
+func (r *PostgresRepository) GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error) {
+	order, ok := historyOrder[query.SortBy]
+	if !ok {
+		order = historyOrder[models.SortById]
+	}
+
+	direction, after := "ASC", ">"
+	if query.Descending {
+		direction, after = "DESC", "<"
+	}
+
+	var where []string
+	var args sqlArgs
+	arg := args.add
+
+	if query.Host != "" {
+		where = append(where, hostCondition(&args, query.Host))
+	}
+	if query.Method != "" {
+		where = append(where, "r.method = "+arg(query.Method))
+	}
+	if query.StatusMin > 0 {
+		where = append(where, "rp.code >= "+arg(query.StatusMin))
+	}
+	if query.StatusMax > 0 {
+		where = append(where, "rp.code <= "+arg(query.StatusMax))
+	}
+	// path, path_regex, content_type and body_contains are not indexed, they
+	// are checked on the rows the other conditions select
+	if query.Path != "" {
+		where = append(where, "strpos(r.path, "+arg(query.Path)+") > 0")
+	}
+	if query.PathRegex != "" {
+		where = append(where, "r.path ~ "+arg(query.PathRegex))
+	}
+	if query.ClientAddr != "" {
+		where = append(where, addrCondition(&args, "r.client_addr", query.ClientAddr))
+	}
+	if query.Listener != "" {
+		where = append(where, "r.listener = "+arg(query.Listener))
+	}
+	if query.SNI != "" {
+		where = append(where, "lower(r.sni) = "+arg(strings.ToLower(query.SNI)))
+	}
+	if query.Proto != "" {
+		where = append(where, "r.proto = "+arg(query.Proto))
+	}
+	if query.ConnectionId != "" {
+		where = append(where, "r.connection_id = "+arg(query.ConnectionId))
+	}
+	if query.ReqId != "" {
+		where = append(where, "r.req_id = "+arg(query.ReqId))
+	}
+	if query.ContentType != "" {
+		where = append(where, "strpos(lower(rp.headers->'Content-Type'->>0), "+arg(strings.ToLower(query.ContentType))+") > 0")
+	}
+	where = append(where, timeConditions(&args, query.Since, query.Until)...)
+	if len(query.BodyContains) > 0 {
+		body := arg(query.BodyContains)
+		where = append(where, "(position("+body+"::bytea in coalesce(r.decoded_body, r.body)) > 0 OR "+
+			"position("+body+"::bytea in coalesce(rp.decoded_body, rp.body)) > 0)")
+	}
+	if query.After != nil {
+		key := interface{}(query.After.Key)
+		if query.SortBy != models.SortByLatency && query.SortBy != models.SortByTTFB {
+			key = query.After.Id
+		}
+		where = append(where, "("+order[0]+", "+order[1]+") "+after+" ("+arg(key)+", "+arg(query.After.Id)+")")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ") + " "
+	}
+
+	limit := ""
+	if query.Limit > 0 {
+		limit = " LIMIT " + arg(query.Limit)
+	}
+
 	rows, err := r.db.Query(
-		"SELECT r.id, r.method, r.scheme, r.host, r.path, r.headers, r.body, r.params, " +
-			"rp.id, rp.request_id, rp.code, rp.message, rp.headers, rp.body " +
-			"from requests r " +
-			"JOIN responses rp ON r.id = rp.request_id")
+		"SELECT r.id, r.method, r.scheme, r.host, r.path, r.proto, r.headers, r.body, r.decoded_body, r.params, r.connection_id, r.rules_fired, "+
+			"r.created_at, r.client_addr, r.listener, r.sni, r.req_id, r.body_truncated, r.body_length, r.decoded_truncated, "+
+			"rp.id, rp.request_id, rp.code, rp.message, rp.proto, rp.headers, rp.body, rp.decoded_body, rp.body_truncated, rp.body_length, rp.decoded_truncated, rp.rules_fired, rp.tls_version, rp.tls_cipher, rp.tls_certificates, "+
+			"rp.started_at, rp.dns_start, rp.dns_ms, rp.connect_start, rp.connect_ms, rp.tls_start, rp.tls_ms, rp.ttfb_ms, rp.total_ms, rp.conn_reused "+
+			"from requests r "+
+			"JOIN responses rp ON r.id = rp.request_id "+
+			filter+
+			"ORDER BY "+order[0]+" "+direction+", "+order[1]+" "+direction+limit, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var requests []*models.RequestData
-	var headersRaw, paramsRaw, respRaw []byte
+	var headersRaw, paramsRaw, respRaw, reqRulesRaw, respRulesRaw []byte
+	var requestDecoded, responseDecoded []byte
 	for rows.Next() {
 		requestData := &models.RequestData{}
 		err = rows.Scan(
@@ -201,15 +464,46 @@ func (r *PostgresRepository) GetAllRequestsData() ([]*models.RequestData, error)
 			&requestData.Request.Scheme,
 			&requestData.Request.Host,
 			&requestData.Request.Path,
+			&requestData.Request.Proto,
 			&headersRaw,
 			&requestData.Request.Body,
+			&requestDecoded,
 			&paramsRaw,
+			&requestData.Request.ConnectionId,
+			&reqRulesRaw,
+			&requestData.Request.CreatedAt,
+			&requestData.Request.ClientAddr,
+			&requestData.Request.Listener,
+			&requestData.Request.SNI,
+			&requestData.Request.ReqId,
+			&requestData.Request.BodyTruncated,
+			&requestData.Request.BodyLength,
+			&requestData.Request.DecodedTruncated,
 			&requestData.Response.Id,
 			&requestData.Response.RequestId,
 			&requestData.Response.Code,
 			&requestData.Response.Message,
+			&requestData.Response.Proto,
 			&respRaw,
 			&requestData.Response.Body,
+			&responseDecoded,
+			&requestData.Response.BodyTruncated,
+			&requestData.Response.BodyLength,
+			&requestData.Response.DecodedTruncated,
+			&respRulesRaw,
+			&requestData.Response.TLSVersion,
+			&requestData.Response.TLSCipher,
+			&requestData.Response.TLSCertificates,
+			&requestData.Response.Timings.Start,
+			&requestData.Response.Timings.DNSStart,
+			&requestData.Response.Timings.DNS,
+			&requestData.Response.Timings.ConnectStart,
+			&requestData.Response.Timings.Connect,
+			&requestData.Response.Timings.TLSStart,
+			&requestData.Response.Timings.TLS,
+			&requestData.Response.Timings.FirstByte,
+			&requestData.Response.Timings.Total,
+			&requestData.Response.Timings.Reused,
 		)
 		if err != nil {
 			return nil, err
@@ -230,8 +524,251 @@ func (r *PostgresRepository) GetAllRequestsData() ([]*models.RequestData, error)
 			return nil, err
 		}
 
+		err = unmarshalRulesFired(requestData, reqRulesRaw, respRulesRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		useDecodedBodies(requestData, requestDecoded, responseDecoded)
 		requests = append(requests, requestData)
 	}
 
-	return requests, nil
+	return requests, rows.Err()
+}
+
+// headlineOptions shape the snippets of text searches like searcher.snippet
+// shapes the ones of regex searches.
+const headlineOptions = "'StartSel=" + models.SnippetStart + ", StopSel=" + models.SnippetStop + ", MaxFragments=2, MaxWords=20, MinWords=5'"
+
+// searchParts are the texts an exchange is searched by, table and id name
+// where a part lives and how it refers to its request. The text search
+// indexes are built on exactly these columns.
+var searchParts = []struct {
+	name   string
+	table  string
+	id     string
+	alias  string
+	column string
+}{
+	{name: models.SearchPartRequestHeaders, table: "requests", id: "id", alias: "r", column: "headers::text"},
+	{name: models.SearchPartRequestBody, table: "requests", id: "id", alias: "r", column: "body_text"},
+	{name: models.SearchPartResponseHeaders, table: "responses", id: "request_id", alias: "rp", column: "headers::text"},
+	{name: models.SearchPartResponseBody, table: "responses", id: "request_id", alias: "rp", column: "body_text"},
+}
+
+// Search runs text searches on the tsvector indexes, snippets are made by
+// ts_headline. Regex searches have no index to use and scan the exchanges
+// left by the host and time limits, their snippets are made in Go.
+func (r *PostgresRepository) Search(query models.SearchQuery) ([]*models.SearchResult, error) {
+	s, err := newSearcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var args sqlArgs
+	text := args.add(query.Text)
+
+	var where []string
+	if query.Host != "" {
+		where = append(where, hostCondition(&args, query.Host))
+	}
+	where = append(where, timeConditions(&args, query.Since, query.Until)...)
+
+	columns := make([]string, 0, len(searchParts))
+	matched := make([]string, 0, len(searchParts))
+	for _, part := range searchParts {
+		column := part.alias + "." + part.column
+		if query.Mode == models.SearchRegex {
+			columns = append(columns, column)
+			matched = append(matched, column+" ~ "+text)
+			continue
+		}
+
+		columns = append(columns, "CASE WHEN to_tsvector('simple', coalesce("+column+", '')) @@ q.query "+
+			"THEN ts_headline('simple', "+column+", q.query, "+headlineOptions+") END")
+		// one union branch per index, an OR across the join would use none
+		matched = append(matched, "SELECT "+part.id+" AS id FROM "+part.table+", q "+
+			"WHERE to_tsvector('simple', coalesce("+part.column+", '')) @@ q.query")
+	}
+
+	if query.Mode == models.SearchRegex {
+		where = append(where, "("+strings.Join(matched, " OR ")+")")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ") + " "
+	}
+
+	// regex results are limited while they are read, rows only postgres
+	// matches are dropped there and must not count
+	limit := ""
+	if query.Limit > 0 && query.Mode != models.SearchRegex {
+		limit = " LIMIT " + args.add(query.Limit)
+	}
+
+	var statement string
+	if query.Mode == models.SearchRegex {
+		statement = "SELECT r.id, " + strings.Join(columns, ", ") + " " +
+			"FROM requests r " +
+			"LEFT JOIN responses rp ON r.id = rp.request_id " +
+			filter +
+			"ORDER BY r.id DESC" + limit
+	} else {
+		statement = "WITH q AS (SELECT websearch_to_tsquery('simple', " + text + ") AS query), " +
+			"matched AS (" + strings.Join(matched, " UNION ") + ") " +
+			"SELECT r.id, " + strings.Join(columns, ", ") + " " +
+			"FROM matched " +
+			"JOIN requests r ON r.id = matched.id " +
+			"LEFT JOIN responses rp ON r.id = rp.request_id " +
+			"CROSS JOIN q " +
+			filter +
+			"ORDER BY r.id DESC" + limit
+	}
+
+	rows, err := r.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*models.SearchResult
+	for rows.Next() {
+		result := &models.SearchResult{}
+		texts := make([]sql.NullString, len(searchParts))
+		dest := []interface{}{&result.RequestId}
+		for i := range texts {
+			dest = append(dest, &texts[i])
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		for i, part := range searchParts {
+			if !texts[i].Valid {
+				continue
+			}
+
+			snippet := texts[i].String
+			if query.Mode == models.SearchRegex {
+				var ok bool
+				if snippet, ok = s.snippet(snippet); !ok {
+					continue
+				}
+			}
+
+			result.Matches = append(result.Matches, models.SearchMatch{Part: part.name, Snippet: snippet})
+		}
+
+		// the ~ of postgres and Go's regexp can disagree on the edges of POSIX
+		// syntax, an exchange without a snippet to show is not a result
+		if query.Mode == models.SearchRegex && len(result.Matches) == 0 {
+			continue
+		}
+
+		results = append(results, result)
+		if query.Limit > 0 && len(results) == query.Limit {
+			break
+		}
+	}
+
+	return results, rows.Err()
+}
+
+func unmarshalRulesFired(requestData *models.RequestData, requestRules, responseRules []byte) error {
+	if err := json.Unmarshal(requestRules, &requestData.Request.RulesFired); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(responseRules, &requestData.Response.RulesFired)
+}
+
+func (r *PostgresRepository) InsertWebSocketMessage(message *models.WebSocketMessage) error {
+	if err := r.db.QueryRow(
+		"INSERT INTO websocket_messages(request_id, direction, opcode, created_at, payload) "+
+			"VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING id",
+		message.RequestId, message.Direction, message.Opcode, message.Time, notNull(message.Payload)).
+		Scan(&message.Id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *PostgresRepository) GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error) {
+	rows, err := r.db.Query(
+		"SELECT id, request_id, direction, opcode, created_at, payload "+
+			"from websocket_messages "+
+			"where request_id = $1 "+
+			"ORDER BY id", requestId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*models.WebSocketMessage{}
+	for rows.Next() {
+		message := &models.WebSocketMessage{}
+		err = rows.Scan(
+			&message.Id,
+			&message.RequestId,
+			&message.Direction,
+			&message.Opcode,
+			&message.Time,
+			&message.Payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (r *PostgresRepository) InsertTLSEvent(event *models.TLSEvent) error {
+	if err := r.db.QueryRow(
+		"INSERT INTO tls_events(host, kind, connection_id, detail, created_at) "+
+			"VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING id",
+		event.Host, event.Kind, event.ConnectionId, event.Detail, event.Time).
+		Scan(&event.Id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *PostgresRepository) GetTLSEvents() ([]*models.TLSEvent, error) {
+	rows, err := r.db.Query(
+		"SELECT id, host, kind, connection_id, detail, created_at " +
+			"from tls_events " +
+			"ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*models.TLSEvent{}
+	for rows.Next() {
+		event := &models.TLSEvent{}
+		err = rows.Scan(
+			&event.Id,
+			&event.Host,
+			&event.Kind,
+			&event.ConnectionId,
+			&event.Detail,
+			&event.Time,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
 }
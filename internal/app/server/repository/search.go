@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
+)
+
+const (
+	// maxSearchText caps the text kept per body for search. Postgres rejects a
+	// tsvector over a megabyte, and the one of a body costs up to about six
+	// bytes per byte of text with every word distinct: the lexeme itself, a
+	// four-byte entry and a two-byte position per word. 128KB keeps the worst
+	// case under the limit.
+	maxSearchText = 128 << 10
+	// snippetContext is how much text a snippet shows on either side of the
+	// first match.
+	snippetContext = 60
+)
+
+// searcher finds the matches of a search in Go, for the embedded backends and
+// for the snippets of regex searches on postgres. In text mode every word of
+// the query has to be in the searched part, compared case-insensitively.
+type searcher struct {
+	patterns []*regexp.Regexp
+}
+
+func newSearcher(query models.SearchQuery) (*searcher, error) {
+	var patterns []*regexp.Regexp
+	switch query.Mode {
+	case "", models.SearchText:
+		for _, word := range strings.Fields(strings.ReplaceAll(query.Text, `"`, " ")) {
+			patterns = append(patterns, regexp.MustCompile("(?i)"+regexp.QuoteMeta(word)))
+		}
+	case models.SearchRegex:
+		if query.Text != "" {
+			pattern, err := regexp.CompilePOSIX(query.Text)
+			if err != nil {
+				return nil, fmt.Errorf("search regex: %w", err)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("unknown search mode %q", query.Mode)
+	}
+
+	if len(patterns) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+
+	return &searcher{patterns: patterns}, nil
+}
+
+// snippet returns the text around the first match with every match in it
+// marked, false when the text does not match.
+func (s *searcher) snippet(text string) (string, bool) {
+	var matches [][]int
+	for _, pattern := range s.patterns {
+		found := pattern.FindAllStringIndex(text, -1)
+		if found == nil {
+			return "", false
+		}
+		matches = append(matches, found...)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i][0] < matches[j][0]
+	})
+
+	start := max(0, matches[0][0]-snippetContext)
+	end := min(len(text), matches[0][1]+snippetContext)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+
+	pos := start
+	for _, match := range matches {
+		// empty and overlapping matches have nothing left to mark
+		if match[0] >= end {
+			break
+		}
+		if match[0] < pos || match[0] == match[1] {
+			continue
+		}
+
+		b.WriteString(text[pos:match[0]])
+		b.WriteString(models.SnippetStart)
+		b.WriteString(text[match[0]:match[1]])
+		b.WriteString(models.SnippetStop)
+		pos = match[1]
+	}
+
+	end = max(end, pos)
+	b.WriteString(text[pos:end])
+	if end < len(text) {
+		b.WriteString("…")
+	}
+
+	return b.String(), true
+}
+
+// searchParts runs the searcher over every part of an exchange, response is
+// nil while the exchange has none. The bodies have to be the decoded ones.
+func (s *searcher) searchParts(request *models.Request, response *models.Response) []models.SearchMatch {
+	type part struct {
+		name string
+		text string
+		ok   bool
+	}
+
+	parts := []part{{name: models.SearchPartRequestHeaders}, {name: models.SearchPartRequestBody}}
+	parts[0].text, parts[0].ok = headersText(request.Headers)
+	parts[1].text, parts[1].ok = searchText(request.Body, request.Headers)
+
+	if response != nil {
+		parts = append(parts, part{name: models.SearchPartResponseHeaders}, part{name: models.SearchPartResponseBody})
+		parts[2].text, parts[2].ok = headersText(response.Headers)
+		parts[3].text, parts[3].ok = searchText(response.Body, response.Headers)
+	}
+
+	var matches []models.SearchMatch
+	for _, p := range parts {
+		if !p.ok {
+			continue
+		}
+
+		if snippet, ok := s.snippet(p.text); ok {
+			matches = append(matches, models.SearchMatch{Part: p.name, Snippet: snippet})
+		}
+	}
+
+	return matches
+}
+
+func headersText(headers map[string][]string) (string, bool) {
+	text, err := json.Marshal(headers)
+	if err != nil {
+		return "", false
+	}
+
+	return string(text), true
+}
+
+// searchText is the text a body is searched by, false for binary bodies.
+func searchText(body []byte, headers map[string][]string) (string, bool) {
+	text, ok := models.BodyText(body, headers)
+	if !ok {
+		return "", false
+	}
+
+	if len(text) > maxSearchText {
+		end := maxSearchText
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end]
+	}
+
+	return text, true
+}
+
+// bodyText fills the body_text column, NULL for binary bodies. searchText has
+// already cut the text to maxSearchText: the search indexes build a tsvector
+// from body_text on every insert, and an over-long one fails the insert.
+func bodyText(body, decoded []byte, headers map[string][]string) sql.NullString {
+	if decoded != nil {
+		body = decoded
+	}
+
+	text, ok := searchText(body, headers)
+	return sql.NullString{String: text, Valid: ok}
+}
@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBodyTextIsBounded(t *testing.T) {
+	headers := map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "short", body: "a short body", want: len("a short body")},
+		{name: "at the bound", body: strings.Repeat("a", maxSearchText), want: maxSearchText},
+		{name: "ascii over the bound", body: strings.Repeat("word ", maxSearchText), want: maxSearchText},
+		// a three-byte rune straddles the bound and is dropped whole
+		{name: "utf-8 over the bound", body: "a" + strings.Repeat("€", maxSearchText), want: maxSearchText - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := bodyText([]byte(tt.body), nil, headers)
+			if !text.Valid {
+				t.Fatal("body_text is NULL for a text body")
+			}
+			if len(text.String) != tt.want || !utf8.ValidString(text.String) {
+				t.Errorf("body_text is %d bytes (valid utf-8 %v), want %d", len(text.String), utf8.ValidString(text.String), tt.want)
+			}
+		})
+	}
+
+	if text := bodyText([]byte{0x00, 0xff, 0xfe}, nil, map[string][]string{"Content-Type": {"application/octet-stream"}}); text.Valid {
+		t.Errorf("body_text = %q for a binary body, want NULL", text.String)
+	}
+}
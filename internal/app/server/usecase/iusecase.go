@@ -4,8 +4,14 @@ import "github.com/JuFnd/go-proxy/internal/app/server/pkg/models"
 
 type IUseCase interface {
 	GetRequestById(id int64) (*models.Request, error)
-	GetRequestDataById(id int64) (*models.RequestData, error)
-	GetAllRequestsData() ([]*models.RequestData, error)
+	GetRequestDataById(id int64, raw bool) (*models.RequestData, error)
+	GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error)
+	Search(query models.SearchQuery) ([]*models.SearchResult, error)
 	SaveRequest(request *models.Request) error
 	SaveResponse(response *models.Response) error
+	SaveWebSocketMessage(message *models.WebSocketMessage) error
+	GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error)
+	SaveTLSEvent(event *models.TLSEvent) error
+	GetTLSEvents() ([]*models.TLSEvent, error)
+	Close() error
 }
@@ -15,16 +15,20 @@ func NewProxyUseCase(proxyRepository repository.IRepository) IUseCase {
 	}
 }
 
-func (u *ProxyUseCase) GetRequestDataById(id int64) (*models.RequestData, error) {
-	return u.proxyRepository.GetRequestDataById(id)
+func (u *ProxyUseCase) GetRequestDataById(id int64, raw bool) (*models.RequestData, error) {
+	return u.proxyRepository.GetRequestDataById(id, raw)
 }
 
 func (u *ProxyUseCase) GetRequestById(id int64) (*models.Request, error) {
 	return u.proxyRepository.GetRequestById(id)
 }
 
-func (u *ProxyUseCase) GetAllRequestsData() ([]*models.RequestData, error) {
-	return u.proxyRepository.GetAllRequestsData()
+func (u *ProxyUseCase) GetAllRequestsData(query models.HistoryQuery) ([]*models.RequestData, error) {
+	return u.proxyRepository.GetAllRequestsData(query)
+}
+
+func (u *ProxyUseCase) Search(query models.SearchQuery) ([]*models.SearchResult, error) {
+	return u.proxyRepository.Search(query)
 }
 
 func (u *ProxyUseCase) SaveRequest(request *models.Request) error {
@@ -35,3 +39,23 @@ func (u *ProxyUseCase) SaveResponse(response *models.Response) error {
 	return u.proxyRepository.InsertResponse(response)
 }
 
+func (u *ProxyUseCase) SaveWebSocketMessage(message *models.WebSocketMessage) error {
+	return u.proxyRepository.InsertWebSocketMessage(message)
+}
+
+func (u *ProxyUseCase) GetWebSocketMessages(requestId int64) ([]*models.WebSocketMessage, error) {
+	return u.proxyRepository.GetWebSocketMessages(requestId)
+}
+
+func (u *ProxyUseCase) SaveTLSEvent(event *models.TLSEvent) error {
+	return u.proxyRepository.InsertTLSEvent(event)
+}
+
+func (u *ProxyUseCase) GetTLSEvents() ([]*models.TLSEvent, error) {
+	return u.proxyRepository.GetTLSEvents()
+}
+
+// Close releases the storage once nothing writes to it anymore.
+func (u *ProxyUseCase) Close() error {
+	return u.proxyRepository.Close()
+}
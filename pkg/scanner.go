@@ -8,7 +8,9 @@ import (
 	"strings"
 )
 
-func DirBusterScan(baseURL string, dictFilePath string) map[string]bool {
+// DirBusterScan sends a HEAD for every path of the dictionary, allowed (when
+// not nil) is asked first and the paths it refuses are never requested.
+func DirBusterScan(client *http.Client, baseURL string, dictFilePath string, allowed func(u *url.URL) bool) map[string]bool {
     foundFiles := make(map[string]bool)
 
     data, err := ioutil.ReadFile(dictFilePath)
@@ -22,9 +24,16 @@ func DirBusterScan(baseURL string, dictFilePath string) map[string]bool {
     for _, line := range lines {
         lineTrimmed := strings.TrimSpace(line)
         if len(lineTrimmed) > 0 {
-            u.Path = lineTrimmed
-            resp, err := http.Head(u.String())
-            if err == nil && resp.StatusCode != 404 {
+            u.Path = "/" + strings.TrimPrefix(lineTrimmed, "/")
+            if allowed != nil && !allowed(u) {
+                continue
+            }
+            resp, err := client.Head(u.String())
+            if err != nil {
+                continue
+            }
+            resp.Body.Close()
+            if resp.StatusCode != 404 {
                 foundFiles[lineTrimmed] = true
             }
         }
@@ -33,8 +42,8 @@ func DirBusterScan(baseURL string, dictFilePath string) map[string]bool {
     return foundFiles
 }
 
-func Scan(request *http.Request, dictFilePath string) map[string]bool {
+func Scan(client *http.Client, request *http.Request, dictFilePath string, allowed func(u *url.URL) bool) map[string]bool {
     parsedDictFilePath := strings.ReplaceAll(dictFilePath, "\\", "/")
-    foundFiles := DirBusterScan(request.URL.String(), parsedDictFilePath)
+    foundFiles := DirBusterScan(client, request.URL.String(), parsedDictFilePath, allowed)
     return foundFiles
 }
\ No newline at end of file
@@ -0,0 +1,48 @@
+package scanner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScanSkipsRefusedPaths(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+
+	dict := filepath.Join(t.TempDir(), "dict.txt")
+	if err := os.WriteFile(dict, []byte("admin\n/private/keys\nmissing\n\nprivate\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, target.URL+"/index", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := Scan(target.Client(), request, dict, func(u *url.URL) bool {
+		return !strings.HasPrefix(u.Path, "/private")
+	})
+
+	if len(found) != 1 || !found["admin"] {
+		t.Errorf("Scan() found %v, want only admin", found)
+	}
+	if strings.Join(requested, ",") != "/admin,/missing" {
+		t.Errorf("target got %v, want the refused paths never requested", requested)
+	}
+}